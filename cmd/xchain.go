@@ -34,7 +34,7 @@ func main() {
 					},
 					&cli.StringFlag{
 						Name:     "chain",
-						Usage:    "Name of the source blockchain (e.g., ethereum, polygon)",
+						Usage:    "Name of the source blockchain (e.g., ethereum, polygon), a comma separated list of names or all",
 						Required: true,
 					},
 					&cli.BoolFlag{
@@ -57,11 +57,11 @@ func main() {
 						log.Fatal(err)
 					}
 
-					// Get source chain name
-					chainName := cctx.String("chain")
-					srcCfg, err := config.GetSourceConfig(cfg, chainName)
+					// Get source chain names
+					chainNames := cctx.String("chain")
+					srcCfgs, err := config.GetSourceConfigs(cfg, chainNames)
 					if err != nil {
-						log.Fatalf("Invalid chain name '%s': %v", chainName, err)
+						log.Fatalf("Invalid chain name '%s': %v", chainNames, err)
 					}
 
 					g, ctx := errgroup.WithContext(cctx.Context)
@@ -77,16 +77,19 @@ func main() {
 					})
 					g.Go(func() error {
 						if isAgg {
-							return aggregator.StartAggregationService(ctx, cfg, srcCfg)
-						}
-						return nil
-					})
-					g.Go(func() error {
-						if !isAgg && !isBuffer {
-							return deal.SmartContractDeal(ctx, cfg, srcCfg)
+							return aggregator.StartAggregationService(ctx, cfg, srcCfgs...)
 						}
 						return nil
 					})
+					// Run a relayer for each source chain
+					for _, srcCfg := range srcCfgs {
+						g.Go(func() error {
+							if !isAgg && !isBuffer {
+								return deal.SmartContractDeal(ctx, cfg, srcCfg)
+							}
+							return nil
+						})
+					}
 					return g.Wait()
 				},
 			},
@@ -132,6 +135,60 @@ func main() {
 					},
 				},
 			},
+			{
+				Name:  "proof",
+				Usage: "Export and verify data inclusion proofs of aggregated offers",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "export",
+						Usage:     "Print the PODSI inclusion proof of an offer as JSON",
+						ArgsUsage: "<offerID>",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "config",
+								Usage: "Path to the configuration file",
+								Value: "./config/config.json",
+							},
+							&cli.StringFlag{
+								Name:     "chain",
+								Usage:    "Name of the source blockchain (e.g., ethereum, polygon)",
+								Required: true,
+							},
+						},
+						Action: aggregator.ProofExportAction,
+					},
+					{
+						Name:      "verify",
+						Usage:     "Verify an inclusion proof JSON file locally",
+						ArgsUsage: "<proof.json>",
+						Action:    aggregator.ProofVerifyAction,
+					},
+				},
+			},
+			{
+				Name:  "deal",
+				Usage: "Manage storage deals of aggregates",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "mark-imported",
+						Usage:     "Mark an offline deal as imported by its storage provider",
+						ArgsUsage: "<dealUUID>",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "config",
+								Usage: "Path to the configuration file",
+								Value: "./config/config.json",
+							},
+							&cli.StringFlag{
+								Name:     "chain",
+								Usage:    "Name of the source blockchain (e.g., ethereum, polygon)",
+								Required: true,
+							},
+						},
+						Action: aggregator.MarkImportedAction,
+					},
+				},
+			},
 			{
 				Name:  "generate-account",
 				Usage: "Generate a new Ethereum keystore account",
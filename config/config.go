@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 )
 
 // DestinationChainConfig represents the Filecoin destination.
@@ -15,30 +17,127 @@ type DestinationChainConfig struct {
 
 // SourceChainConfig represents a blockchain that can send data to Filecoin.
 type SourceChainConfig struct {
-	ChainID       int    `json:"ChainID"`
-	Api           string `json:"Api"`
-	OnRampAddress string `json:"OnRampAddress"`
+	ChainID       int      `json:"ChainID"`
+	Api           string   `json:"Api"`
+	OnRampAddress string   `json:"OnRampAddress"`
+	StartBlock    uint64   `json:"StartBlock"`    // first block to backfill events from when no checkpoint exists
+	BackfillRange uint64   `json:"BackfillRange"` // max number of blocks per FilterLogs query while backfilling
+	Confirmations uint64   `json:"Confirmations"` // blocks an event must be buried under before it is aggregated
+	Tx            TxConfig `json:"Tx"`
+}
+
+// TxConfig controls fees and replacement of transactions sent to a source chain.
+type TxConfig struct {
+	MaxFeePerGas         uint64 `json:"MaxFeePerGas"`         // cap on the fee per gas in wei, 0 for no cap
+	MaxPriorityFeePerGas uint64 `json:"MaxPriorityFeePerGas"` // cap on the priority fee per gas in wei, 0 for no cap
+	ReceiptTimeout       int    `json:"ReceiptTimeout"`       // seconds to wait for inclusion before replacing a transaction
+	FeeBumpPercent       int    `json:"FeeBumpPercent"`       // fee increase of each replacement
+	MaxReplacements      int    `json:"MaxReplacements"`      // replacements sent before giving up on a transaction
+}
+
+// AdmissionPolicyConfig restricts which offers the aggregator accepts. Empty rules allow everything.
+type AdmissionPolicyConfig struct {
+	AllowedTokens    []string          `json:"AllowedTokens"`
+	MinPricePerByte  map[string]string `json:"MinPricePerByte"` // token address to minimum amount per padded byte
+	MaxPieceSize     uint64            `json:"MaxPieceSize"`
+	AllowedSchemes   []string          `json:"AllowedSchemes"`
+	AllowedHosts     []string          `json:"AllowedHosts"`
+	DeniedSubmitters []string          `json:"DeniedSubmitters"`
+}
+
+// DealRetryConfig controls how failed deal proposals are re-proposed.
+type DealRetryConfig struct {
+	MaxAttempts int  `json:"MaxAttempts"` // proposals per aggregate before giving up
+	Backoff     int  `json:"Backoff"`     // seconds before the first retry, doubled after every failure
+	MaxBackoff  int  `json:"MaxBackoff"`  // upper bound of the backoff in seconds
+	Failover    bool `json:"Failover"`    // propose to alternate providers instead of only the assigned ones
+}
+
+// PieceFetchConfig controls how the aggregator fetches sub pieces from their buffer locations.
+type PieceFetchConfig struct {
+	Parallelism int `json:"Parallelism"` // sub pieces fetched at once
+	Retries     int `json:"Retries"`     // attempts after a failure without progress before giving up on a piece
+	Timeout     int `json:"Timeout"`     // seconds without progress after which a fetch is retried
+}
+
+// UploadConfig selects where staged aggregates are uploaded for storage providers to fetch them.
+type UploadConfig struct {
+	Backend string     `json:"Backend"` // lighthouse, s3, ipfs or none, defaults to lighthouse with a LighthouseApiKey and none without
+	S3      S3Config   `json:"S3"`
+	IPFS    IPFSConfig `json:"IPFS"`
+}
+
+// S3Config addresses a bucket of an S3-compatible object store.
+type S3Config struct {
+	Endpoint        string `json:"Endpoint"` // e.g. https://s3.us-east-1.amazonaws.com, objects are addressed path style
+	Region          string `json:"Region"`
+	Bucket          string `json:"Bucket"`
+	AccessKeyID     string `json:"AccessKeyID"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	PublicURL       string `json:"PublicURL"` // base URL providers fetch objects from, Endpoint/Bucket if empty
+}
+
+// IPFSConfig addresses the HTTP RPC API of an IPFS node.
+type IPFSConfig struct {
+	ApiURL     string `json:"ApiURL"`     // e.g. http://127.0.0.1:5001
+	GatewayURL string `json:"GatewayURL"` // gateway providers fetch uploaded aggregates from
+}
+
+// OfflineDealConfig makes deals offline, storage providers import the raw piece files of aggregates
+// shipped to them instead of fetching them.
+type OfflineDealConfig struct {
+	Enabled     bool   `json:"Enabled"`
+	MinDealSize uint64 `json:"MinDealSize"` // padded deal size from which deals are made offline, 0 for all deals
+	PiecePath   string `json:"PiecePath"`   // directory raw piece files of aggregates and their manifests are exported to
+}
+
+// DDOConfig onboards aggregates with Direct Data Onboarding, allocating DataCap from the
+// client contract in the verified registry instead of making market deals. Providers
+// import the exported aggregates by hand and their offers are not proven.
+type DDOConfig struct {
+	Enabled     bool     `json:"Enabled"`
+	MinDealSize uint64   `json:"MinDealSize"` // padded deal size from which aggregates are onboarded directly, 0 for all
+	TermMax     int64    `json:"TermMax"`     // epochs providers may earn power for the data, 5 years if 0
+	Tx          TxConfig `json:"Tx"`          // allocation transactions sent to the client contract on Filecoin
 }
 
 // Config holds all configuration parameters.
 type Config struct {
-	Destination      DestinationChainConfig       `json:"destination"`
-	Sources          map[string]SourceChainConfig `json:"sources"`
-	KeyPath          string                       `json:"KeyPath"`
-	ClientAddr       string                       `json:"ClientAddr"`
-	PayoutAddr       string                       `json:"PayoutAddr"`
-	OnRampABIPath    string                       `json:"OnRampABIPath"`
-	BufferPath       string                       `json:"BufferPath"`
-	BufferPort       int                          `json:"BufferPort"`
-	ProviderAddr     string                       `json:"ProviderAddr"`
-	LighthouseApiKey string                       `json:"LighthouseApiKey"`
-	LighthouseAuth   string                       `json:"LighthouseAuth"`
-	TransferIP       string                       `json:"TransferIP"`
-	TransferPort     int                          `json:"TransferPort"`
-	TargetAggSize    int                          `json:"TargetAggSize"`
-	MinDealSize      int                          `json:"MinDealSize"`
-	DealDelayEpochs  int                          `json:"DealDelayEpochs"`
-	DealDuration     int                          `json:"DealDuration"`
+	Destination         DestinationChainConfig       `json:"destination"`
+	Sources             map[string]SourceChainConfig `json:"sources"`
+	KeyPath             string                       `json:"KeyPath"`
+	ClientAddr          string                       `json:"ClientAddr"`
+	PayoutAddr          string                       `json:"PayoutAddr"`
+	OnRampABIPath       string                       `json:"OnRampABIPath"`
+	ProverABIPath       string                       `json:"ProverABIPath"`
+	BufferPath          string                       `json:"BufferPath"`
+	BufferPort          int                          `json:"BufferPort"`
+	ProviderAddr        string                       `json:"ProviderAddr"`
+	Providers           []string                     `json:"Providers"`
+	ReplicationFactor   int                          `json:"ReplicationFactor"`
+	DealRetry           DealRetryConfig              `json:"DealRetry"`
+	LighthouseApiKey    string                       `json:"LighthouseApiKey"`
+	LighthouseAuth      string                       `json:"LighthouseAuth"`
+	DealEngine          string                       `json:"DealEngine"`        // boost proposes deals directly, lighthouse submits uploaded aggregates to its deal engine
+	LighthouseDealURL   string                       `json:"LighthouseDealURL"` // Lighthouse deal engine endpoint
+	TransferIP          string                       `json:"TransferIP"`
+	TransferPort        int                          `json:"TransferPort"`
+	TargetAggSize       int                          `json:"TargetAggSize"`
+	MinDealSize         int                          `json:"MinDealSize"`
+	DealDelayEpochs     int                          `json:"DealDelayEpochs"`
+	DealDuration        int                          `json:"DealDuration"`
+	RenewalWindow       int                          `json:"RenewalWindow"` // epochs before a deal ends that it is renewed, 0 disables renewal
+	MaxAggregationDelay int                          `json:"MaxAggregationDelay"`
+	PackingStrategy     string                       `json:"PackingStrategy"`
+	AdmissionPolicy     AdmissionPolicyConfig        `json:"AdmissionPolicy"`
+	StatePath           string                       `json:"StatePath"`
+	StagingPath         string                       `json:"StagingPath"`         // directory aggregate files are written to before upload and transfer
+	StagingMinFreeSpace uint64                       `json:"StagingMinFreeSpace"` // bytes that must stay free after staging an aggregate
+	StagingRetention    string                       `json:"StagingRetention"`    // deal state after which staged aggregates are removed, empty keeps them
+	PieceFetch          PieceFetchConfig             `json:"PieceFetch"`
+	Upload              UploadConfig                 `json:"Upload"`
+	OfflineDeals        OfflineDealConfig            `json:"OfflineDeals"`
+	DDO                 DDOConfig                    `json:"DDO"`
 }
 
 // LoadConfig reads the configuration from a JSON file.
@@ -63,3 +162,31 @@ func GetSourceConfig(cfg *Config, network string) (*SourceChainConfig, error) {
 	}
 	return nil, fmt.Errorf("source chain configuration for '%s' not found", network)
 }
+
+// GetSourceConfigs retrieves the configurations of a comma separated list of
+// source chain names, or of every source chain for "all", ordered by name.
+func GetSourceConfigs(cfg *Config, networks string) ([]*SourceChainConfig, error) {
+	var names []string
+	if networks == "all" {
+		for name := range cfg.Sources {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	} else {
+		for _, name := range strings.Split(networks, ",") {
+			names = append(names, strings.TrimSpace(name))
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no source chains configured")
+	}
+	srcCfgs := make([]*SourceChainConfig, 0, len(names))
+	for _, name := range names {
+		srcCfg, err := GetSourceConfig(cfg, name)
+		if err != nil {
+			return nil, err
+		}
+		srcCfgs = append(srcCfgs, srcCfg)
+	}
+	return srcCfgs, nil
+}
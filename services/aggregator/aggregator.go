@@ -5,7 +5,6 @@ import (
 	"path/filepath"
 
 	"github.com/FIL-Builders/xchainClient/config"
-	"github.com/FIL-Builders/xchainClient/services/buffer"
 	"github.com/FIL-Builders/xchainClient/utils"
 
 	"context"
@@ -15,19 +14,19 @@ import (
 	"io"
 	"log"
 	"math/big"
-	"math/bits"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi"
-	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
@@ -37,6 +36,7 @@ import (
 	cborutil "github.com/filecoin-project/go-cbor-util"
 	"github.com/filecoin-project/go-data-segment/datasegment"
 	"github.com/filecoin-project/go-data-segment/merkletree"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
 	"github.com/filecoin-project/go-jsonrpc"
 	inet "github.com/libp2p/go-libp2p/core/network"
 
@@ -51,45 +51,85 @@ import (
 	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/host"
-	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/multiformats/go-multiaddr"
+	"github.com/mitchellh/go-homedir"
 )
 
 const (
 	// libp2p identifier for latest deal protocol
 	DealProtocolv120 = "/fil/storage/mk/1.2.0"
+	// libp2p identifier for the boost deal status protocol
+	DealStatusProtocolv120 = "/fil/storage/status/1.2.0"
+	// default location of the aggregator state database
+	DefaultStatePath = "~/.xchain/state"
+	// default number of blocks covered by one FilterLogs query while backfilling
+	defaultBackfillRange = 2000
+	// how often commits still pending on chain after a restart are checked
+	commitReconcileInterval = time.Minute
+	// how often the state of proposed deals is refreshed
+	dealTrackInterval = 5 * time.Minute
+)
+
+var (
+	// how often the source chain head is polled to release confirmed events
+	confirmationPollInterval = 5 * time.Second
+	// how often pending offers are checked against the max aggregation delay
+	aggregationTickInterval = 10 * time.Second
 )
 
 type aggregator struct {
-	client           *ethclient.Client         // raw client for log subscriptions
-	onramp           *bind.BoundContract       // onramp binding over raw client for message sending
-	auth             *bind.TransactOpts        // auth for message sending
-	abi              *abi.ABI                  // onramp abi for log subscription and message sending
-	onrampAddr       common.Address            // onramp address for log subscription
-	proverAddr       common.Address            // prover address for client contract deal
-	payoutAddr       common.Address            // aggregator payout address for receiving funds
-	ch               chan DataReadyEvent       // pass events to seperate goroutine for processing
-	transfers        map[int]AggregateTransfer // track aggregate data awaiting transfer
-	transferLk       sync.RWMutex              // Mutex protecting transfers map
-	transferID       int                       // ID of the next transfer
-	transferAddr     string                    // address to listen for transfer requests
-	minDealSize      uint64                    // minimum deal size
-	targetDealSize   uint64                    // how big aggregates should be
-	dealDelayEpochs  uint64                    // when the deal will be active, in blocks
-	dealDuration     uint64                    // how long the deal will be active, in blocks
-	host             host.Host                 // libp2p host for deal protocol to boost
-	spDealAddr       *peer.AddrInfo            // address to reach boost (or other) deal v 1.2 provider
-	spActorAddr      address.Address           // address of the storage provider actor
-	lotusAPI         v0api.FullNode            // Lotus API for determining deal start epoch and collateral bounds
-	LighthouseAuth   string                    // Auth token to interact with Lighthouse Deal Engine
-	lighthouseApiKey string                    // API key for lighthouse
-	cleanup          func()                    // cleanup function to call on shutdown
+	src                 *sourceChain              // source chain offers are taken from and aggregates committed to
+	abi                 *abi.ABI                  // onramp abi for log subscription and message sending
+	proverAddr          common.Address            // prover address for client contract deal
+	notifyClient        notifyClient              // destination chain client reading the prover's deal notifications
+	dealNotify          abi.Event                 // event the prover emits when a deal is published
+	payoutAddr          common.Address            // aggregator payout address for receiving funds
+	ch                  chan DataReadyEvent       // pass events to seperate goroutine for processing
+	retractCh           chan DataReadyEvent       // pass events removed by chain reorgs to aggregation
+	transfers           map[int]AggregateTransfer // track aggregate data awaiting transfer
+	transferLk          sync.RWMutex              // Mutex protecting transfers map
+	transferID          int                       // ID of the next transfer
+	pending             []DataReadyEvent          // offers awaiting aggregation, owned by runAggregate
+	store               *stateStore               // durable aggregator state surviving restarts
+	maxAggregationDelay time.Duration             // seal pending offers after waiting this long, 0 disables
+	transferAddr        string                    // address to listen for transfer requests
+	minDealSize         uint64                    // minimum deal size
+	targetDealSize      uint64                    // how big aggregates should be
+	maxDealSize         uint64                    // largest aggregate the packer may fill
+	packer              PackingStrategy           // chooses which pending offers go into an aggregate
+	policy              *admissionPolicy          // decides which offers are accepted for aggregation
+	dealDelayEpochs     uint64                    // when the deal will be active, in blocks
+	dealDuration        uint64                    // how long the deal will be active, in blocks
+	renewalWindow       filabi.ChainEpoch         // epochs before a deal ends that it is renewed
+	stagingPath         string                    // directory aggregate files are staged in
+	stagingMinFree      uint64                    // bytes that must stay free after staging an aggregate
+	stagingRetention    string                    // deal state after which staged aggregates are removed, empty keeps them
+	fetcher             *pieceFetcher             // fetches sub pieces from their buffer locations
+	stagedVerified      map[cid.Cid]time.Time     // modification time of staged aggregates when their commp was verified
+	stagingLk           sync.Mutex                // protects stagedVerified
+	stagingVerify       singleflight.Group        // verifies each staged aggregate once for concurrent transfers
+	host                host.Host                 // libp2p host for deal protocol to boost
+	providers           []storageProvider         // storage providers deals are proposed to
+	replicationFactor   int                       // number of providers that should store each aggregate
+	retry               retryPolicy               // when failed deals are re-proposed
+	replicateLk         sync.Mutex                // serializes proposals for the same aggregate
+	lotusAPI            v0api.FullNode            // Lotus API for determining deal start epoch and collateral bounds
+	dealEngine          *lighthouseDealEngine     // makes deals for uploaded aggregates instead of proposing them, nil with boost
+	uploader            AggregateUploader         // uploads staged aggregates for providers to fetch
+	offlineDeals        bool                      // propose offline deals for aggregates of at least offlineMinSize
+	offlineMinSize      uint64                    // padded deal size from which deals are made offline
+	exportPath          string                    // directory aggregates of offline deals are exported to
+	allocator           *allocator                // onboards aggregates with DDO instead of market deals, nil without
+	cleanup             func()                    // cleanup function to call on shutdown
 }
 
 // Define a Go struct to match the DataReady event from the OnRamp contract
 type DataReadyEvent struct {
-	Offer   Offer
-	OfferID uint64
+	Offer       Offer
+	OfferID     uint64
+	ChainID     int            // source chain the offer was made on
+	BlockNumber uint64         // source chain block the event was emitted in
+	BlockHash   common.Hash    // tells inclusions of the offer in different blocks apart
+	Submitter   common.Address // sender of the offer transaction, only resolved when the admission policy needs it
 }
 
 // Mirror OnRamp.sol's `Offer` struct
@@ -130,35 +170,66 @@ type (
 	LotusTSK               = lotustypes.TipSetKey
 )
 
-// Function to start the aggregation service
-func StartAggregationService(ctx context.Context, cfg *config.Config, srcCfg *config.SourceChainConfig) error {
-	aggregator, err := NewAggregator(ctx, cfg, srcCfg)
+// Function to start the aggregation service for the given source chains.
+// Each chain has its own aggregator, transfers of all aggregators are served
+// from the same address.
+func StartAggregationService(ctx context.Context, cfg *config.Config, srcCfgs ...*config.SourceChainConfig) error {
+	// Allocations of every aggregator are sent with the same key, one allocator
+	// assigns their nonces
+	allocator, err := newAllocator(ctx, cfg)
 	if err != nil {
 		return err
 	}
-	return aggregator.run(ctx)
-}
+	var aggs []*aggregator
+	for _, srcCfg := range srcCfgs {
+		a, err := NewAggregator(ctx, cfg, srcCfg, allocator)
+		if err != nil {
+			for _, a := range aggs {
+				a.cleanup()
+			}
+			return err
+		}
+		aggs = append(aggs, a)
+	}
 
-func NewAggregator(ctx context.Context, cfg *config.Config, srcCfg *config.SourceChainConfig) (*aggregator, error) {
-	client, err := ethclient.Dial(srcCfg.Api)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to Ethereum client for source chain at %s: %w", srcCfg.Api, err)
+	g, ctx := errgroup.WithContext(ctx)
+	for _, a := range aggs {
+		g.Go(func() error {
+			return a.run(ctx)
+		})
 	}
+	// Start handling data transfer requests
+	g.Go(func() error {
+		return serveTransfers(ctx, aggs[0].transferAddr, aggs)
+	})
+	return g.Wait()
+}
 
+func NewAggregator(ctx context.Context, cfg *config.Config, srcCfg *config.SourceChainConfig, allocator *allocator) (*aggregator, error) {
 	parsedABI, err := utils.LoadAbi(cfg.OnRampABIPath)
 	if err != nil {
 		return nil, err
 	}
+	src, err := newSourceChain(ctx, cfg, srcCfg)
+	if err != nil {
+		return nil, err
+	}
 	proverContractAddress := common.HexToAddress(cfg.Destination.ProverAddr)
-	onRampContractAddress := common.HexToAddress(srcCfg.OnRampAddress)
 	payoutAddress := common.HexToAddress(cfg.PayoutAddr)
-	onramp := bind.NewBoundContract(onRampContractAddress, *parsedABI, client, client, client)
-
-	//aggregator need to call smart contract on source Chain to send podsi proof
-	auth, err := utils.LoadPrivateKey(cfg, srcCfg.ChainID)
+	// IDs of published deals are learned from the prover's notifications
+	proverABI, err := utils.LoadAbi(cfg.ProverABIPath)
 	if err != nil {
 		return nil, err
 	}
+	dealNotify, ok := proverABI.Events["DealNotify"]
+	if !ok {
+		return nil, fmt.Errorf("prover abi %s has no DealNotify event", cfg.ProverABIPath)
+	}
+	filClient, err := ethclient.Dial(LotusEthURL(cfg.Destination.LotusAPI))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the Ethereum client on the destination chain: using url %s: %w", cfg.Destination.LotusAPI, err)
+	}
+
 	// TODO consider allowing config to specify listen addr and pid, for now it shouldn't matter as boost will entertain anybody
 	h, err := libp2p.New()
 	if err != nil {
@@ -170,65 +241,152 @@ func NewAggregator(ctx context.Context, cfg *config.Config, srcCfg *config.Sourc
 		return nil, fmt.Errorf("failed to connect to the Ethereum client on the destination chain: using url %s: %v", cfg.Destination.LotusAPI, err)
 	}
 
-	// Get maddr for dialing boost from on chain miner actor
-	providerAddr, err := address.NewFromString(cfg.ProviderAddr)
+	// Fall back to the single ProviderAddr when no provider list is configured
+	providerAddrs := cfg.Providers
+	if len(providerAddrs) == 0 {
+		providerAddrs = []string{cfg.ProviderAddr}
+	}
+	providers, err := resolveProviders(ctx, lAPI, providerAddrs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse provider address: %w", err)
+		return nil, err
+	}
+	replicationFactor := cfg.ReplicationFactor
+	if replicationFactor <= 0 {
+		replicationFactor = 1
+	}
+	if replicationFactor > len(providers) {
+		log.Printf("Replication factor %d exceeds the %d resolved storage providers", replicationFactor, len(providers))
 	}
-	minfo, err := lAPI.StateMinerInfo(ctx, providerAddr, lotustypes.EmptyTSK)
+
+	// Restore pending offers and scheduled transfers from the state store
+	statePath := stateStorePath(cfg, srcCfg.ChainID)
+	store, err := openStateStore(statePath)
 	if err != nil {
 		return nil, err
 	}
-	if minfo.PeerId == nil {
-		return nil, fmt.Errorf("sp has no peer id set on chain")
+	pending, err := store.pendingOffers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pending offers: %w", err)
 	}
-	var maddrs []multiaddr.Multiaddr
-	for _, mma := range minfo.Multiaddrs {
-		ma, err := multiaddr.NewMultiaddrBytes(mma)
+	transferID, err := store.nextTransferID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load next transfer ID: %w", err)
+	}
+	records, err := store.aggregates()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load aggregates: %w", err)
+	}
+	transfers := make(map[int]AggregateTransfer, len(records))
+	for _, rec := range records {
+		agg, err := datasegment.NewAggregate(filabi.PaddedPieceSize(rec.DealSize), rec.Pieces)
 		if err != nil {
-			return nil, fmt.Errorf("storage provider %s had invalid multiaddrs in their info: %w", providerAddr, err)
+			return nil, fmt.Errorf("failed to rebuild aggregate for transfer %d: %w", rec.TransferID, err)
+		}
+		transfers[rec.TransferID] = AggregateTransfer{
+			locations: rec.Locations,
+			agg:       agg,
 		}
-		maddrs = append(maddrs, ma)
 	}
-	if len(maddrs) == 0 {
-		return nil, fmt.Errorf("storage provider %s has no multiaddrs set on-chain", providerAddr)
+	log.Printf("Restored %d pending offers and %d transfers from %s", len(pending), len(transfers), statePath)
+
+	stagingPath := cfg.StagingPath
+	if stagingPath == "" {
+		stagingPath = defaultStagingPath
+	}
+	stagingPath, err = homedir.Expand(stagingPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute staging path: %w", err)
+	}
+	if err := os.MkdirAll(stagingPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
 	}
-	psPeerInfo := &peer.AddrInfo{
-		ID:    *minfo.PeerId,
-		Addrs: maddrs,
+	fetcher := newPieceFetcher(cfg.PieceFetch, stagingPath)
+	fetcher.removeLeftovers()
+	uploader, err := newAggregateUploader(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dealEngine, err := newDealEngine(cfg, uploader)
+	if err != nil {
+		return nil, err
+	}
+	exportPath, err := offlineExportPath(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if (cfg.OfflineDeals.Enabled || cfg.DDO.Enabled) && dealEngine != nil {
+		return nil, fmt.Errorf("offline deals and DDO are not supported by the %s deal engine", cfg.DealEngine)
+	}
+	switch cfg.StagingRetention {
+	case "", dealTransferring, dealSealing, dealActive, dealExpired:
+	default:
+		return nil, fmt.Errorf("invalid staging retention %q, expected transferring, sealing, active or expired", cfg.StagingRetention)
+	}
+
+	packer, err := NewPackingStrategy(cfg.PackingStrategy)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := newAdmissionPolicy(cfg.AdmissionPolicy)
+	if err != nil {
+		return nil, err
 	}
 
 	return &aggregator{
-		client:           client,
-		onramp:           onramp,
-		onrampAddr:       onRampContractAddress,
-		proverAddr:       proverContractAddress,
-		payoutAddr:       payoutAddress,
-		auth:             auth,
-		ch:               make(chan DataReadyEvent, 1024), // buffer many events since consumer sometimes waits for chain
-		transfers:        make(map[int]AggregateTransfer),
-		transferLk:       sync.RWMutex{},
-		transferAddr:     fmt.Sprintf("%s:%d", cfg.TransferIP, cfg.TransferPort),
-		abi:              parsedABI,
-		targetDealSize:   uint64(cfg.TargetAggSize),
-		minDealSize:      uint64(cfg.MinDealSize),
-		dealDelayEpochs:  uint64(cfg.DealDelayEpochs),
-		dealDuration:     uint64(cfg.DealDuration),
-		host:             h,
-		spDealAddr:       psPeerInfo,
-		spActorAddr:      providerAddr,
-		lotusAPI:         lAPI,
-		LighthouseAuth:   cfg.LighthouseAuth,
-		lighthouseApiKey: cfg.LighthouseApiKey,
+		src:                 src,
+		proverAddr:          proverContractAddress,
+		notifyClient:        filClient,
+		dealNotify:          dealNotify,
+		payoutAddr:          payoutAddress,
+		ch:                  make(chan DataReadyEvent, 1024), // buffer many events since consumer sometimes waits for chain
+		retractCh:           make(chan DataReadyEvent, 1024),
+		transfers:           transfers,
+		transferLk:          sync.RWMutex{},
+		transferID:          transferID,
+		pending:             pending,
+		store:               store,
+		maxAggregationDelay: time.Duration(cfg.MaxAggregationDelay) * time.Second,
+		transferAddr:        fmt.Sprintf("%s:%d", cfg.TransferIP, cfg.TransferPort),
+		abi:                 parsedABI,
+		targetDealSize:      uint64(cfg.TargetAggSize),
+		maxDealSize:         uint64(cfg.TargetAggSize),
+		packer:              packer,
+		policy:              policy,
+		minDealSize:         uint64(cfg.MinDealSize),
+		dealDelayEpochs:     uint64(cfg.DealDelayEpochs),
+		dealDuration:        uint64(cfg.DealDuration),
+		renewalWindow:       filabi.ChainEpoch(cfg.RenewalWindow),
+		stagingPath:         stagingPath,
+		stagingMinFree:      cfg.StagingMinFreeSpace,
+		stagingRetention:    cfg.StagingRetention,
+		fetcher:             fetcher,
+		stagedVerified:      make(map[cid.Cid]time.Time),
+		host:                h,
+		providers:           providers,
+		replicationFactor:   replicationFactor,
+		retry:               newRetryPolicy(cfg.DealRetry),
+		lotusAPI:            lAPI,
+		dealEngine:          dealEngine,
+		uploader:            uploader,
+		offlineDeals:        cfg.OfflineDeals.Enabled,
+		offlineMinSize:      cfg.OfflineDeals.MinDealSize,
+		exportPath:          exportPath,
+		allocator:           allocator,
 		cleanup: func() {
 			closer()
 			log.Printf("done with lotus api closer\n")
+			if err := store.Close(); err != nil {
+				log.Printf("failed to close state store: %s", err)
+			}
+			src.client.Close()
+			filClient.Close()
 		},
 	}, nil
 }
 
-// Run the two offerTaker persistant process
-//  1. a goroutine listening for new DataReady events
+// Run the offerTaker persistant processes
+//  1. a goroutine per source chain listening for new DataReady events
 //  2. a goroutine collecting data and aggregating before commiting
 //     to store and sending to filecoin boost
 func (a *aggregator) run(ctx context.Context) error {
@@ -238,11 +396,11 @@ func (a *aggregator) run(ctx context.Context) error {
 	// New DataReady events are passed through the channel to aggregation handling
 	g.Go(func() error {
 		query := ethereum.FilterQuery{
-			Addresses: []common.Address{a.onrampAddr},
+			Addresses: []common.Address{a.src.onrampAddr},
 			Topics:    [][]common.Hash{{a.abi.Events["DataReady"].ID}},
 		}
 
-		err := a.SubscribeQuery(ctx, query)
+		err := a.SubscribeQuery(ctx, a.src, query)
 		for err == nil || strings.Contains(err.Error(), "read tcp") {
 			if err != nil {
 				log.Printf("ignoring mystery error: %s", err)
@@ -251,9 +409,9 @@ func (a *aggregator) run(ctx context.Context) error {
 				err = ctx.Err()
 				break
 			}
-			err = a.SubscribeQuery(ctx, query)
+			err = a.SubscribeQuery(ctx, a.src, query)
 		}
-		log.Printf("context done exiting subscribe query\n")
+		log.Printf("context done exiting subscribe query of chain %d\n", a.src.chainID)
 		return err
 	})
 
@@ -262,23 +420,9 @@ func (a *aggregator) run(ctx context.Context) error {
 		return a.runAggregate(ctx)
 	})
 
-	// Start handling data transfer requests
+	// Start following the state of proposed deals and retrying failed ones
 	g.Go(func() error {
-		http.HandleFunc("/", a.transferHandler)
-		log.Printf("Data transfer server starting at %s\n", a.transferAddr)
-		server := &http.Server{
-			Addr:    a.transferAddr,
-			Handler: nil, // http.DefaultServeMux
-		}
-		go func() {
-			if err := server.ListenAndServe(); err != http.ErrServerClosed {
-				log.Fatalf("Transfer HTTP server ListenAndServe: %v", err)
-			}
-		}()
-		<-ctx.Done()
-		log.Printf("context done about to shut down server\n")
-		// Context is cancelled, shut down the server
-		return server.Shutdown(context.Background())
+		return a.trackDeals(ctx)
 	})
 
 	return g.Wait()
@@ -286,10 +430,61 @@ func (a *aggregator) run(ctx context.Context) error {
 
 func (a *aggregator) runAggregate(ctx context.Context) error {
 	// pieces being aggregated, flushed upon commitment
-	// Invariant: the pieces in the pending queue can always make a valid aggregate w.r.t a.targetDealSize
+	// Invariant: the pieces in the pending queue can always make a valid aggregate w.r.t a.maxDealSize
 	fmt.Println("Start running aggregation.")
-	var pending []DataReadyEvent
-	total := uint64(0)
+	pending := a.pending
+	total := pendingSize(pending)
+	// when the oldest pending offer started waiting, restored offers wait from startup
+	pendingSince := time.Now()
+	// offers whose data has been checked against their CommP
+	checks := newOfferChecks()
+
+	// Settle commits left unfinished by a restart, checking again while some are pending on chain
+	returned, unsettled, err := a.reconcileCommits(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to reconcile commits: %w", err)
+	}
+	pending = append(pending, returned...)
+	total += pendingSize(returned)
+	reconcileTicker := time.NewTicker(commitReconcileInterval)
+	defer reconcileTicker.Stop()
+
+	// Drop an offer removed by a chain reorg from pending. Recording the retraction
+	// also drops the removed event if it is still queued in a.ch.
+	retract := func(removed DataReadyEvent) error {
+		rec, found, err := a.store.getOffer(removed.ref())
+		if err != nil {
+			return err
+		}
+		if found && rec.Status == offerAggregated {
+			log.Printf("[ALERT] offer %d was removed by a chain reorg after being committed in transfer %d", removed.OfferID, rec.TransferID)
+			return nil
+		}
+		if found && rec.Event.BlockHash != (common.Hash{}) && rec.Event.BlockHash != removed.BlockHash {
+			log.Printf("ignoring removal of offer %d from block %s, it was included again in block %s", removed.OfferID, removed.BlockHash.Hex(), rec.Event.BlockHash.Hex())
+			return nil
+		}
+		for i, event := range pending {
+			if event.ref() == removed.ref() {
+				pending = append(pending[:i], pending[i+1:]...)
+				total -= event.Offer.Size
+				break
+			}
+		}
+		if err := a.store.putOffer(offerRecord{Event: removed, Status: offerRetracted}); err != nil {
+			return fmt.Errorf("failed to persist retracted offer %d: %w", removed.OfferID, err)
+		}
+		log.Printf("Offer-%d retracted by chain reorg. %d offers pending aggregation with total size=%d\n", removed.OfferID, len(pending), total)
+		return nil
+	}
+
+	// Periodically seal whatever is pending once it has waited long enough
+	var sealTick <-chan time.Time
+	if a.maxAggregationDelay > 0 {
+		ticker := time.NewTicker(aggregationTickInterval)
+		defer ticker.Stop()
+		sealTick = ticker.C
+	}
 
 	for {
 		select {
@@ -298,218 +493,426 @@ func (a *aggregator) runAggregate(ctx context.Context) error {
 			return nil
 		case latestEvent := <-a.ch:
 			{
-				// Comment out to test
-				// Check if the offer is too big to fit in a valid aggregate on its own
-				// TODO: as referenced below there must be a better way when we introspect on the gory details of NewAggregate
-				latestPiece, err := latestEvent.Offer.Piece()
-				if err != nil {
-					log.Printf("skipping offer %d, size %d not valid padded piece size ", latestEvent.OfferID, latestEvent.Offer.Size)
-					continue
+				// Retractions are sent before the events re-including their offers, select
+				// picks ready channels at random so those queued before this event go first
+				for drained := false; !drained; {
+					select {
+					case removed := <-a.retractCh:
+						if err := retract(removed); err != nil {
+							return err
+						}
+					default:
+						drained = true
+					}
 				}
-				log.Println("Extraced PieceC from Offer:", latestPiece)
-
-				_, err = datasegment.NewAggregate(filabi.PaddedPieceSize(a.targetDealSize), []filabi.PieceInfo{
-					latestPiece,
-				})
 
+				accepted, err := a.acceptOffer(latestEvent)
 				if err != nil {
-					fmt.Errorf("skipping offer %d, size %d exceeds max PODSI packable size. %w", latestEvent.OfferID, latestEvent.Offer.Size, err)
+					return err
+				}
+				// The event is persisted or dropped, scanning no longer resumes from its block
+				if err := a.eventSettled(latestEvent.BlockNumber); err != nil {
+					return err
+				}
+				if !accepted {
 					continue
 				}
+				if len(pending) == 0 {
+					pendingSince = time.Now()
+				}
 				pending = append(pending, latestEvent)
+				total += latestEvent.Offer.Size
 
-				// Turn offers into datasegment pieces
-				pieces := make([]filabi.PieceInfo, len(pending))
-				for i, event := range pending {
-					piece, err := event.Offer.Piece()
-					if err != nil {
-						return err
-					}
-					pieces[i] = piece
+				// Keep collecting offers while they all fit in the smallest acceptable deal
+				if _, rest := a.packer.Pack(pending, filabi.PaddedPieceSize(a.minDealSize)); len(rest) == 0 {
+					log.Printf("Offer-%d added. %d offers pending aggregation with total size=%d\n", latestEvent.OfferID, len(pending), total)
+					continue
 				}
-
-				// aggregation process
-				aggregatePieces := pieces
-				log.Println("Aggregated Pieces are:", aggregatePieces)
-				_, size, err := datasegment.ComputeDealPlacement(aggregatePieces)
+				pending, err = a.packAndSeal(ctx, pending, checks)
 				if err != nil {
-					panic(err)
+					return err
 				}
-				overallSize := filabi.PaddedPieceSize(size)
-				log.Printf("Aggregated Piece Size is %d", overallSize)
+				total = pendingSize(pending)
+				pendingSince = time.Now()
+			}
+		case <-sealTick:
+			if len(pending) == 0 || time.Since(pendingSince) < a.maxAggregationDelay {
+				continue
+			}
+			log.Printf("Max aggregation delay of %s reached, sealing %d pending offers with total size=%d", a.maxAggregationDelay, len(pending), total)
+			var err error
+			pending, err = a.packAndSeal(ctx, pending, checks)
+			if err != nil {
+				return err
+			}
+			total = pendingSize(pending)
+			pendingSince = time.Now()
+		case <-reconcileTicker.C:
+			if !unsettled {
+				continue
+			}
+			var returned []DataReadyEvent
+			var err error
+			returned, unsettled, err = a.reconcileCommits(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to reconcile commits: %w", err)
+			}
+			if len(pending) == 0 && len(returned) > 0 {
+				pendingSince = time.Now()
+			}
+			pending = append(pending, returned...)
+			total += pendingSize(returned)
+		case removed := <-a.retractCh:
+			if err := retract(removed); err != nil {
+				return err
+			}
+		}
+	}
+}
 
-				next := 1 << (64 - bits.LeadingZeros64(uint64(overallSize+256)))
-				if next <= int(a.minDealSize) {
-					total += latestEvent.Offer.Size
-					log.Printf("Offer-%d added. %d offers pending aggregation with total size=%d\n", latestEvent.OfferID, len(pending), total)
-				} else {
-					dealSize := filabi.PaddedPieceSize(next)
-					a.targetDealSize = uint64(dealSize)
-					log.Printf("Target DealSize is %d.", a.targetDealSize)
-
-					agg, err := datasegment.NewAggregate(filabi.PaddedPieceSize(a.targetDealSize), aggregatePieces)
-					if err != nil {
-						return fmt.Errorf("failed to create aggregate from pending, should not be reachable: %w", err)
-					}
+// Persist a dequeued event as a pending offer, reporting false if it is skipped
+func (a *aggregator) acceptOffer(latestEvent DataReadyEvent) (bool, error) {
+	// The same offer may be delivered again after a resubscription.
+	// Retracted offers are only accepted again when a reorg included them in another block,
+	// events of the removed block may still have been queued.
+	if rec, found, err := a.store.getOffer(latestEvent.ref()); err != nil {
+		return false, err
+	} else if found && rec.Status != offerRetracted {
+		log.Printf("skipping offer %d, already known", latestEvent.OfferID)
+		return false, nil
+	} else if found && rec.Event.BlockHash == latestEvent.BlockHash {
+		log.Printf("skipping offer %d, retracted from block %s", latestEvent.OfferID, latestEvent.BlockHash.Hex())
+		return false, nil
+	}
 
-					//Generates Podsi inclusion proof from aggregation
-					inclProofs := make([]merkletree.ProofData, len(pieces))
-					ids := make([]uint64, len(pieces))
-					for i, piece := range pieces {
-						podsi, err := agg.ProofForPieceInfo(piece)
-						if err != nil {
-							return err
-						}
-						ids[i] = pending[i].OfferID
-						inclProofs[i] = podsi.ProofSubtree // Only do data proofs on chain for now not index proofs
-					}
+	// Comment out to test
+	// Check if the offer is too big to fit in a valid aggregate on its own
+	// TODO: as referenced below there must be a better way when we introspect on the gory details of NewAggregate
+	latestPiece, err := latestEvent.Offer.Piece()
+	if err != nil {
+		log.Printf("skipping offer %d, size %d not valid padded piece size ", latestEvent.OfferID, latestEvent.Offer.Size)
+		return false, nil
+	}
+	log.Println("Extraced PieceC from Offer:", latestPiece)
 
-					//Sending aggCommp and inclusion proof to onramp contracts
-					aggCommp, err := agg.PieceCID()
-					if err != nil {
-						return err
-					}
-					tx, err := a.onramp.Transact(a.auth, "commitAggregate", aggCommp.Bytes(), ids, inclProofs, a.payoutAddr)
-					if err != nil {
-						return err
-					}
-					receipt, err := bind.WaitMined(ctx, a.client, tx)
-					if err != nil {
-						return err
-					}
-					log.Printf("Tx %s committing aggregate commp %s included: %d", tx.Hash().Hex(), aggCommp.String(), receipt.Status)
+	_, err = datasegment.NewAggregate(filabi.PaddedPieceSize(a.maxDealSize), []filabi.PieceInfo{
+		latestPiece,
+	})
 
-					// Schedule aggregate data for transfer
-					// After adding to the map this is now served in aggregator.transferHandler at `/?id={transferID}`
-					locations := make([]string, len(pending))
-					for i, event := range pending {
-						locations[i] = event.Offer.Location
-					}
-					var transferID int
-					a.transferLk.Lock()
-					transferID = a.transferID
-					a.transfers[transferID] = AggregateTransfer{
-						locations: locations,
-						agg:       agg,
-					}
-					a.transferID++
-					a.transferLk.Unlock()
-					log.Printf("Transfer ID %d scheduled for aggregation %s with %d urls.", transferID, aggCommp.String(), len(locations))
-
-					// Aggregate data into a file
-					homeDir, err := os.UserHomeDir()
-					if err != nil {
-						fmt.Println("Error:", err)
-						return nil
-					}
-					aggLocation := filepath.Join(homeDir, "/.xchain/", aggCommp.String())
-					err = a.saveAggregateToFile(transferID, aggLocation)
-					if err != nil {
-						log.Fatalf("failed to save aggregate to file: %s", err)
-					} else {
-						log.Println("Saved aggregated data into a file.")
-					}
+	if err != nil {
+		log.Printf("skipping offer %d, size %d exceeds max PODSI packable size. %s", latestEvent.OfferID, latestEvent.Offer.Size, err)
+		return false, nil
+	}
+	if err := a.store.putOffer(offerRecord{Event: latestEvent, Status: offerPending}); err != nil {
+		return false, fmt.Errorf("failed to persist offer %d: %w", latestEvent.OfferID, err)
+	}
+	return true, nil
+}
 
-					// send file to lighthouse
-					lhResp, err := buffer.UploadToLighthouse(aggLocation, a.lighthouseApiKey)
-					if err != nil {
-						log.Fatalf("failed to upload to lighthouse: %s", err)
-					}
-					retrievalURL := fmt.Sprintf("https://gateway.lighthouse.storage/ipfs/%s", lhResp.Hash)
-					log.Printf("Uploaded CAR size is %s", lhResp.Size)
+// Turn offers into datasegment pieces
+func offerPieces(events []DataReadyEvent) ([]filabi.PieceInfo, error) {
+	pieces := make([]filabi.PieceInfo, len(events))
+	for i, event := range events {
+		piece, err := event.Offer.Piece()
+		if err != nil {
+			return nil, err
+		}
+		pieces[i] = piece
+	}
+	return pieces, nil
+}
 
-					// Make storage deal on Filecoin network.
-					err = a.sendDeal(ctx, aggCommp, transferID, retrievalURL)
-					if err != nil {
-						log.Printf("[ERROR] failed to send deal: %s", err)
-					}
+// Return events without the offers in removed
+func withoutOffers(events, removed []DataReadyEvent) []DataReadyEvent {
+	drop := make(map[offerRef]struct{}, len(removed))
+	for _, event := range removed {
+		drop[event.ref()] = struct{}{}
+	}
+	var kept []DataReadyEvent
+	for _, event := range events {
+		if _, ok := drop[event.ref()]; !ok {
+			kept = append(kept, event)
+		}
+	}
+	return kept
+}
 
-					// Reset event log queue to empty
-					pending = pending[:0]
-				}
-			}
+func pendingSize(pending []DataReadyEvent) uint64 {
+	total := uint64(0)
+	for _, event := range pending {
+		total += event.Offer.Size
+	}
+	return total
+}
+
+// Seal the pending offers chosen by the packing strategy into the smallest deal
+// between the min and max deal sizes that holds them all, or into a max size deal
+// if some of them have to wait for the next aggregate. Returns the offers left pending.
+// Offers whose data does not match their CommP are dropped before the aggregate is built,
+// offers whose data cannot be fetched wait for a later aggregate.
+func (a *aggregator) packAndSeal(ctx context.Context, pending []DataReadyEvent, checks *offerChecks) ([]DataReadyEvent, error) {
+	var dealSize filabi.PaddedPieceSize
+	var packed, rest, unavailable []DataReadyEvent
+	for {
+		dealSize = filabi.PaddedPieceSize(a.minDealSize)
+		packed, rest = a.packer.Pack(pending, dealSize)
+		for len(rest) > 0 && dealSize < filabi.PaddedPieceSize(a.maxDealSize) {
+			dealSize *= 2
+			packed, rest = a.packer.Pack(pending, dealSize)
+		}
+		if len(packed) == 0 {
+			return nil, fmt.Errorf("no pending offer fits a %d byte aggregate, should not be reachable", dealSize)
+		}
+
+		invalid, failed, err := a.verifyOffers(ctx, packed, checks)
+		if err != nil {
+			return nil, err
+		}
+		if len(invalid) == 0 && len(failed) == 0 {
+			break
+		}
+		// Repack without the invalid and unavailable offers
+		pending = withoutOffers(pending, append(invalid, failed...))
+		unavailable = append(unavailable, failed...)
+		if len(pending) == 0 {
+			return unavailable, nil
+		}
+	}
+	log.Printf("Packed %d of %d pending offers into a %d byte aggregate", len(packed), len(pending), dealSize)
+	if err := a.sealAggregate(ctx, packed, dealSize); err != nil {
+		return nil, err
+	}
+	return append(rest, unavailable...), nil
+}
+
+// Build an aggregate of dealSize from the pending offers, commit it on the source chain
+// with PODSI proofs, schedule it for transfer and make the Filecoin storage deal.
+func (a *aggregator) sealAggregate(ctx context.Context, pending []DataReadyEvent, dealSize filabi.PaddedPieceSize) error {
+	pieces, err := offerPieces(pending)
+	if err != nil {
+		return err
+	}
+	a.targetDealSize = uint64(dealSize)
+	log.Printf("Target DealSize is %d.", a.targetDealSize)
+
+	agg, err := datasegment.NewAggregate(filabi.PaddedPieceSize(a.targetDealSize), pieces)
+	if err != nil {
+		return fmt.Errorf("failed to create aggregate from pending, should not be reachable: %w", err)
+	}
+
+	aggCommp, err := agg.PieceCID()
+	if err != nil {
+		return err
+	}
+
+	//Generates Podsi inclusion proof from aggregation
+	ids := make([]uint64, len(pieces))
+	for i := range pending {
+		ids[i] = pending[i].OfferID
+	}
+	proofs, err := computeProofs(agg, aggregateRecord{AggCommP: aggCommp, Pieces: pieces, OfferIDs: ids, ChainID: a.src.chainID})
+	if err != nil {
+		return err
+	}
+
+	// Persist the aggregate before committing it so that commits sent before a restart
+	// are reconciled from their recorded transactions instead of being sent again
+	locations := make([]string, len(pending))
+	for i, event := range pending {
+		locations[i] = event.Offer.Location
+	}
+	a.transferLk.Lock()
+	transferID := a.transferID
+	err = a.store.saveAggregate(aggregateRecord{
+		TransferID: transferID,
+		AggCommP:   aggCommp,
+		DealSize:   a.targetDealSize,
+		Pieces:     pieces,
+		OfferIDs:   ids,
+		ChainID:    a.src.chainID,
+		Locations:  locations,
+	}, pending, nil)
+	if err != nil {
+		a.transferLk.Unlock()
+		return fmt.Errorf("failed to persist aggregate %s: %w", aggCommp, err)
+	}
+	a.transferID++
+	a.transferLk.Unlock()
+
+	// Commit the offers with their proofs to the OnRamp
+	for i := range proofs {
+		proofs[i].TransferID = transferID
+	}
+	commitErr := a.commitAggregate(ctx, transferID, aggCommp, proofs)
+	if commitErr != nil {
+		log.Printf("[ERROR] failed to commit aggregate %s, %d offers return to pending: %s", aggCommp, len(pending), commitErr)
+	}
+	if err := a.store.settleCommit(transferID, commitErr == nil, proofs); err != nil {
+		return fmt.Errorf("failed to persist commit of aggregate %s: %w", aggCommp, err)
+	}
+	if commitErr != nil {
+		return commitErr
+	}
+
+	// Schedule aggregate data for transfer
+	// After adding to the map this is now served in aggregator.transferHandler at `/?id={transferID}`
+	a.transferLk.Lock()
+	a.transfers[transferID] = AggregateTransfer{
+		locations: locations,
+		agg:       agg,
+	}
+	a.transferLk.Unlock()
+	log.Printf("Transfer ID %d scheduled for aggregation %s with %d urls.", transferID, aggCommp.String(), len(locations))
+
+	// Aggregate data into a file
+	// Without it providers fetch the aggregate from the transfer server which reassembles it from the buffers
+	aggLocation, err := a.stageAggregate(transferID, aggCommp, uint64(dealSize.Unpadded()))
+	if err != nil {
+		log.Printf("[ERROR] failed to stage aggregate %s, it is served from the buffers: %s", aggCommp, err)
+		return a.replicate(ctx, transferID)
+	}
+	log.Println("Saved aggregated data into a file.")
+
+	// Upload the aggregate for providers to fetch, without a retrieval URL they fetch it from the transfer server.
+	// Providers import aggregates of offline and direct deals from the export directory instead.
+	if a.isOffline(uint64(dealSize)) || a.isDirect(uint64(dealSize)) {
+		return a.replicate(ctx, transferID)
+	}
+	retrievalURL, err := a.uploader.Upload(ctx, aggLocation, aggCommp)
+	if err != nil {
+		log.Printf("[ERROR] failed to upload aggregate %s, it is served from the transfer server: %s", aggCommp, err)
+	} else if retrievalURL != "" {
+		err = a.store.updateAggregate(transferID, func(rec *aggregateRecord) {
+			rec.RetrievalURL = retrievalURL
+		})
+		if err != nil {
+			return fmt.Errorf("failed to persist retrieval url of transfer %d: %w", transferID, err)
 		}
 	}
+
+	// Make storage deals on Filecoin network.
+	return a.replicate(ctx, transferID)
 }
 
-// Send deal data to the configured SP deal making address (boost node)
+// Send the aggregate commp with the subtree proofs of its offers to the OnRamp,
+// recording the sent transactions on the aggregate of the transfer
+func (a *aggregator) commitAggregate(ctx context.Context, transferID int, aggCommp cid.Cid, proofs []proofRecord) error {
+	src := a.src
+	ids := make([]uint64, len(proofs))
+	inclProofs := make([]merkletree.ProofData, len(proofs))
+	for i, proof := range proofs {
+		ids[i] = proof.OfferID
+		inclProofs[i] = proof.Proof.ProofSubtree // Only do data proofs on chain for now, index proofs are persisted for clients
+	}
+
+	//Sending aggCommp and inclusion proof to onramp contracts
+	sent := func(hash common.Hash) {
+		err := a.store.updateAggregate(transferID, func(rec *aggregateRecord) {
+			rec.CommitTxs = append(rec.CommitTxs, hash)
+		})
+		if err != nil {
+			log.Printf("[ERROR] failed to persist tx %s committing transfer %d to chain %d: %s", hash.Hex(), transferID, src.chainID, err)
+		}
+	}
+	receipt, err := src.txm.TransactNotify(ctx, sent, src.onrampAddr, a.abi, "commitAggregate", aggCommp.Bytes(), ids, inclProofs, a.payoutAddr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Tx %s committing aggregate commp %s to chain %d included in block %d", receipt.TxHash.Hex(), aggCommp.String(), src.chainID, receipt.BlockNumber)
+	return nil
+}
+
+// Send deal data to the storage provider's deal making address (boost node)
 // The deal is made with the configured prover client contract
 // Heavily inspired by boost client
-func (a *aggregator) sendDeal(ctx context.Context, aggCommp cid.Cid, transferID int, url string) error {
-	if err := a.host.Connect(ctx, *a.spDealAddr); err != nil {
-		return fmt.Errorf("failed to connect to peer %s: %w", a.spDealAddr.ID, err)
+func (a *aggregator) sendDeal(ctx context.Context, sp storageProvider, rec aggregateRecord) (dealRecord, error) {
+	if a.isDirect(rec.DealSize) {
+		return a.sendDirectDeal(ctx, sp, rec)
+	}
+	offline := a.isOffline(rec.DealSize)
+	deal := dealRecord{Provider: sp.actor, ProposedAt: time.Now(), Offline: offline}
+	if err := a.host.Connect(ctx, *sp.peer); err != nil {
+		return deal, fmt.Errorf("failed to connect to peer %s: %w", sp.peer.ID, err)
 	}
-	x, err := a.host.Peerstore().FirstSupportedProtocol(a.spDealAddr.ID, DealProtocolv120)
+	x, err := a.host.Peerstore().FirstSupportedProtocol(sp.peer.ID, DealProtocolv120)
 	if err != nil {
-		return fmt.Errorf("getting protocols for peer %s: %w", a.spDealAddr.ID, err)
+		return deal, fmt.Errorf("getting protocols for peer %s: %w", sp.peer.ID, err)
 	}
 	if len(x) == 0 {
-		return fmt.Errorf("cannot make a deal with storage provider %s because it does not support protocol version 1.2.0", a.spDealAddr.ID)
+		return deal, fmt.Errorf("cannot make a deal with storage provider %s because it does not support protocol version 1.2.0", sp.peer.ID)
 	}
 
 	// Construct deal
+	aggCommp := rec.AggCommP
+	dealSize := rec.DealSize
 	dealUuid := uuid.New()
+	deal.DealUUID = dealUuid
 	log.Printf("making deal for commp=%s, UUID=%s\n", aggCommp.String(), dealUuid)
 
-	if url == "" {
-		url = fmt.Sprintf("http://%s/?id=%d", a.transferAddr, transferID)
-	}
+	// Offline deals have no transfer, the provider imports the exported aggregate
+	var transfer boosttypes.Transfer
+	if offline {
+		if err := a.exportAggregate(rec); err != nil {
+			return deal, fmt.Errorf("failed to export aggregate for offline deal: %w", err)
+		}
+		log.Printf("offline deal, aggregate exported to %s", a.exportedAggregatePath(aggCommp))
+	} else {
+		url := rec.RetrievalURL
+		if url == "" {
+			url = fmt.Sprintf("http://%s/?id=%d&chain=%d", a.transferAddr, rec.TransferID, rec.ChainID)
+		}
 
-	transferParams := boosttypes2.HttpRequest{
-		URL: url,
-	}
-	log.Printf("transfer URL: %s", url)
-	paramsBytes, err := json.Marshal(transferParams)
-	if err != nil {
-		return fmt.Errorf("failed to marshal transfer params: %w", err)
-	}
-	transfer := boosttypes.Transfer{
-		Type: "http",
-		//ClientID: fmt.Sprintf("%d", transferID),
-		Params: paramsBytes,
-		Size:   a.targetDealSize - a.targetDealSize/128, // aggregate for transfer is not fr32 encoded
+		transferParams := boosttypes2.HttpRequest{
+			URL: url,
+		}
+		log.Printf("transfer URL: %s", url)
+		paramsBytes, err := json.Marshal(transferParams)
+		if err != nil {
+			return deal, fmt.Errorf("failed to marshal transfer params: %w", err)
+		}
+		transfer = boosttypes.Transfer{
+			Type: "http",
+			//ClientID: fmt.Sprintf("%d", transferID),
+			Params: paramsBytes,
+			Size:   dealSize - dealSize/128, // aggregate for transfer is not fr32 encoded
+		}
 	}
 
-	bounds, err := a.lotusAPI.StateDealProviderCollateralBounds(ctx, filabi.PaddedPieceSize(a.targetDealSize), false, lotustypes.EmptyTSK)
+	bounds, err := a.lotusAPI.StateDealProviderCollateralBounds(ctx, filabi.PaddedPieceSize(dealSize), false, lotustypes.EmptyTSK)
 	if err != nil {
-		return fmt.Errorf("failed to get collateral bounds: %w", err)
+		return deal, fmt.Errorf("failed to get collateral bounds: %w", err)
 	}
 	providerCollateral := fbig.Div(fbig.Mul(bounds.Min, fbig.NewInt(6)), fbig.NewInt(5)) // add 20% as boost client does
 	tipset, err := a.lotusAPI.ChainHead(ctx)
 	if err != nil {
-		return fmt.Errorf("cannot get chain head: %w", err)
+		return deal, fmt.Errorf("cannot get chain head: %w", err)
 	}
 	filHeight := tipset.Height()
 	dealStart := filHeight + filabi.ChainEpoch(a.dealDelayEpochs)
 	dealEnd := dealStart + filabi.ChainEpoch(a.dealDuration)
+	deal.StartEpoch = dealStart
+	deal.EndEpoch = dealEnd
 	filClient, err := address.NewDelegatedAddress(builtintypes.EthereumAddressManagerActorID, a.proverAddr[:])
 	log.Printf("filClient = %s", filClient.String())
 	if err != nil {
-		return fmt.Errorf("failed to translate onramp address (%s) into a "+
-			"Filecoin f4 address: %w", a.onrampAddr.Hex(), err)
-	}
-	chainID, err := a.client.ChainID(ctx)
-	log.Printf("chainID = %d", chainID)
-	if err != nil {
-		return fmt.Errorf("failed to get chain ID: %w", err)
+		return deal, fmt.Errorf("failed to translate prover address (%s) into a "+
+			"Filecoin f4 address: %w", a.proverAddr.Hex(), err)
 	}
-	// Encode the chainID as uint256
-	encodedChainID, err := utils.EncodeChainIDAsString(chainID)
+	// Label the deal with the source chain the aggregate is committed to
+	label := dealLabel(rec.ChainID)
+	log.Printf("chainID = %s", label)
+	dealLabel, err := market.NewLabelFromString(label)
 	if err != nil {
-		return fmt.Errorf("failed to encode chainID: %w", err)
-	}
-	dealLabel, err := market.NewLabelFromString(encodedChainID)
-	if err != nil {
-		return fmt.Errorf("failed to create deal label: %w", err)
+		return deal, fmt.Errorf("failed to create deal label: %w", err)
 	}
 	log.Println("Start creating ClientDealProposal.")
 	proposal := market.ClientDealProposal{
 		Proposal: market.DealProposal{
 			PieceCID:             aggCommp,
-			PieceSize:            filabi.PaddedPieceSize(a.targetDealSize),
+			PieceSize:            filabi.PaddedPieceSize(dealSize),
 			VerifiedDeal:         true,
 			Client:               filClient,
-			Provider:             a.spActorAddr,
+			Provider:             sp.actor,
 			Label:                dealLabel,
 			StartEpoch:           dealStart,
 			EndEpoch:             dealEnd,
@@ -527,7 +930,7 @@ func (a *aggregator) sendDeal(ctx context.Context, aggCommp cid.Cid, transferID
 		DealUUID:           dealUuid,
 		ClientDealProposal: proposal,
 		DealDataRoot:       aggCommp,
-		IsOffline:          false,
+		IsOffline:          offline,
 		Transfer:           transfer,
 		RemoveUnsealedCopy: false,
 		SkipIPNIAnnounce:   false,
@@ -547,21 +950,26 @@ func (a *aggregator) sendDeal(ctx context.Context, aggCommp cid.Cid, transferID
 	log.Println("ProviderCollateral:", proposal.Proposal.ProviderCollateral)
 	log.Println("---------------------------------------------------------------")
 
-	s, err := a.host.NewStream(ctx, a.spDealAddr.ID, DealProtocolv120)
+	s, err := a.host.NewStream(ctx, sp.peer.ID, DealProtocolv120)
 	if err != nil {
-		return err
+		return deal, err
 	}
 	defer s.Close()
 
 	var resp boosttypes.DealResponse
 	if err := doRpc(ctx, s, &dealParams, &resp); err != nil {
-		return fmt.Errorf("send proposal rpc: %w", err)
+		return deal, fmt.Errorf("send proposal rpc: %w", err)
 	}
 	if !resp.Accepted {
-		return fmt.Errorf("deal proposal rejected: %s", resp.Message)
+		return deal, fmt.Errorf("deal proposal rejected: %s", resp.Message)
 	}
-	log.Printf("Deal UUID=%s is sent to miner %s.", dealUuid, a.spActorAddr)
-	return nil
+	log.Printf("Deal UUID=%s is sent to miner %s.", dealUuid, sp.actor)
+	if offline {
+		if err := a.addOfflineDeal(rec, deal); err != nil {
+			log.Printf("[ERROR] failed to add deal %s to the manifest of aggregate %s: %s", dealUuid, aggCommp, err)
+		}
+	}
+	return deal, nil
 }
 
 func doRpc(ctx context.Context, s inet.Stream, req interface{}, resp interface{}) error {
@@ -588,10 +996,10 @@ func doRpc(ctx context.Context, s inet.Stream, req interface{}, resp interface{}
 	}
 }
 
-func (a *aggregator) SubscribeQuery(ctx context.Context, query ethereum.FilterQuery) error {
+func (a *aggregator) SubscribeQuery(ctx context.Context, src *sourceChain, query ethereum.FilterQuery) error {
 	logs := make(chan types.Log)
-	log.Printf("Listening for data ready events on %s\n", a.onrampAddr.Hex())
-	sub, err := a.client.SubscribeFilterLogs(ctx, query, logs)
+	log.Printf("Listening for data ready events on %s of chain %d\n", src.onrampAddr.Hex(), src.chainID)
+	sub, err := src.client.SubscribeFilterLogs(ctx, query, logs)
 	if err != nil {
 		return err
 	}
@@ -601,6 +1009,125 @@ func (a *aggregator) SubscribeQuery(ctx context.Context, query ethereum.FilterQu
 	processed := make(map[uint64]struct{})
 	// Mutex for thread safety
 	var mu sync.Mutex
+	// Events waiting to reach the configured confirmation depth
+	held := make(map[uint64]DataReadyEvent)
+	// Held events are lost with the subscription, the next one finds them again
+	defer func() {
+		blocks := make([]uint64, 0, len(held))
+		for _, event := range held {
+			blocks = append(blocks, event.BlockNumber)
+		}
+		src.rewind(blocks)
+	}()
+
+	handleLog := func(vLog types.Log) error {
+		log.Println("Receive a DataReady() event.")
+		event, err := parseDataReadyEvent(vLog, a.abi)
+		if err != nil {
+			return err
+		}
+		event.ChainID = src.chainID
+
+		// Logs removed by a reorg retract their offer
+		if vLog.Removed {
+			mu.Lock()
+			delete(processed, event.OfferID)
+			mu.Unlock()
+			if heldEvent, ok := held[event.OfferID]; ok && heldEvent.BlockHash == event.BlockHash {
+				delete(held, event.OfferID)
+				log.Printf("Unconfirmed offer NO. %d removed by chain reorg\n", event.OfferID)
+				return a.eventSettled(heldEvent.BlockNumber)
+			}
+			log.Printf("Retracting offer NO. %d removed by chain reorg\n", event.OfferID)
+			a.retractCh <- *event
+			return nil
+		}
+
+		// Offers already known from a previous run are not aggregated again
+		if rec, found, err := a.store.getOffer(event.ref()); err != nil {
+			return err
+		} else if found && rec.Status != offerRetracted {
+			log.Printf("Known offer ignored: Offer NO. %d\n", event.OfferID)
+			return nil
+		}
+
+		// Deduplication logic with mutex
+		mu.Lock()
+		if _, exists := processed[event.OfferID]; exists {
+			mu.Unlock() // Unlock and continue if duplicate
+			log.Printf("Duplicate event ignored: Offer NO. %d\n", event.OfferID)
+			return nil
+		}
+		processed[event.OfferID] = struct{}{}
+		mu.Unlock()
+
+		if a.policy.needsSubmitter() {
+			tx, _, err := src.client.TransactionByHash(ctx, vLog.TxHash)
+			if err != nil {
+				return fmt.Errorf("failed to get offer transaction %s: %w", vLog.TxHash.Hex(), err)
+			}
+			event.Submitter, err = src.client.TransactionSender(ctx, tx, vLog.BlockHash, vLog.TxIndex)
+			if err != nil {
+				return fmt.Errorf("failed to get sender of offer transaction %s: %w", vLog.TxHash.Hex(), err)
+			}
+		}
+		if reason := a.policy.evaluate(*event); reason != "" {
+			log.Printf("Offer NO. %d rejected: %s\n", event.OfferID, reason)
+			return a.store.putOffer(offerRecord{Event: *event, Status: offerRejected, Reason: reason})
+		}
+
+		src.eventAccepted(event.BlockNumber)
+		if src.confirmations > 0 {
+			log.Printf("Holding offer NO. %d from block %d for %d confirmations\n", event.OfferID, event.BlockNumber, src.confirmations)
+			held[event.OfferID] = *event
+			return nil
+		}
+		a.sendForAggregation(*event)
+		return nil
+	}
+
+	// Hand over held events that are buried deep enough, oldest first
+	releaseConfirmed := func(head uint64) {
+		var confirmed []DataReadyEvent
+		for id, event := range held {
+			if event.BlockNumber+src.confirmations <= head {
+				confirmed = append(confirmed, event)
+				delete(held, id)
+			}
+		}
+		sort.Slice(confirmed, func(i, j int) bool {
+			if confirmed[i].BlockNumber != confirmed[j].BlockNumber {
+				return confirmed[i].BlockNumber < confirmed[j].BlockNumber
+			}
+			return confirmed[i].OfferID < confirmed[j].OfferID
+		})
+		for _, event := range confirmed {
+			a.sendForAggregation(event)
+		}
+	}
+	checkConfirmations := func() error {
+		if len(held) == 0 {
+			return nil
+		}
+		head, err := src.client.BlockNumber(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get source chain head: %w", err)
+		}
+		releaseConfirmed(head)
+		return nil
+	}
+
+	// Catch up on events emitted while not subscribed. Live logs arriving meanwhile
+	// are buffered by the subscription and duplicates are dropped above.
+	if err := a.backfill(ctx, src, query, handleLog); err != nil {
+		return err
+	}
+	if err := checkConfirmations(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(confirmationPollInterval)
+	defer ticker.Stop()
 LOOP:
 	for {
 		select {
@@ -609,35 +1136,83 @@ LOOP:
 		case err := <-sub.Err():
 			return err
 		case vLog := <-logs:
-			log.Println("Receive a DataReady() event.")
-			event, err := parseDataReadyEvent(vLog, a.abi)
-			if err != nil {
+			if err := handleLog(vLog); err != nil {
 				return err
 			}
-
-			// Deduplication logic with mutex
-			mu.Lock()
-			if _, exists := processed[event.OfferID]; exists {
-				mu.Unlock() // Unlock and continue if duplicate
-				log.Printf("Duplicate event ignored: Offer NO. %d\n", event.OfferID)
-				continue
+			// Logs are delivered in block order, every earlier block was scanned
+			if !vLog.Removed {
+				if err := a.scannedTo(src, vLog.BlockNumber); err != nil {
+					return err
+				}
 			}
-			processed[event.OfferID] = struct{}{}
-			mu.Unlock()
+		case <-ticker.C:
+			if err := checkConfirmations(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-			log.Printf("Sending offer NO. %d for aggregation\n", event.OfferID)
-			log.Printf("  Offer:\n")
-			log.Printf("    CommP: %v\n", event.Offer.CommP)
-			log.Printf("    Size: %d\n", event.Offer.Size)
-			log.Printf("    Cid: %s\n", event.Offer.Cid)
-			log.Printf("    Location: %s\n", event.Offer.Location)
-			log.Printf("    Payment Token: %s\n", event.Offer.Token.Hex())      // Address needs .Hex() for printing
-			log.Printf("    Payment Amount: %s\n", event.Offer.Amount.String()) // big.Int needs .String() for printing
+// Pass a confirmed event on to runAggregate
+func (a *aggregator) sendForAggregation(event DataReadyEvent) {
+	log.Printf("Sending offer NO. %d of chain %d for aggregation\n", event.OfferID, event.ChainID)
+	log.Printf("  Offer:\n")
+	log.Printf("    CommP: %v\n", event.Offer.CommP)
+	log.Printf("    Size: %d\n", event.Offer.Size)
+	log.Printf("    Cid: %s\n", event.Offer.Cid)
+	log.Printf("    Location: %s\n", event.Offer.Location)
+	log.Printf("    Payment Token: %s\n", event.Offer.Token.Hex())      // Address needs .Hex() for printing
+	log.Printf("    Payment Amount: %s\n", event.Offer.Amount.String()) // big.Int needs .String() for printing
+
+	// The offer has passed the admission policy, packing decisions
+	// are made by the packing strategy in runAggregate
+	a.ch <- event
+}
 
-			// This is where we should make packing decisions.
-			// In the current prototype we accept all offers regardless
-			// of payment type, amount or duration
-			a.ch <- *event
+// Replay historical DataReady events from the last checkpoint (or the configured
+// start block) up to the current head in bounded block ranges
+func (a *aggregator) backfill(ctx context.Context, src *sourceChain, query ethereum.FilterQuery, handleLog func(types.Log) error) error {
+	from, err := a.store.checkpoint(src.chainID)
+	if err != nil {
+		return fmt.Errorf("failed to load checkpoint: %w", err)
+	}
+	if from == 0 {
+		from = src.startBlock
+	}
+	if from == 0 {
+		log.Printf("No checkpoint or start block configured for chain %d, skipping backfill", src.chainID)
+		return nil
+	}
+	head, err := src.client.BlockNumber(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get source chain head: %w", err)
+	}
+
+	log.Printf("Backfilling DataReady events of chain %d from block %d to %d", src.chainID, from, head)
+	if err := a.scannedTo(src, from); err != nil {
+		return err
+	}
+	for start := from; start <= head; start += src.backfillRange {
+		end := min(start+src.backfillRange-1, head)
+		rangeQuery := query
+		rangeQuery.FromBlock = new(big.Int).SetUint64(start)
+		rangeQuery.ToBlock = new(big.Int).SetUint64(end)
+		vLogs, err := src.client.FilterLogs(ctx, rangeQuery)
+		if err != nil {
+			return fmt.Errorf("failed to filter logs in blocks %d-%d: %w", start, end, err)
+		}
+		for _, vLog := range vLogs {
+			if err := handleLog(vLog); err != nil {
+				return err
+			}
+		}
+		// Scanning resumes after the range once its events are persisted
+		if err := a.scannedTo(src, end+1); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
 		}
 	}
 	return nil
@@ -652,17 +1227,15 @@ func (a *aggregator) saveAggregateToFile(trensferId int, location string) error
 		return fmt.Errorf("no data found for ID %d", trensferId)
 	}
 
-	readers := []io.Reader{
-		// bytes.NewReader(prefixCARBytes)
-	}
 	log.Printf("Fetching %d pieces from buffer.", len(transfer.locations))
-	// Fetch each sub piece from its buffer location and add to readers
-	for _, url := range transfer.locations {
-		lazyReader := &lazyHTTPReader{url: url}
-		readers = append(readers, lazyReader)
-		defer lazyReader.Close()
+	// Fetch the sub pieces from their buffer locations in the background while writing the aggregate
+	srcs := make([]pieceSource, len(transfer.locations))
+	for i, url := range transfer.locations {
+		srcs[i] = pieceSource{url: url, limit: transfer.agg.Index.Entries[i].UnpaddedLength()}
 	}
-	aggReader, err := transfer.agg.AggregateObjectReader(readers)
+	pieces := a.fetcher.prefetch(context.Background(), srcs)
+	defer pieces.Close()
+	aggReader, err := transfer.agg.AggregateObjectReader(pieces.readers())
 	if err != nil {
 		return fmt.Errorf("failed to create aggregate reader: %w", err)
 	}
@@ -674,25 +1247,75 @@ func (a *aggregator) saveAggregateToFile(trensferId int, location string) error
 	}
 	defer file.Close()
 
-	// Copy the aggregated data to the file
-	_, err = io.Copy(file, aggReader)
+	// Copy the aggregated data to the file, checking its commp on the way
+	cp := new(commp.Calc)
+	_, err = io.Copy(io.MultiWriter(file, cp), aggReader)
 	if err != nil {
 		return fmt.Errorf("failed to write aggregate stream to file: %w", err)
 	}
+	aggCommp, err := transfer.agg.PieceCID()
+	if err != nil {
+		return err
+	}
+	return checkCommp(cp, aggCommp)
+}
 
-	return nil
+// Return the directory of the state database of the aggregator of the source chain
+func stateStorePath(cfg *config.Config, chainID int) string {
+	statePath := cfg.StatePath
+	if statePath == "" {
+		statePath = DefaultStatePath
+	}
+	return filepath.Join(statePath, strconv.Itoa(chainID))
+}
+
+// Serve data transfer, deal, proof and import requests of all aggregators at addr. Requests go to the
+// aggregator of the source chain in the `chain` query parameter, which may be omitted with a single aggregator.
+func serveTransfers(ctx context.Context, addr string, aggs []*aggregator) error {
+	route := func(handler func(a *aggregator, w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if len(aggs) == 1 {
+				handler(aggs[0], w, r)
+				return
+			}
+			chainID, err := strconv.Atoi(r.URL.Query().Get("chain"))
+			if err != nil {
+				http.Error(w, "Chain is required", http.StatusBadRequest)
+				return
+			}
+			for _, a := range aggs {
+				if a.src.chainID == chainID {
+					handler(a, w, r)
+					return
+				}
+			}
+			http.Error(w, fmt.Sprintf("Chain %d is not served", chainID), http.StatusNotFound)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", route((*aggregator).transferHandler))
+	mux.HandleFunc("/deals", route((*aggregator).dealsHandler))
+	mux.HandleFunc("/proof", route((*aggregator).proofHandler))
+	mux.HandleFunc("/imported", route((*aggregator).importedHandler))
+	log.Printf("Data transfer server starting at %s\n", addr)
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("Transfer HTTP server ListenAndServe: %v", err)
+		}
+	}()
+	<-ctx.Done()
+	log.Printf("context done about to shut down server\n")
+	// Context is cancelled, shut down the server
+	return server.Shutdown(context.Background())
 }
 
 // Handle data transfer requests from boost
 func (a *aggregator) transferHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("Received data transfer from boost.")
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", strconv.Itoa(int(a.targetDealSize-a.targetDealSize/128)))
-	if r.Method == "HEAD" {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
 	idStr := r.URL.Query().Get("id")
 	if idStr == "" {
 		http.Error(w, "ID is required", http.StatusBadRequest)
@@ -712,54 +1335,32 @@ func (a *aggregator) transferHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	readers := []io.Reader{}
-	// Fetch each sub piece from its buffer location and write to response
-	for _, url := range transfer.locations {
-		lazyReader := &lazyHTTPReader{url: url}
-		readers = append(readers, lazyReader)
-		defer lazyReader.Close()
-	}
-	aggReader, err := transfer.agg.AggregateObjectReader(readers)
+	aggCommp, err := transfer.agg.PieceCID()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to create aggregate reader: %s", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("failed to get aggregate commp: %s", err), http.StatusInternalServerError)
 		return
 	}
-	_, err = io.Copy(w, aggReader)
-	if err != nil {
-		log.Printf("failed to write aggregate stream: %s", err)
-	}
-}
-
-// LazyHTTPReader is an io.Reader that fetches data from an HTTP URL on the first Read call
-type lazyHTTPReader struct {
-	url     string
-	reader  io.ReadCloser
-	started bool
-}
+	// The content of a transfer never changes, its commp identifies it.
+	// ServeContent answers Range requests, which boost sends to resume interrupted transfers.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", fmt.Sprintf("%q", aggCommp.String()))
 
-func (l *lazyHTTPReader) Read(p []byte) (int, error) {
-	if !l.started {
-		// Start the HTTP request on the first Read call
-		log.Printf("reading %s\n", l.url)
-		resp, err := http.Get(l.url)
-		if err != nil {
-			return 0, err
-		}
-		if resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
-			return 0, fmt.Errorf("failed to fetch data: %s", resp.Status)
-		}
-		l.reader = resp.Body
-		l.started = true
+	// Serve the staged aggregate file if it is still around and matches the commp
+	if file := a.openStaged(aggCommp, uint64(transfer.agg.DealSize.Unpadded())); file != nil {
+		defer file.Close()
+		http.ServeContent(w, r, "", time.Time{}, file)
+		return
 	}
-	return l.reader.Read(p)
-}
 
-func (l *lazyHTTPReader) Close() error {
-	if l.reader != nil {
-		return l.reader.Close()
+	// Otherwise read the requested range of the aggregate from the buffer locations of its sub pieces
+	layout, err := newAggregateLayout(transfer.agg, transfer.locations)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to create aggregate reader: %s", err), http.StatusInternalServerError)
+		return
 	}
-	return nil
+	aggReader := newAggregateReader(r.Context(), a.fetcher, layout)
+	defer aggReader.Close()
+	http.ServeContent(w, r, "", time.Time{}, aggReader)
 }
 
 // Function to parse the DataReady event from log data
@@ -792,8 +1393,10 @@ func parseDataReadyEvent(log types.Log, abi *abi.ABI) (*DataReadyEvent, error) {
 	}
 
 	return &DataReadyEvent{
-		OfferID: offerID,
-		Offer:   offer,
+		OfferID:     offerID,
+		Offer:       offer,
+		BlockNumber: log.BlockNumber,
+		BlockHash:   log.BlockHash,
 	}, nil
 }
 
@@ -827,3 +1430,10 @@ func NewLotusDaemonAPIClientV0(ctx context.Context, url string, timeoutSecs int,
 }
 
 var hasV0Suffix = regexp.MustCompile(`\/rpc\/v0\/?\z`)
+
+var hasRPCSuffix = regexp.MustCompile(`\/rpc\/v[01]\/?\z`)
+
+// LotusEthURL returns the Lotus eth JSON-RPC endpoint of a Lotus API url
+func LotusEthURL(url string) string {
+	return hasRPCSuffix.ReplaceAllString(url, "") + "/rpc/v1"
+}
@@ -0,0 +1,130 @@
+package aggregator
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/FIL-Builders/xchainClient/utils"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that offers short of the minimum deal size are sealed once they waited for
+// the max aggregation delay, into an aggregate padded to the minimum deal size
+func TestSealAfterMaxDelay(t *testing.T) {
+	interval := aggregationTickInterval
+	aggregationTickInterval = 10 * time.Millisecond
+	defer func() { aggregationTickInterval = interval }()
+
+	// Buffer serving the data of two 1 KiB pieces
+	data := make([][]byte, 2)
+	events := make([]DataReadyEvent, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i, err := strconv.Atoi(r.URL.Path[1:])
+		if err != nil || i >= len(data) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data[i]))
+	}))
+	defer srv.Close()
+	for i := range data {
+		data[i] = make([]byte, 1000)
+		rand.Read(data[i])
+		cp := new(commp.Calc)
+		cp.Write(data[i])
+		rawCommP, size, err := cp.Digest()
+		assert.NoError(t, err)
+		commP, err := commcid.DataCommitmentV1ToCID(rawCommP)
+		assert.NoError(t, err)
+		events[i] = DataReadyEvent{
+			OfferID: uint64(i + 1),
+			ChainID: 1,
+			Offer:   Offer{CommP: commP.Bytes(), Size: size, Location: srv.URL + "/" + strconv.Itoa(i), Amount: big.NewInt(0)},
+		}
+	}
+
+	store, err := openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	onrampABI, err := utils.LoadAbi("../../config/onramp-abi.json")
+	if err != nil {
+		t.Fatalf("failed to load abi: %v", err)
+	}
+	key, err := crypto.GenerateKey()
+	assert.NoError(t, err)
+	auth, err := bind.NewKeyedTransactorWithChainID(key, big.NewInt(1))
+	assert.NoError(t, err)
+	client := &fakeChainClient{head: 10}
+	stagingPath := t.TempDir()
+	a := &aggregator{
+		src:                 &sourceChain{chainID: 1, client: client, txm: utils.NewTxManager(client, auth, config.TxConfig{})},
+		store:               store,
+		abi:                 onrampABI,
+		ch:                  make(chan DataReadyEvent, 8),
+		retractCh:           make(chan DataReadyEvent, 8),
+		transfers:           make(map[int]AggregateTransfer),
+		packer:              firstFit{},
+		minDealSize:         8192,
+		maxDealSize:         1 << 20,
+		maxAggregationDelay: 200 * time.Millisecond,
+		stagingPath:         stagingPath,
+		fetcher:             newPieceFetcher(config.PieceFetchConfig{}, stagingPath),
+		stagedVerified:      make(map[cid.Cid]time.Time),
+		uploader:            noUploader{},
+		replicationFactor:   1,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.runAggregate(ctx) }()
+	start := time.Now()
+	for _, event := range events {
+		a.ch <- event
+	}
+	assert.Eventually(t, func() bool {
+		pending, _ := store.pendingOffers()
+		return len(pending) == 2
+	}, time.Second, time.Millisecond)
+	aggs, err := store.aggregates()
+	assert.NoError(t, err)
+	assert.Empty(t, aggs)
+
+	assert.Eventually(t, func() bool {
+		aggs, _ = store.aggregates()
+		return len(aggs) == 1 && aggs[0].Committed
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, time.Since(start), a.maxAggregationDelay)
+	cancel()
+	assert.NoError(t, <-done)
+
+	rec := aggs[0]
+	assert.EqualValues(t, 8192, rec.DealSize)
+	assert.Equal(t, []uint64{1, 2}, rec.OfferIDs)
+	assert.Equal(t, []common.Hash{client.sent[0].Hash()}, rec.CommitTxs)
+	assert.Len(t, client.sent, 1)
+	pending, err := store.pendingOffers()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+	// The staged aggregate holds the pieces followed by the padding and the index
+	info, err := os.Stat(a.stagedAggregatePath(rec.AggCommP))
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 8128, info.Size())
+	}
+}
@@ -0,0 +1,101 @@
+package aggregator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/filecoin-project/go-data-segment/datasegment"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+)
+
+// Settle the commits of aggregates left committing by a restart, from the receipts of
+// their recorded commit transactions. Returns the offers of aggregates that were not
+// committed, to be aggregated again, and whether commits are still pending.
+func (a *aggregator) reconcileCommits(ctx context.Context) ([]DataReadyEvent, bool, error) {
+	aggs, err := a.store.aggregates()
+	if err != nil {
+		return nil, false, err
+	}
+	var returned []DataReadyEvent
+	var unsettled bool
+	for _, rec := range aggs {
+		if rec.Committed {
+			continue
+		}
+		committed, done, err := txOutcome(ctx, a.src.client, rec.CommitTxs)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to check commit of transfer %d: %w", rec.TransferID, err)
+		}
+		if !done {
+			log.Printf("Commit of transfer %d is still pending", rec.TransferID)
+			unsettled = true
+			continue
+		}
+
+		var proofs []proofRecord
+		var uncommitted []DataReadyEvent
+		if committed {
+			agg, err := datasegment.NewAggregate(filabi.PaddedPieceSize(rec.DealSize), rec.Pieces)
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to rebuild aggregate for transfer %d: %w", rec.TransferID, err)
+			}
+			if proofs, err = computeProofs(agg, rec); err != nil {
+				return nil, false, err
+			}
+		} else {
+			for _, offerID := range rec.OfferIDs {
+				offer, found, err := a.store.getOffer(offerRef{ChainID: rec.ChainID, OfferID: offerID})
+				if err != nil {
+					return nil, false, err
+				}
+				if found {
+					uncommitted = append(uncommitted, offer.Event)
+				}
+			}
+		}
+		if err := a.store.settleCommit(rec.TransferID, committed, proofs); err != nil {
+			return nil, false, fmt.Errorf("failed to persist commit of transfer %d: %w", rec.TransferID, err)
+		}
+		if !committed {
+			a.transferLk.Lock()
+			delete(a.transfers, rec.TransferID)
+			a.transferLk.Unlock()
+		}
+		log.Printf("Settled commit of aggregate %s in transfer %d, committed: %t, %d offers return to pending", rec.AggCommP, rec.TransferID, committed, len(uncommitted))
+		returned = append(returned, uncommitted...)
+	}
+	return returned, unsettled, nil
+}
+
+// Return whether one of the transactions of a call was included successfully, and whether
+// that is known yet. A call is still pending while the node knows one of its transactions
+// without a receipt, otherwise it was dropped or never sent.
+func txOutcome(ctx context.Context, client ethereum.TransactionReader, hashes []common.Hash) (bool, bool, error) {
+	for _, hash := range hashes {
+		receipt, err := client.TransactionReceipt(ctx, hash)
+		if errors.Is(err, ethereum.NotFound) {
+			continue
+		}
+		if err != nil {
+			return false, false, err
+		}
+		// Replacements share the nonce, no other transaction of the call can be included
+		return receipt.Status == types.ReceiptStatusSuccessful, true, nil
+	}
+	for _, hash := range hashes {
+		_, _, err := client.TransactionByHash(ctx, hash)
+		if errors.Is(err, ethereum.NotFound) {
+			continue
+		}
+		if err != nil {
+			return false, false, err
+		}
+		return false, false, nil
+	}
+	return false, true, nil
+}
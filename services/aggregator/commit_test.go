@@ -0,0 +1,208 @@
+package aggregator
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/filecoin-project/go-data-segment/datasegment"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/assert"
+)
+
+// Source chain stand-in serving logs, the head block and commit transactions.
+// Sent transactions are included right away.
+type fakeChainClient struct {
+	lk       sync.Mutex
+	head     uint64
+	logs     []types.Log
+	receipts map[common.Hash]*types.Receipt
+	pending  map[common.Hash]bool // transactions known to the node without a receipt
+	sub      chan<- types.Log     // live logs of the subscription
+	sent     []*types.Transaction
+}
+
+type fakeSubscription struct {
+	err chan error
+}
+
+func (s *fakeSubscription) Unsubscribe()      {}
+func (s *fakeSubscription) Err() <-chan error { return s.err }
+
+func (c *fakeChainClient) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	var logs []types.Log
+	for _, l := range c.logs {
+		if l.BlockNumber >= q.FromBlock.Uint64() && l.BlockNumber <= q.ToBlock.Uint64() {
+			logs = append(logs, l)
+		}
+	}
+	return logs, nil
+}
+
+func (c *fakeChainClient) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.sub = ch
+	return &fakeSubscription{err: make(chan error)}, nil
+}
+
+func (c *fakeChainClient) setHead(head uint64) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.head = head
+}
+
+func (c *fakeChainClient) BlockNumber(ctx context.Context) (uint64, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.head, nil
+}
+
+func (c *fakeChainClient) TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error) {
+	if c.pending[hash] {
+		return nil, true, nil
+	}
+	return nil, false, ethereum.NotFound
+}
+
+func (c *fakeChainClient) TransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if receipt, ok := c.receipts[hash]; ok {
+		return receipt, nil
+	}
+	return nil, ethereum.NotFound
+}
+
+func (c *fakeChainClient) TransactionSender(ctx context.Context, tx *types.Transaction, block common.Hash, index uint) (common.Address, error) {
+	return common.Address{}, nil
+}
+
+func (c *fakeChainClient) Close() {}
+
+func (c *fakeChainClient) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	return nil, nil
+}
+
+func (c *fakeChainClient) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	return 50000, nil
+}
+
+func (c *fakeChainClient) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return big.NewInt(150), nil
+}
+
+func (c *fakeChainClient) SuggestGasTipCap(ctx context.Context) (*big.Int, error) {
+	return big.NewInt(50), nil
+}
+
+func (c *fakeChainClient) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.sent = append(c.sent, tx)
+	if c.receipts == nil {
+		c.receipts = make(map[common.Hash]*types.Receipt)
+	}
+	c.receipts[tx.Hash()] = &types.Receipt{Status: types.ReceiptStatusSuccessful, TxHash: tx.Hash(), BlockNumber: big.NewInt(int64(c.head))}
+	return nil
+}
+
+func (c *fakeChainClient) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return &types.Header{Number: big.NewInt(int64(c.head)), BaseFee: big.NewInt(100)}, nil
+}
+
+func (c *fakeChainClient) PendingCodeAt(ctx context.Context, account common.Address) ([]byte, error) {
+	return nil, nil
+}
+
+func (c *fakeChainClient) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	return 0, nil
+}
+
+// Test that commits left unfinished by a restart are settled from their transactions
+func TestReconcileCommits(t *testing.T) {
+	store, err := openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	included, failed, pending := common.HexToHash("0x01"), common.HexToHash("0x02"), common.HexToHash("0x03")
+	client := &fakeChainClient{
+		receipts: map[common.Hash]*types.Receipt{
+			included: {Status: types.ReceiptStatusSuccessful, BlockNumber: big.NewInt(10)},
+			failed:   {Status: types.ReceiptStatusFailed, BlockNumber: big.NewInt(10)},
+		},
+		pending: map[common.Hash]bool{pending: true},
+	}
+	a := &aggregator{
+		store:     store,
+		src:       &sourceChain{chainID: 1, client: client},
+		transfers: make(map[int]AggregateTransfer),
+	}
+	// Aggregates of two offers each, committed with the given transactions
+	for i, hashes := range [][]common.Hash{{included}, {failed}, {pending}, nil} {
+		events := []DataReadyEvent{pieceEvent(t, uint64(2*i+1), 256, 0), pieceEvent(t, uint64(2*i+2), 256, 0)}
+		for j := range events {
+			events[j].ChainID = 1
+		}
+		pieces, err := offerPieces(events)
+		assert.NoError(t, err)
+		agg, err := datasegment.NewAggregate(filabi.PaddedPieceSize(8192), pieces)
+		if err != nil {
+			t.Fatalf("failed to create aggregate: %v", err)
+		}
+		aggCommP, err := agg.PieceCID()
+		assert.NoError(t, err)
+		rec := aggregateRecord{
+			TransferID: i,
+			AggCommP:   aggCommP,
+			DealSize:   8192,
+			Pieces:     pieces,
+			OfferIDs:   offerIDs(events),
+			ChainID:    1,
+			CommitTxs:  hashes,
+		}
+		assert.NoError(t, store.saveAggregate(rec, events, nil))
+		a.transfers[i] = AggregateTransfer{agg: agg}
+	}
+
+	ctx := context.Background()
+	returned, unsettled, err := a.reconcileCommits(ctx)
+	assert.NoError(t, err)
+	assert.True(t, unsettled)
+	assert.ElementsMatch(t, []uint64{3, 4, 7, 8}, offerIDs(returned))
+	saved, _, _ := store.getAggregate(0)
+	assert.True(t, saved.Committed)
+	for _, transferID := range []int{1, 3} {
+		_, found, _ := store.getAggregate(transferID)
+		assert.False(t, found)
+		assert.NotContains(t, a.transfers, transferID)
+	}
+	saved, _, _ = store.getAggregate(2)
+	assert.False(t, saved.Committed)
+
+	// The pending commit was dropped by the node
+	client.pending = nil
+	returned, unsettled, err = a.reconcileCommits(ctx)
+	assert.NoError(t, err)
+	assert.False(t, unsettled)
+	assert.ElementsMatch(t, []uint64{5, 6}, offerIDs(returned))
+
+	offers, err := store.pendingOffers()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{3, 4, 5, 6, 7, 8}, offerIDs(offers))
+	for _, offerID := range []uint64{1, 2} {
+		_, found, err := store.getProof(offerRef{ChainID: 1, OfferID: offerID})
+		assert.NoError(t, err)
+		assert.True(t, found)
+	}
+	_, found, _ := store.getProof(offerRef{ChainID: 1, OfferID: 3})
+	assert.False(t, found)
+}
@@ -0,0 +1,306 @@
+package aggregator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/FIL-Builders/xchainClient/utils"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/builtin"
+	verifregtypes "github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
+	lotustypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/google/uuid"
+)
+
+// Method of the client contract that transfers DataCap to the verified registry,
+// with the encoded allocation requests as operator data
+const allocateMethod = "allocate"
+
+// Onboards aggregates with Direct Data Onboarding (DDO). Instead of a market deal the
+// client contract allocates DataCap to the aggregate piece in the verified registry,
+// and the provider claims the allocation by importing the exported aggregate with
+// boost's direct deal flow. Nothing is sent to boost, the import is manual, and no
+// DealNotify event is emitted so the offers of these aggregates are never proven.
+type allocator struct {
+	client  ethereum.TransactionReader // looks up allocate transactions left by earlier attempts
+	txm     *utils.TxManager           // sends allocations to the client contract on the destination chain
+	abi     *abi.ABI                   // client contract ABI with the allocate method
+	minSize uint64                     // padded deal size from which aggregates are onboarded directly
+	termMax filabi.ChainEpoch          // epochs providers may earn power for the data
+}
+
+// Return the configured allocator, nil to make market deals
+func newAllocator(ctx context.Context, cfg *config.Config) (*allocator, error) {
+	if !cfg.DDO.Enabled {
+		return nil, nil
+	}
+	proverABI, err := utils.LoadAbi(cfg.ProverABIPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := proverABI.Methods[allocateMethod]; !ok {
+		return nil, fmt.Errorf("prover abi %s has no %s method", cfg.ProverABIPath, allocateMethod)
+	}
+	termMax := filabi.ChainEpoch(cfg.DDO.TermMax)
+	if termMax == 0 {
+		termMax = verifregtypes.MaximumVerifiedAllocationTerm
+	}
+	termMin := filabi.ChainEpoch(cfg.DealDuration)
+	if termMin < verifregtypes.MinimumVerifiedAllocationTerm || termMax < termMin || termMax > verifregtypes.MaximumVerifiedAllocationTerm {
+		return nil, fmt.Errorf("DDO requires %d <= DealDuration <= DDO.TermMax <= %d", verifregtypes.MinimumVerifiedAllocationTerm, verifregtypes.MaximumVerifiedAllocationTerm)
+	}
+
+	client, err := ethclient.Dial(LotusEthURL(cfg.Destination.LotusAPI))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the Ethereum client on the destination chain: using url %s: %w", cfg.Destination.LotusAPI, err)
+	}
+	auth, err := utils.LoadPrivateKey(cfg, cfg.Destination.ChainID)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[ALERT] DDO is enabled: aggregates of at least %d bytes must be imported by providers with boostd import-direct and their offers are not proven on the source chains", cfg.DDO.MinDealSize)
+	return &allocator{
+		client:  client,
+		txm:     utils.NewTxManager(client, auth, cfg.DDO.Tx),
+		abi:     proverABI,
+		minSize: cfg.DDO.MinDealSize,
+		termMax: termMax,
+	}, nil
+}
+
+// Return true if aggregates of the padded deal size are onboarded with DDO
+func (a *aggregator) isDirect(dealSize uint64) bool {
+	return a.allocator != nil && dealSize >= a.allocator.minSize
+}
+
+// Return the f4 address of the client contract, the client of every deal and allocation
+func (a *aggregator) dealClient() (address.Address, error) {
+	client, err := address.NewDelegatedAddress(builtin.EthereumAddressManagerActorID, a.proverAddr[:])
+	if err != nil {
+		return address.Undef, fmt.Errorf("failed to translate prover address (%s) into a Filecoin f4 address: %w", a.proverAddr.Hex(), err)
+	}
+	return client, nil
+}
+
+// Encode the request allocating DataCap to the aggregate piece for the provider,
+// to be claimed before expiration
+func allocationRequest(provider filabi.ActorID, rec aggregateRecord, termMin, termMax, expiration filabi.ChainEpoch) ([]byte, error) {
+	req := verifregtypes.AllocationRequests{
+		Allocations: []verifregtypes.AllocationRequest{{
+			Provider:   provider,
+			Data:       rec.AggCommP,
+			Size:       filabi.PaddedPieceSize(rec.DealSize),
+			TermMin:    termMin,
+			TermMax:    termMax,
+			Expiration: expiration,
+		}},
+		Extensions: []verifregtypes.ClaimExtensionRequest{},
+	}
+	var buf bytes.Buffer
+	if err := req.MarshalCBOR(&buf); err != nil {
+		return nil, fmt.Errorf("failed to encode allocation request: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Allocate DataCap to the aggregate for the provider from the client contract and
+// export the aggregate with the allocation in its manifest, for the provider to import
+// with `boostd import-direct`. An allocation made by an earlier attempt that is not
+// recorded on a deal is used instead of allocating again.
+func (a *aggregator) sendDirectDeal(ctx context.Context, sp storageProvider, rec aggregateRecord) (dealRecord, error) {
+	deal := dealRecord{Provider: sp.actor, DealUUID: uuid.New(), ProposedAt: time.Now(), Offline: true}
+	providerID, err := address.IDFromAddress(sp.actor)
+	if err != nil {
+		return deal, fmt.Errorf("provider %s is not an ID address: %w", sp.actor, err)
+	}
+	if err := a.exportAggregate(rec); err != nil {
+		return deal, fmt.Errorf("failed to export aggregate for direct onboarding: %w", err)
+	}
+
+	tipset, err := a.lotusAPI.ChainHead(ctx)
+	if err != nil {
+		return deal, fmt.Errorf("cannot get chain head: %w", err)
+	}
+	provider := filabi.ActorID(providerID)
+	allocationID, alloc, err := a.resolveAllocation(ctx, rec, provider, tipset.Height())
+	if err != nil {
+		return deal, err
+	}
+	if alloc != nil {
+		log.Printf("Using allocation %d of aggregate %s for %s made by an earlier attempt", allocationID, rec.AggCommP, sp.actor)
+		deal.StartEpoch = alloc.Expiration
+	} else {
+		// The allocation must be claimed by the start epoch a market deal would have
+		delay := min(filabi.ChainEpoch(a.dealDelayEpochs), verifregtypes.MaximumVerifiedAllocationExpiration)
+		deal.StartEpoch = tipset.Height() + delay
+		if allocationID, err = a.allocate(ctx, rec, provider, deal.StartEpoch); err != nil {
+			return deal, err
+		}
+	}
+	deal.EndEpoch = deal.StartEpoch + filabi.ChainEpoch(a.dealDuration)
+	deal.AllocationID = allocationID
+	err = a.store.updateAggregate(rec.TransferID, func(rec *aggregateRecord) {
+		delete(rec.Allocating, provider)
+	})
+	if err != nil {
+		return deal, fmt.Errorf("failed to persist allocation %d of transfer %d: %w", allocationID, rec.TransferID, err)
+	}
+	log.Printf("Allocation %d of aggregate %s is ready to be claimed by %s", allocationID, rec.AggCommP, sp.actor)
+	if err := a.addOfflineDeal(rec, deal); err != nil {
+		log.Printf("[ERROR] failed to add allocation %d to the manifest of aggregate %s: %s", allocationID, rec.AggCommP, err)
+	}
+	return deal, nil
+}
+
+// Return the allocation of the aggregate for the provider left by an earlier attempt, nil
+// if there is none and DataCap has to be allocated. Allocate transactions of earlier attempts
+// are settled first, an error is returned while one of them is pending or its allocation
+// is not found, to not allocate twice.
+func (a *aggregator) resolveAllocation(ctx context.Context, rec aggregateRecord, provider filabi.ActorID, head filabi.ChainEpoch) (verifregtypes.AllocationId, *verifregtypes.Allocation, error) {
+	included := false
+	if hashes := rec.Allocating[provider]; len(hashes) > 0 {
+		var done bool
+		var err error
+		included, done, err = txOutcome(ctx, a.allocator.client, hashes)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to check allocation of aggregate %s for f0%d: %w", rec.AggCommP, provider, err)
+		}
+		if !done {
+			return 0, nil, fmt.Errorf("allocation of aggregate %s for f0%d is still pending", rec.AggCommP, provider)
+		}
+		if !included {
+			// Forget the failed or dropped transactions before allocating again
+			err := a.store.updateAggregate(rec.TransferID, func(rec *aggregateRecord) {
+				delete(rec.Allocating, provider)
+			})
+			if err != nil {
+				return 0, nil, fmt.Errorf("failed to persist failed allocation of transfer %d: %w", rec.TransferID, err)
+			}
+		}
+	}
+	id, alloc, err := a.findAllocation(ctx, rec, provider)
+	if err != nil {
+		return 0, nil, err
+	}
+	if alloc != nil && alloc.Expiration > head {
+		return id, alloc, nil
+	}
+	if included {
+		return 0, nil, fmt.Errorf("no allocation of aggregate %s for f0%d found after allocating", rec.AggCommP, provider)
+	}
+	return 0, nil, nil
+}
+
+// Allocate DataCap to the aggregate for the provider, to be claimed before expiration.
+// The allocate transactions are recorded on the aggregate until the allocation is found.
+func (a *aggregator) allocate(ctx context.Context, rec aggregateRecord, provider filabi.ActorID, expiration filabi.ChainEpoch) (verifregtypes.AllocationId, error) {
+	operatorData, err := allocationRequest(provider, rec, filabi.ChainEpoch(a.dealDuration), a.allocator.termMax, expiration)
+	if err != nil {
+		return 0, err
+	}
+
+	// One DataCap token is needed for every byte allocated
+	datacap := new(big.Int).Mul(new(big.Int).SetUint64(rec.DealSize), builtin.TokenPrecision.Int)
+	log.Printf("Allocating %d bytes of DataCap to aggregate %s for f0%d", rec.DealSize, rec.AggCommP, provider)
+	sent := func(hash common.Hash) {
+		err := a.store.updateAggregate(rec.TransferID, func(rec *aggregateRecord) {
+			if rec.Allocating == nil {
+				rec.Allocating = make(map[filabi.ActorID][]common.Hash)
+			}
+			rec.Allocating[provider] = append(rec.Allocating[provider], hash)
+		})
+		if err != nil {
+			log.Printf("[ERROR] failed to persist tx %s allocating transfer %d for f0%d: %s", hash.Hex(), rec.TransferID, provider, err)
+		}
+	}
+	receipt, err := a.allocator.txm.TransactNotify(ctx, sent, a.proverAddr, a.allocator.abi, allocateMethod, operatorData, datacap)
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate datacap: %w", err)
+	}
+	log.Printf("Allocation transaction %s included in block %s", receipt.TxHash, receipt.BlockNumber)
+
+	id, alloc, err := a.findAllocation(ctx, rec, provider)
+	if err != nil {
+		return 0, err
+	}
+	if alloc == nil {
+		return 0, fmt.Errorf("no allocation of aggregate %s for f0%d found after allocating", rec.AggCommP, provider)
+	}
+	return id, nil
+}
+
+// Return the newest allocation of the aggregate for the provider that is not
+// recorded on a deal yet, nil if there is none
+func (a *aggregator) findAllocation(ctx context.Context, rec aggregateRecord, provider filabi.ActorID) (verifregtypes.AllocationId, *verifregtypes.Allocation, error) {
+	client, err := a.dealClient()
+	if err != nil {
+		return 0, nil, err
+	}
+	allocations, err := a.lotusAPI.StateGetAllocations(ctx, client, lotustypes.EmptyTSK)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get allocations of %s: %w", client, err)
+	}
+	recorded := make(map[verifregtypes.AllocationId]bool)
+	for _, deal := range rec.Deals {
+		recorded[deal.AllocationID] = true
+	}
+	var found verifregtypes.AllocationId
+	for id, alloc := range allocations {
+		if alloc.Provider == provider && alloc.Data.Equals(rec.AggCommP) && !recorded[id] && id > found {
+			found = id
+		}
+	}
+	if found == 0 {
+		return 0, nil, nil
+	}
+	alloc := allocations[found]
+	return found, &alloc, nil
+}
+
+// Return the state of a directly onboarded deal from its allocation, and from the
+// claim made for it once the provider sealed the data
+func (a *aggregator) queryAllocation(ctx context.Context, deal dealRecord, head filabi.ChainEpoch) (string, filabi.DealID, string) {
+	client, err := a.dealClient()
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		return "", 0, ""
+	}
+	alloc, err := a.lotusAPI.StateGetAllocation(ctx, client, deal.AllocationID, lotustypes.EmptyTSK)
+	if err != nil {
+		log.Printf("[ERROR] failed to get allocation %d of deal %s: %s", deal.AllocationID, deal.DealUUID, err)
+		return "", 0, ""
+	}
+	if alloc != nil {
+		switch {
+		case head > alloc.Expiration:
+			return dealExpired, 0, "allocation was not claimed before its expiration"
+		case deal.Imported:
+			return dealSealing, 0, ""
+		}
+		return dealAccepted, 0, ""
+	}
+
+	// Claims have the ID of the allocation they claimed
+	claim, err := a.lotusAPI.StateGetClaim(ctx, deal.Provider, verifregtypes.ClaimId(deal.AllocationID), lotustypes.EmptyTSK)
+	if err != nil {
+		log.Printf("[ERROR] failed to get claim %d of deal %s: %s", deal.AllocationID, deal.DealUUID, err)
+		return "", 0, ""
+	}
+	switch {
+	case claim == nil:
+		return dealExpired, 0, "allocation was removed without being claimed"
+	case head > claim.TermStart+claim.TermMax:
+		return dealExpired, 0, ""
+	}
+	return dealActive, 0, ""
+}
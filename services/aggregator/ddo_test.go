@@ -0,0 +1,217 @@
+package aggregator
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/FIL-Builders/xchainClient/utils"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	verifregtypes "github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
+	"github.com/filecoin-project/lotus/api/v0api"
+	lotustypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+)
+
+// Lotus stand-in serving verified registry state
+type fakeVerifreg struct {
+	v0api.FullNode
+	head        filabi.ChainEpoch
+	allocations map[verifregtypes.AllocationId]verifregtypes.Allocation
+	claims      map[verifregtypes.ClaimId]verifregtypes.Claim
+}
+
+func (f *fakeVerifreg) ChainHead(ctx context.Context) (*lotustypes.TipSet, error) {
+	miner, _ := address.NewIDAddress(1)
+	root := cid.NewCidV1(cid.Raw, []byte{0})
+	return lotustypes.NewTipSet([]*lotustypes.BlockHeader{{
+		Miner:                 miner,
+		Height:                f.head,
+		ParentStateRoot:       root,
+		ParentMessageReceipts: root,
+		Messages:              root,
+	}})
+}
+
+func (f *fakeVerifreg) StateGetAllocations(ctx context.Context, clientAddr address.Address, tsk lotustypes.TipSetKey) (map[verifregtypes.AllocationId]verifregtypes.Allocation, error) {
+	return f.allocations, nil
+}
+
+func (f *fakeVerifreg) StateGetAllocation(ctx context.Context, clientAddr address.Address, id verifregtypes.AllocationId, tsk lotustypes.TipSetKey) (*verifregtypes.Allocation, error) {
+	if alloc, ok := f.allocations[id]; ok {
+		return &alloc, nil
+	}
+	return nil, nil
+}
+
+func (f *fakeVerifreg) StateGetClaim(ctx context.Context, providerAddr address.Address, id verifregtypes.ClaimId, tsk lotustypes.TipSetKey) (*verifregtypes.Claim, error) {
+	if claim, ok := f.claims[id]; ok {
+		return &claim, nil
+	}
+	return nil, nil
+}
+
+// Test that retried direct deals settle the allocate transactions of earlier
+// attempts and use their allocation instead of allocating DataCap again
+func TestDirectDealRetry(t *testing.T) {
+	store, err := openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	proverABI, err := utils.LoadAbi("../../config/prover-abi.json")
+	if err != nil {
+		t.Fatalf("failed to load abi: %v", err)
+	}
+	key, err := crypto.GenerateKey()
+	assert.NoError(t, err)
+	auth, err := bind.NewKeyedTransactorWithChainID(key, big.NewInt(314))
+	assert.NoError(t, err)
+	client := &fakeChainClient{head: 10}
+	lotus := &fakeVerifreg{head: 100}
+	a := &aggregator{
+		store:           store,
+		lotusAPI:        lotus,
+		proverAddr:      common.HexToAddress("0x8560C0fAC0EF0547863e1748D15B85a5c3FF4B2f"),
+		exportPath:      t.TempDir(),
+		stagingPath:     t.TempDir(),
+		dealDelayEpochs: 200,
+		dealDuration:    518400,
+		allocator: &allocator{
+			client:  client,
+			txm:     utils.NewTxManager(client, auth, config.TxConfig{}),
+			abi:     proverABI,
+			termMax: 5256000,
+		},
+	}
+	rec := aggregateRecord{TransferID: 0, AggCommP: testAggCommp(t, 1), DealSize: 2048}
+	assert.NoError(t, store.saveAggregate(rec, nil, nil))
+	// The aggregate is exported already
+	assert.NoError(t, os.WriteFile(a.exportedAggregatePath(rec.AggCommP), make([]byte, 2032), 0644))
+	provider, _ := address.NewIDAddress(1000)
+	sp := storageProvider{actor: provider}
+	ctx := context.Background()
+	load := func() aggregateRecord {
+		rec, found, err := store.getAggregate(0)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		return *rec
+	}
+
+	// The allocation is not found after allocating, the transaction is kept
+	_, err = a.sendDirectDeal(ctx, sp, load())
+	assert.ErrorContains(t, err, "no allocation")
+	assert.Len(t, client.sent, 1)
+	hash := client.sent[0].Hash()
+	assert.Equal(t, []common.Hash{hash}, load().Allocating[1000])
+
+	// Retries do not allocate again while the transaction is pending or its allocation is missing
+	receipt := client.receipts[hash]
+	delete(client.receipts, hash)
+	client.pending = map[common.Hash]bool{hash: true}
+	_, err = a.sendDirectDeal(ctx, sp, load())
+	assert.ErrorContains(t, err, "pending")
+	client.receipts[hash] = receipt
+	client.pending = nil
+	_, err = a.sendDirectDeal(ctx, sp, load())
+	assert.ErrorContains(t, err, "no allocation")
+	assert.Len(t, client.sent, 1)
+
+	// The allocation made by the transaction is used once it shows up
+	lotus.allocations = map[verifregtypes.AllocationId]verifregtypes.Allocation{
+		7: {Provider: 1000, Data: rec.AggCommP, Expiration: 300},
+	}
+	deal, err := a.sendDirectDeal(ctx, sp, load())
+	assert.NoError(t, err)
+	assert.EqualValues(t, 7, deal.AllocationID)
+	assert.EqualValues(t, 300, deal.StartEpoch)
+	assert.Len(t, client.sent, 1)
+	assert.Empty(t, load().Allocating)
+
+	// Dropped transactions are forgotten and DataCap is allocated again
+	lotus.allocations = nil
+	assert.NoError(t, store.updateAggregate(0, func(rec *aggregateRecord) {
+		rec.Allocating = map[filabi.ActorID][]common.Hash{1000: {common.HexToHash("0x01")}}
+	}))
+	_, err = a.sendDirectDeal(ctx, sp, load())
+	assert.ErrorContains(t, err, "no allocation")
+	assert.Len(t, client.sent, 2)
+	assert.Equal(t, []common.Hash{client.sent[1].Hash()}, load().Allocating[1000])
+}
+
+func TestLotusEthURL(t *testing.T) {
+	assert.Equal(t, "https://api.calibration.node.glif.io/rpc/v1", LotusEthURL("https://api.calibration.node.glif.io"))
+	assert.Equal(t, "http://127.0.0.1:1234/rpc/v1", LotusEthURL("http://127.0.0.1:1234/rpc/v0"))
+}
+
+func TestAllocationRequest(t *testing.T) {
+	rec := aggregateRecord{AggCommP: testAggCommp(t, 1), DealSize: 1 << 20}
+	bs, err := allocationRequest(1000, rec, 518400, 5256000, 3000)
+	assert.NoError(t, err)
+	var req verifregtypes.AllocationRequests
+	assert.NoError(t, req.UnmarshalCBOR(bytes.NewReader(bs)))
+	assert.Equal(t, []verifregtypes.AllocationRequest{{
+		Provider:   1000,
+		Data:       rec.AggCommP,
+		Size:       1 << 20,
+		TermMin:    518400,
+		TermMax:    5256000,
+		Expiration: 3000,
+	}}, req.Allocations)
+	assert.Empty(t, req.Extensions)
+}
+
+func TestAllocationDeals(t *testing.T) {
+	provider, _ := address.NewIDAddress(1000)
+	aggCommp := testAggCommp(t, 1)
+	lotus := &fakeVerifreg{
+		allocations: map[verifregtypes.AllocationId]verifregtypes.Allocation{
+			3: {Provider: 1000, Data: aggCommp, Expiration: 100},
+			4: {Provider: 1001, Data: aggCommp, Expiration: 100},
+			5: {Provider: 1000, Data: testAggCommp(t, 2), Expiration: 100},
+		},
+		claims: map[verifregtypes.ClaimId]verifregtypes.Claim{
+			2: {Provider: 1000, Data: aggCommp, TermStart: 50, TermMax: 1000},
+		},
+	}
+	a := &aggregator{lotusAPI: lotus, proverAddr: common.HexToAddress("0x8560C0fAC0EF0547863e1748D15B85a5c3FF4B2f")}
+	ctx := context.Background()
+
+	// Allocations already recorded on a deal are skipped
+	rec := aggregateRecord{AggCommP: aggCommp, Deals: []dealRecord{{AllocationID: 2}}}
+	id, alloc, err := a.findAllocation(ctx, rec, 1000)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, id)
+	if assert.NotNil(t, alloc) {
+		assert.EqualValues(t, 100, alloc.Expiration)
+	}
+	rec.Deals = append(rec.Deals, dealRecord{AllocationID: 3})
+	_, alloc, err = a.findAllocation(ctx, rec, 1000)
+	assert.NoError(t, err)
+	assert.Nil(t, alloc)
+
+	for _, tc := range []struct {
+		deal  dealRecord
+		head  filabi.ChainEpoch
+		state string
+	}{
+		{dealRecord{Provider: provider, AllocationID: 3}, 90, dealAccepted},
+		{dealRecord{Provider: provider, AllocationID: 3, Imported: true}, 90, dealSealing},
+		{dealRecord{Provider: provider, AllocationID: 3}, 110, dealExpired},
+		{dealRecord{Provider: provider, AllocationID: 2}, 500, dealActive},
+		{dealRecord{Provider: provider, AllocationID: 2}, 1100, dealExpired},
+		{dealRecord{Provider: provider, AllocationID: 9}, 90, dealExpired},
+	} {
+		state, dealID, _ := a.queryDeal(ctx, tc.deal, tc.head)
+		assert.Equal(t, tc.state, state, "allocation %d at %d", tc.deal.AllocationID, tc.head)
+		assert.Zero(t, dealID)
+	}
+}
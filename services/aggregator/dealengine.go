@@ -0,0 +1,259 @@
+package aggregator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// default Lighthouse deal engine endpoint
+	defaultLighthouseDealURL = "https://calibration.lighthouse.storage"
+	// deal engine that made deals through Lighthouse
+	lighthouseEngine = "lighthouse"
+)
+
+// Makes deals for uploaded aggregates through the Lighthouse deal engine, which
+// picks providers, replicates and repairs on its own
+type lighthouseDealEngine struct {
+	client *http.Client
+	url    string
+	auth   string // LighthouseAuth bearer token
+}
+
+// A deal reported by the Lighthouse deal status API
+type lighthouseDeal struct {
+	DealUUID        string `json:"dealUUID"`
+	StorageProvider string `json:"storageProvider"`
+	DealStatus      string `json:"dealStatus"`
+	ChainDealID     int64  `json:"chainDealID"`
+	StartEpoch      int64  `json:"startEpoch"`
+	EndEpoch        int64  `json:"endEpoch"`
+	PieceCID        string `json:"pieceCID"`
+}
+
+// Return the configured deal engine, nil to propose deals over boost
+func newDealEngine(cfg *config.Config, uploader AggregateUploader) (*lighthouseDealEngine, error) {
+	switch cfg.DealEngine {
+	case "", "boost":
+		return nil, nil
+	case "lighthouse":
+		// The deal engine fetches aggregates by their IPFS CID
+		switch uploader.(type) {
+		case *lighthouseUploader, *ipfsUploader:
+		default:
+			return nil, fmt.Errorf("lighthouse deal engine requires the lighthouse or ipfs upload backend")
+		}
+		return newLighthouseDealEngine(cfg.LighthouseDealURL, cfg.LighthouseAuth)
+	default:
+		return nil, fmt.Errorf("unknown deal engine %q, expected boost or lighthouse", cfg.DealEngine)
+	}
+}
+
+func newLighthouseDealEngine(dealURL, auth string) (*lighthouseDealEngine, error) {
+	if auth == "" {
+		return nil, fmt.Errorf("lighthouse deal engine requires LighthouseAuth")
+	}
+	if dealURL == "" {
+		dealURL = defaultLighthouseDealURL
+	}
+	return &lighthouseDealEngine{
+		client: &http.Client{Timeout: time.Minute},
+		url:    strings.TrimSuffix(dealURL, "/"),
+		auth:   auth,
+	}, nil
+}
+
+// Register a job replicating the uploaded content to replicationTarget providers for the given epochs
+func (e *lighthouseDealEngine) submit(ctx context.Context, payloadCID string, replicationTarget int, epochs uint64) error {
+	endDate := time.Now().Add(time.Duration(epochs) * builtin.EpochDurationSeconds * time.Second)
+	form := url.Values{
+		"cid":               {payloadCID},
+		"jobType":           {"replication"},
+		"replicationTarget": {strconv.Itoa(replicationTarget)},
+		"epochs":            {strconv.FormatUint(epochs, 10)},
+		"endDate":           {strconv.FormatInt(endDate.Unix(), 10)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url+"/api/register_job", strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = e.do(req)
+	return err
+}
+
+// Return the deals the engine made for the uploaded content
+func (e *lighthouseDealEngine) status(ctx context.Context, payloadCID string) ([]lighthouseDeal, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.url+"/api/deal_status?cid="+url.QueryEscape(payloadCID), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	body, err := e.do(req)
+	if err != nil {
+		return nil, err
+	}
+	var deals []lighthouseDeal
+	if err := json.Unmarshal(body, &deals); err != nil {
+		// Some deployments wrap the deals in an object
+		var wrapped struct {
+			DealInfo []lighthouseDeal `json:"dealInfo"`
+		}
+		if err := json.Unmarshal(body, &wrapped); err != nil {
+			return nil, fmt.Errorf("failed to decode deal status: %w", err)
+		}
+		deals = wrapped.DealInfo
+	}
+	return deals, nil
+}
+
+func (e *lighthouseDealEngine) do(req *http.Request) ([]byte, error) {
+	req.Header.Set("Authorization", "Bearer "+e.auth)
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s %s", req.Method, req.URL.Path, resp.Status, body)
+	}
+	return body, nil
+}
+
+// Map the status of a deal reported by Lighthouse to a deal state. Published deals
+// carry their chain deal ID and are followed through the market actor from then on.
+func lighthouseDealState(d lighthouseDeal) (string, filabi.DealID) {
+	status := strings.ToLower(d.DealStatus)
+	switch {
+	case strings.Contains(status, "error"), strings.Contains(status, "fail"), strings.Contains(status, "reject"):
+		return dealFailed, 0
+	case strings.Contains(status, "slash"), strings.Contains(status, "terminat"):
+		return dealSlashed, filabi.DealID(max(d.ChainDealID, 0))
+	case d.ChainDealID > 0:
+		return dealSealing, filabi.DealID(d.ChainDealID)
+	case strings.Contains(status, "transfer"):
+		return dealTransferring, 0
+	case strings.Contains(status, "seal"), strings.Contains(status, "publish"):
+		return dealSealing, 0
+	}
+	return dealAccepted, 0
+}
+
+// Return the IPFS CID of an aggregate uploaded to a gateway at `.../ipfs/<cid>`
+func uploadedCID(retrievalURL string) (string, bool) {
+	_, path, found := strings.Cut(retrievalURL, "/ipfs/")
+	if !found {
+		return "", false
+	}
+	c, err := cid.Decode(strings.Split(path, "/")[0])
+	if err != nil {
+		return "", false
+	}
+	return c.String(), true
+}
+
+// Submit the uploaded aggregate to the deal engine once. Returns false if it was not
+// uploaded to IPFS, the deal engine can only make deals for uploaded content.
+func (a *aggregator) submitToDealEngine(ctx context.Context, rec *aggregateRecord) (bool, error) {
+	if rec.DealEngineCID != "" {
+		return true, nil
+	}
+	payloadCID, ok := uploadedCID(rec.RetrievalURL)
+	if !ok {
+		return false, nil
+	}
+	if err := a.dealEngine.submit(ctx, payloadCID, a.replicationFactor, a.dealDuration); err != nil {
+		log.Printf("[ERROR] failed to submit aggregate %s to the deal engine: %s", rec.AggCommP, err)
+		return true, nil
+	}
+	log.Printf("Submitted aggregate %s uploaded as %s to the deal engine for %d replicas", rec.AggCommP, payloadCID, a.replicationFactor)
+	err := a.store.updateAggregate(rec.TransferID, func(r *aggregateRecord) {
+		r.DealEngineCID = payloadCID
+	})
+	if err != nil {
+		return true, fmt.Errorf("failed to persist deal engine submission of aggregate %d: %w", rec.TransferID, err)
+	}
+	return true, nil
+}
+
+// Record the deals the deal engine reports for the aggregate. New deals are added
+// and deals that are not published yet are updated, published deals are followed
+// through the market actor like deals proposed by the aggregator. Deals for
+// another piece are rejected and the aggregate is replicated without the engine.
+func (a *aggregator) updateEngineDeals(ctx context.Context, rec aggregateRecord) error {
+	deals, err := a.dealEngine.status(ctx, rec.DealEngineCID)
+	if err != nil {
+		log.Printf("[ERROR] failed to get deal status of aggregate %s from the deal engine: %s", rec.AggCommP, err)
+		return nil
+	}
+	return a.store.updateAggregate(rec.TransferID, func(r *aggregateRecord) {
+		for _, reported := range deals {
+			provider, err := address.NewFromString(reported.StorageProvider)
+			if err != nil {
+				log.Printf("[ERROR] deal engine reported deal %s with invalid provider %q", reported.DealUUID, reported.StorageProvider)
+				continue
+			}
+			dealUUID, err := uuid.Parse(reported.DealUUID)
+			if err != nil {
+				// Identify deals without a proposal UUID by their provider and chain deal
+				dealUUID = uuid.NewSHA1(uuid.NameSpaceOID, []byte(fmt.Sprintf("%s/%s/%d", rec.DealEngineCID, provider, reported.ChainDealID)))
+			}
+
+			var deal *dealRecord
+			for i := range r.Deals {
+				if r.Deals[i].DealUUID == dealUUID {
+					deal = &r.Deals[i]
+				}
+			}
+			if deal == nil {
+				r.Deals = append(r.Deals, dealRecord{
+					Provider:   provider,
+					DealUUID:   dealUUID,
+					Attempt:    len(r.Deals) + 1,
+					Accepted:   true,
+					ProposedAt: time.Now(),
+					StartEpoch: filabi.ChainEpoch(reported.StartEpoch),
+					EndEpoch:   filabi.ChainEpoch(reported.EndEpoch),
+					Engine:     lighthouseEngine,
+				})
+				deal = &r.Deals[len(r.Deals)-1]
+			} else if deal.DealID != 0 || isTerminalDealState(deal.State) {
+				continue
+			}
+			// A deal for another piece does not store the aggregate, the aggregator
+			// proposes it to providers itself
+			if reported.PieceCID != "" && reported.PieceCID != rec.AggCommP.String() {
+				log.Printf("[ERROR] deal %s of aggregate %s with %s is for piece %s", dealUUID, rec.AggCommP, provider, reported.PieceCID)
+				deal.Accepted = false
+				deal.setState(dealRejected, fmt.Sprintf("deal engine made the deal for piece %s", reported.PieceCID))
+				r.EngineFailed = true
+				continue
+			}
+			state, dealID := lighthouseDealState(reported)
+			if dealID != 0 {
+				deal.DealID = dealID
+			}
+			if deal.setState(state, reported.DealStatus) {
+				log.Printf("Deal %s with %s for aggregate %s is %s", deal.DealUUID, deal.Provider, r.AggCommP, state)
+			}
+		}
+	})
+}
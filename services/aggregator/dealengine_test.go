@@ -0,0 +1,178 @@
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/filecoin-project/go-address"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDealEngine(t *testing.T) {
+	e, err := newDealEngine(&config.Config{}, noUploader{})
+	assert.NoError(t, err)
+	assert.Nil(t, e)
+
+	_, err = newDealEngine(&config.Config{DealEngine: "lighthouse", LighthouseAuth: "token"}, noUploader{})
+	assert.Error(t, err)
+	_, err = newDealEngine(&config.Config{DealEngine: "lighthouse"}, &ipfsUploader{})
+	assert.Error(t, err)
+	e, err = newDealEngine(&config.Config{DealEngine: "lighthouse", LighthouseAuth: "token"}, &ipfsUploader{})
+	assert.NoError(t, err)
+	assert.Equal(t, defaultLighthouseDealURL, e.url)
+	_, err = newDealEngine(&config.Config{DealEngine: "estuary"}, noUploader{})
+	assert.Error(t, err)
+}
+
+func TestUploadedCID(t *testing.T) {
+	c, ok := uploadedCID("https://gateway.lighthouse.storage/ipfs/bafkqaaa")
+	assert.True(t, ok)
+	assert.Equal(t, "bafkqaaa", c)
+	_, ok = uploadedCID("https://bucket.example/baga6ea4seaqaaa")
+	assert.False(t, ok)
+	_, ok = uploadedCID("")
+	assert.False(t, ok)
+}
+
+func TestLighthouseDealEngine(t *testing.T) {
+	store, err := openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	// Deal engine stand-in that makes two deals for every registered job
+	var lk sync.Mutex
+	jobs := make(map[string]string)
+	status := `[
+		{"dealUUID": "4f0b2a4e-8a39-4b5e-9a3c-5f5b0d6c2a11", "storageProvider": "t01000", "dealStatus": "Transferring"},
+		{"storageProvider": "t01001", "dealStatus": "Sealing", "chainDealID": 42, "startEpoch": 100, "endEpoch": 200}
+	]`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		lk.Lock()
+		defer lk.Unlock()
+		switch r.URL.Path {
+		case "/api/register_job":
+			jobs[r.FormValue("cid")] = r.FormValue("replicationTarget")
+			fmt.Fprint(w, `{"message": "success"}`)
+		case "/api/deal_status":
+			if _, ok := jobs[r.URL.Query().Get("cid")]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, status)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	engine, err := newLighthouseDealEngine(srv.URL, "token")
+	if err != nil {
+		t.Fatalf("failed to create deal engine: %v", err)
+	}
+	a := &aggregator{store: store, dealEngine: engine, replicationFactor: 2, dealDuration: 518400}
+	rec := aggregateRecord{TransferID: 1, AggCommP: testAggCommp(t, 1), RetrievalURL: "https://gateway.lighthouse.storage/ipfs/bafkqaaa"}
+	assert.NoError(t, store.saveAggregate(rec, nil, nil))
+
+	ctx := context.Background()
+	assert.NoError(t, a.replicate(ctx, rec.TransferID))
+	assert.Equal(t, map[string]string{"bafkqaaa": "2"}, jobs)
+	saved, _, _ := store.getAggregate(rec.TransferID)
+	assert.Equal(t, "bafkqaaa", saved.DealEngineCID)
+	// Submitted aggregates are not submitted again
+	assert.NoError(t, a.replicate(ctx, rec.TransferID))
+	assert.Len(t, jobs, 1)
+
+	assert.NoError(t, a.updateEngineDeals(ctx, *saved))
+	saved, _, _ = store.getAggregate(rec.TransferID)
+	if assert.Len(t, saved.Deals, 2) {
+		p1, _ := address.NewIDAddress(1000)
+		assert.Equal(t, p1, saved.Deals[0].Provider)
+		assert.Equal(t, "4f0b2a4e-8a39-4b5e-9a3c-5f5b0d6c2a11", saved.Deals[0].DealUUID.String())
+		assert.Equal(t, dealTransferring, saved.Deals[0].State)
+		assert.Equal(t, dealSealing, saved.Deals[1].State)
+		assert.EqualValues(t, 42, saved.Deals[1].DealID)
+		assert.EqualValues(t, 200, saved.Deals[1].EndEpoch)
+		for _, deal := range saved.Deals {
+			assert.True(t, deal.Accepted)
+			assert.Equal(t, lighthouseEngine, deal.Engine)
+		}
+	}
+
+	// Reported deals are merged into the records they were first seen as
+	status = `{"dealInfo": [
+		{"dealUUID": "4f0b2a4e-8a39-4b5e-9a3c-5f5b0d6c2a11", "storageProvider": "t01000", "dealStatus": "Error: transfer failed"},
+		{"storageProvider": "t01001", "dealStatus": "Sealing", "chainDealID": 42, "startEpoch": 100, "endEpoch": 200}
+	]}`
+	assert.NoError(t, a.updateEngineDeals(ctx, *saved))
+	saved, _, _ = store.getAggregate(rec.TransferID)
+	if assert.Len(t, saved.Deals, 2) {
+		assert.Equal(t, dealFailed, saved.Deals[0].State)
+		assert.Equal(t, "Error: transfer failed", saved.Deals[0].Message)
+		assert.Len(t, saved.Deals[1].Transitions, 1)
+	}
+
+	// Deals for another piece are rejected and do not count as replicas
+	status = `[
+		{"storageProvider": "t01001", "dealStatus": "Sealing", "chainDealID": 42, "startEpoch": 100, "endEpoch": 200},
+		{"dealUUID": "9c7e1d2a-3b4f-4e5a-8d6c-7b8a9f0e1d2c", "storageProvider": "t01002", "dealStatus": "Sealing", "pieceCID": "baga6ea4seaqaaa"}
+	]`
+	assert.NoError(t, a.updateEngineDeals(ctx, *saved))
+	saved, _, _ = store.getAggregate(rec.TransferID)
+	assert.True(t, saved.EngineFailed)
+	if assert.Len(t, saved.Deals, 3) {
+		assert.False(t, saved.Deals[2].Accepted)
+		assert.Equal(t, dealRejected, saved.Deals[2].State)
+	}
+	assert.Equal(t, 1, saved.acceptedReplicas())
+
+	// The aggregate is then proposed to providers directly
+	h, err := libp2p.New(libp2p.NoListenAddrs)
+	if err != nil {
+		t.Fatalf("failed to create host: %v", err)
+	}
+	defer h.Close()
+	p3, _ := address.NewIDAddress(1003)
+	a.host = h
+	a.providers = []storageProvider{{actor: p3, peer: &peer.AddrInfo{ID: h.ID()}}}
+	a.retry = retryPolicy{maxAttempts: 5, failover: true}
+	assert.NoError(t, store.updateAggregate(rec.TransferID, func(r *aggregateRecord) { r.Committed = true }))
+	assert.NoError(t, a.retryDeals(ctx))
+	saved, _, _ = store.getAggregate(rec.TransferID)
+	if assert.Len(t, saved.Deals, 4) {
+		assert.Equal(t, p3, saved.Deals[3].Provider)
+		assert.Empty(t, saved.Deals[3].Engine)
+	}
+	assert.Len(t, jobs, 1)
+}
+
+func TestLighthouseDealState(t *testing.T) {
+	for _, tc := range []struct {
+		deal   lighthouseDeal
+		state  string
+		dealID uint64
+	}{
+		{lighthouseDeal{DealStatus: "Accepted"}, dealAccepted, 0},
+		{lighthouseDeal{DealStatus: "Transfer Started"}, dealTransferring, 0},
+		{lighthouseDeal{DealStatus: "Sealing: PreCommit1"}, dealSealing, 0},
+		{lighthouseDeal{DealStatus: "Active", ChainDealID: 7}, dealSealing, 7},
+		{lighthouseDeal{DealStatus: "Deal rejected"}, dealFailed, 0},
+		{lighthouseDeal{DealStatus: "Slashed", ChainDealID: 7}, dealSlashed, 7},
+	} {
+		state, dealID := lighthouseDealState(tc.deal)
+		assert.Equal(t, tc.state, state, tc.deal.DealStatus)
+		assert.EqualValues(t, tc.dealID, dealID, tc.deal.DealStatus)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package aggregator
+
+import "errors"
+
+func freeSpace(path string) (uint64, error) {
+	return 0, errors.New("free space checks are not supported on this platform")
+}
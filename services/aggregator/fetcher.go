@@ -0,0 +1,356 @@
+package aggregator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/FIL-Builders/xchainClient/config"
+)
+
+const (
+	// default number of sub pieces fetched at once
+	defaultFetchParallelism = 4
+	// default number of retries of a sub piece fetch failing without progress
+	defaultFetchRetries = 5
+	// default time a sub piece fetch may go without receiving data
+	defaultFetchTimeout = time.Minute
+	// prefix of the temporary files prefetched sub pieces are kept in
+	fetchFilePrefix = "fetch-"
+)
+
+// wait before the first retry of a failed fetch, doubled on every further failure
+var fetchRetryDelay = time.Second
+
+// Fetches sub pieces from their buffer locations, retrying and resuming failed fetches
+type pieceFetcher struct {
+	client      *http.Client
+	parallelism int
+	retries     int
+	timeout     time.Duration // time without progress after which a fetch is retried
+	tmpDir      string        // directory prefetched sub pieces are kept in until read
+}
+
+// A sub piece to fetch
+type pieceSource struct {
+	url   string
+	limit uint64 // unpadded size of the piece, more data is an error
+}
+
+func newPieceFetcher(cfg config.PieceFetchConfig, tmpDir string) *pieceFetcher {
+	f := &pieceFetcher{
+		client:      &http.Client{},
+		parallelism: cfg.Parallelism,
+		retries:     cfg.Retries,
+		timeout:     time.Duration(cfg.Timeout) * time.Second,
+		tmpDir:      tmpDir,
+	}
+	if f.parallelism <= 0 {
+		f.parallelism = defaultFetchParallelism
+	}
+	if f.retries <= 0 {
+		f.retries = defaultFetchRetries
+	}
+	if f.timeout <= 0 {
+		f.timeout = defaultFetchTimeout
+	}
+	return f
+}
+
+// Remove prefetched sub pieces left behind by a previous run
+func (f *pieceFetcher) removeLeftovers() {
+	leftovers, err := filepath.Glob(filepath.Join(f.tmpDir, fetchFilePrefix+"*"))
+	if err != nil {
+		return
+	}
+	for _, path := range leftovers {
+		if err := os.Remove(path); err != nil {
+			log.Printf("failed to remove prefetched piece %s: %s", path, err)
+		}
+	}
+}
+
+// Return a reader of the sub piece from offset on. The fetch starts on the first Read.
+func (f *pieceFetcher) open(ctx context.Context, src pieceSource, offset uint64) *pieceReader {
+	return &pieceReader{f: f, ctx: ctx, src: src, offset: offset}
+}
+
+// Reads a sub piece from its buffer location. When a response fails or stalls the
+// piece is requested again from where it stopped with a Range header.
+type pieceReader struct {
+	f        *pieceFetcher
+	ctx      context.Context
+	src      pieceSource
+	offset   uint64 // bytes of the piece read so far
+	failures int    // failed attempts since data was last received
+	eof      bool
+	body     io.ReadCloser
+	stall    *time.Timer // cancels the request when no data arrives in time
+	cancel   context.CancelFunc
+}
+
+func (r *pieceReader) Read(p []byte) (int, error) {
+	for {
+		if r.eof {
+			return 0, io.EOF
+		}
+		if r.body == nil {
+			err := r.request()
+			if errors.Is(err, errPieceEnd) {
+				r.eof = true
+				continue
+			}
+			if err != nil {
+				if retryErr := r.retry(err); retryErr != nil {
+					return 0, retryErr
+				}
+				continue
+			}
+		}
+
+		n, err := r.body.Read(p)
+		if n > 0 {
+			r.stall.Reset(r.f.timeout)
+			r.failures = 0
+			r.offset += uint64(n)
+			if r.offset > r.src.limit {
+				r.Close()
+				return 0, fmt.Errorf("piece at %s exceeds its %d bytes", r.src.url, r.src.limit)
+			}
+			return n, nil
+		}
+		if errors.Is(err, io.EOF) {
+			r.Close()
+			r.eof = true
+			continue
+		}
+		if err != nil {
+			r.Close()
+			if retryErr := r.retry(err); retryErr != nil {
+				return 0, retryErr
+			}
+		}
+	}
+}
+
+func (r *pieceReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	r.stall.Stop()
+	r.cancel()
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// returned by request when the piece has no data after the offset
+var errPieceEnd = errors.New("end of piece")
+
+// a response that will not change when retried
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+func (r *pieceReader) request() error {
+	ctx, cancel := context.WithCancel(r.ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.src.url, nil)
+	if err != nil {
+		cancel()
+		return permanentError{fmt.Errorf("invalid location %q: %w", r.src.url, err)}
+	}
+	if r.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+	}
+	stall := time.AfterFunc(r.f.timeout, cancel)
+	resp, err := r.f.client.Do(req)
+	if err != nil {
+		stall.Stop()
+		cancel()
+		return fmt.Errorf("failed to fetch %s: %w", r.src.url, err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK:
+		// The buffer ignored the range, skip what was read already
+		if _, err := io.CopyN(io.Discard, resp.Body, int64(r.offset)); err != nil {
+			resp.Body.Close()
+			stall.Stop()
+			cancel()
+			if errors.Is(err, io.EOF) {
+				return errPieceEnd
+			}
+			return fmt.Errorf("failed to skip to offset %d of %s: %w", r.offset, r.src.url, err)
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		stall.Stop()
+		cancel()
+		return errPieceEnd
+	default:
+		resp.Body.Close()
+		stall.Stop()
+		cancel()
+		err := fmt.Errorf("failed to fetch %s: %s", r.src.url, resp.Status)
+		if resp.StatusCode < http.StatusInternalServerError && resp.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+	r.body, r.stall, r.cancel = resp.Body, stall, cancel
+	return nil
+}
+
+// Wait before the next attempt after err, or return the error to give up
+func (r *pieceReader) retry(err error) error {
+	var permanent permanentError
+	if r.ctx.Err() != nil || errors.As(err, &permanent) || r.failures >= r.f.retries {
+		return err
+	}
+	delay := fetchRetryDelay << r.failures
+	r.failures++
+	log.Printf("Fetching %s failed at offset %d, retrying in %s: %s", r.src.url, r.offset, delay, err)
+	select {
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// Sub pieces fetched in the background for reading in order
+type prefetchedPieces struct {
+	pieces []*prefetchedPiece
+	cancel context.CancelFunc
+}
+
+// Fetch the sub pieces in the background. At most parallelism pieces are fetched or
+// waiting to be read at a time, each kept in a temporary file until it was read.
+// The pieces must be closed to cancel outstanding fetches.
+func (f *pieceFetcher) prefetch(ctx context.Context, srcs []pieceSource) *prefetchedPieces {
+	ctx, cancel := context.WithCancel(ctx)
+	slots := make(chan struct{}, f.parallelism)
+	pieces := make([]*prefetchedPiece, len(srcs))
+	for i := range pieces {
+		pieces[i] = &prefetchedPiece{done: make(chan struct{})}
+	}
+	go func() {
+		for i, src := range srcs {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				for _, piece := range pieces[i:] {
+					piece.err = ctx.Err()
+					close(piece.done)
+				}
+				return
+			}
+			piece := pieces[i]
+			piece.release = func() { <-slots }
+			go func() {
+				piece.file, piece.size, piece.err = f.download(ctx, src)
+				close(piece.done)
+			}()
+		}
+	}()
+	return &prefetchedPieces{pieces: pieces, cancel: cancel}
+}
+
+// Return readers of the pieces in order, blocking until their piece is fetched
+func (p *prefetchedPieces) readers() []io.Reader {
+	readers := make([]io.Reader, len(p.pieces))
+	for i, piece := range p.pieces {
+		readers[i] = piece
+	}
+	return readers
+}
+
+// Cancel outstanding fetches and remove the pieces not read yet
+func (p *prefetchedPieces) Close() {
+	p.cancel()
+	for _, piece := range p.pieces {
+		<-piece.done
+		piece.remove()
+	}
+}
+
+// Fetch the sub piece into a temporary file, returning the file and its size
+func (f *pieceFetcher) download(ctx context.Context, src pieceSource) (*os.File, int64, error) {
+	file, err := os.CreateTemp(f.tmpDir, fetchFilePrefix+"*")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create file for piece at %s: %w", src.url, err)
+	}
+	r := f.open(ctx, src, 0)
+	defer r.Close()
+	n, err := io.Copy(file, r)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, fmt.Errorf("failed to rewind piece at %s: %w", src.url, err)
+	}
+	return file, n, nil
+}
+
+// A sub piece fetched in the background
+type prefetchedPiece struct {
+	done    chan struct{} // closed once the fetch finished
+	file    *os.File
+	size    int64 // bytes fetched into the file
+	read    int64 // bytes of the file read so far
+	err     error
+	release func() // frees the fetch slot, nil if the fetch never started
+	once    sync.Once
+}
+
+func (p *prefetchedPiece) Read(b []byte) (int, error) {
+	<-p.done
+	if p.err != nil {
+		return 0, p.err
+	}
+	if p.file == nil {
+		return 0, io.EOF
+	}
+	n, err := p.file.Read(b)
+	p.read += int64(n)
+	// Readers of pieces filling their whole segment stop at its size without reading EOF,
+	// free the slot once all data was returned so later pieces are still fetched
+	if p.read >= p.size || errors.Is(err, io.EOF) {
+		p.remove()
+	}
+	return n, err
+}
+
+// Remove the fetched piece and free its slot for the next fetch
+func (p *prefetchedPiece) remove() {
+	p.once.Do(func() {
+		if p.file != nil {
+			p.file.Close()
+			os.Remove(p.file.Name())
+			p.file = nil
+		}
+		if p.release != nil {
+			p.release()
+		}
+	})
+}
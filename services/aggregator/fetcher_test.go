@@ -0,0 +1,150 @@
+package aggregator
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPieceReaderResume(t *testing.T) {
+	delay := fetchRetryDelay
+	fetchRetryDelay = time.Millisecond
+	defer func() { fetchRetryDelay = delay }()
+
+	data := bytes.Repeat([]byte("xchain"), 2000)
+	var lk sync.Mutex
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lk.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		first := len(ranges) == 1
+		lk.Unlock()
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/stalled":
+			if first {
+				time.Sleep(200 * time.Millisecond)
+			}
+			w.Write(data)
+		default:
+			if first {
+				// Promise all data but break off after half of it
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				w.Write(data[:len(data)/2])
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		}
+	}))
+	defer srv.Close()
+	f := newPieceFetcher(config.PieceFetchConfig{Timeout: 1}, t.TempDir())
+	f.timeout = 50 * time.Millisecond
+	read := func(path string, limit uint64) ([]byte, error) {
+		lk.Lock()
+		ranges = nil
+		lk.Unlock()
+		return io.ReadAll(f.open(context.Background(), pieceSource{url: srv.URL + path, limit: limit}, 0))
+	}
+
+	got, err := read("/data", 16256)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got))
+	assert.Equal(t, []string{"", "bytes=6000-"}, ranges)
+
+	// Stalled responses are retried
+	got, err = read("/stalled", 16256)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got))
+
+	// Pieces larger than their limit fail
+	_, err = read("/data", 8128)
+	assert.ErrorContains(t, err, "exceeds")
+
+	// Missing pieces are not retried
+	_, err = read("/missing", 16256)
+	assert.Error(t, err)
+	assert.Len(t, ranges, 1)
+}
+
+func TestPrefetch(t *testing.T) {
+	var lk sync.Mutex
+	active, maxActive := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lk.Lock()
+		active++
+		maxActive = max(maxActive, active)
+		lk.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		w.Write(bytes.Repeat([]byte(r.URL.Query().Get("id")), 100))
+		lk.Lock()
+		active--
+		lk.Unlock()
+	}))
+	defer srv.Close()
+	tmpDir := t.TempDir()
+	f := newPieceFetcher(config.PieceFetchConfig{Parallelism: 2}, tmpDir)
+
+	var srcs []pieceSource
+	for i := 0; i < 6; i++ {
+		srcs = append(srcs, pieceSource{url: srv.URL + "/?id=" + strconv.Itoa(i), limit: 127})
+	}
+	pieces := f.prefetch(context.Background(), srcs)
+	for i, r := range pieces.readers() {
+		got, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, bytes.Repeat([]byte(strconv.Itoa(i)), 100), got)
+	}
+	pieces.Close()
+	assert.LessOrEqual(t, maxActive, 2)
+
+	// Fetched pieces are removed once read or closed
+	pieces = f.prefetch(context.Background(), srcs)
+	io.ReadAll(pieces.readers()[0])
+	pieces.Close()
+	files, err := os.ReadDir(tmpDir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	// Pieces of exactly their unpadded size are read without reaching EOF
+	f = newPieceFetcher(config.PieceFetchConfig{Parallelism: 1}, tmpDir)
+	data := make([][]byte, 3)
+	for i := range data {
+		data[i] = bytes.Repeat([]byte(strconv.Itoa(i)), 127)
+	}
+	exact := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i, _ := strconv.Atoi(r.URL.Query().Get("id"))
+		w.Write(data[i])
+	}))
+	defer exact.Close()
+	srcs = nil
+	for i := range data {
+		srcs = append(srcs, pieceSource{url: exact.URL + "/?id=" + strconv.Itoa(i), limit: 127})
+	}
+	pieces = f.prefetch(context.Background(), srcs)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i, r := range pieces.readers() {
+			got, err := io.ReadAll(io.LimitReader(r, 127))
+			assert.NoError(t, err)
+			assert.Equal(t, data[i], got)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reading pieces of exactly their unpadded size deadlocked")
+	}
+	pieces.Close()
+}
@@ -0,0 +1,298 @@
+package aggregator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	verifregtypes "github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli/v2"
+)
+
+// default directory raw piece files of offline deals are exported to
+const defaultPiecePath = "~/.xchain/pieces"
+
+// Manifest written next to an exported piece file, telling providers which deals
+// to import it for with `boostd import-data <dealUUID> <pieceFile>`, or which
+// allocations with `boostd import-direct`
+type offlineManifest struct {
+	PieceCID      string        `json:"pieceCID"`
+	PieceSize     uint64        `json:"pieceSize"`     // padded size of the aggregate piece
+	PieceFile     string        `json:"pieceFile"`     // name of the raw piece file in the export directory, not a CAR
+	PieceFileSize uint64        `json:"pieceFileSize"` // unpadded size of the piece
+	Deals         []offlineDeal `json:"deals"`
+}
+
+// An offline deal of an exported aggregate
+type offlineDeal struct {
+	DealUUID   uuid.UUID         `json:"dealUUID"`
+	Provider   address.Address   `json:"provider"`
+	StartEpoch filabi.ChainEpoch `json:"startEpoch"` // the deal must be imported and sealed before
+	Imported   bool              `json:"imported"`
+	// Verified registry allocation and its client for `boostd import-direct` of directly onboarded deals
+	AllocationID verifregtypes.AllocationId `json:"allocationID,omitempty"`
+	Client       string                     `json:"client,omitempty"`
+}
+
+// Return the expanded export directory of the configuration
+func offlineExportPath(cfg *config.Config) (string, error) {
+	exportPath := cfg.OfflineDeals.PiecePath
+	if exportPath == "" {
+		exportPath = defaultPiecePath
+	}
+	exportPath, err := homedir.Expand(exportPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute export path: %w", err)
+	}
+	return exportPath, nil
+}
+
+// Return true if deals for aggregates of the padded deal size are made offline
+func (a *aggregator) isOffline(dealSize uint64) bool {
+	return a.offlineDeals && dealSize >= a.offlineMinSize
+}
+
+// Return where the aggregate with the given commp is exported
+func (a *aggregator) exportedAggregatePath(aggCommp cid.Cid) string {
+	return filepath.Join(a.exportPath, aggCommp.String())
+}
+
+// Return where the manifest of the aggregate with the given commp is written
+func (a *aggregator) manifestPath(aggCommp cid.Cid) string {
+	return a.exportedAggregatePath(aggCommp) + ".json"
+}
+
+// Export the aggregate as a raw piece file for providers to import, linking the staged
+// aggregate if possible and copying or rebuilding it otherwise. Exported aggregates are kept.
+func (a *aggregator) exportAggregate(rec aggregateRecord) error {
+	size := uint64(filabi.PaddedPieceSize(rec.DealSize).Unpadded())
+	location := a.exportedAggregatePath(rec.AggCommP)
+	if info, err := os.Stat(location); err == nil && uint64(info.Size()) == size {
+		return nil
+	}
+	if err := os.MkdirAll(a.exportPath, 0755); err != nil {
+		return fmt.Errorf("failed to create export directory: %w", err)
+	}
+
+	tmp := location + ".tmp"
+	defer os.Remove(tmp)
+	staged := a.openStaged(rec.AggCommP, size)
+	if staged != nil {
+		defer staged.Close()
+		if err := os.Link(staged.Name(), location); err == nil {
+			return nil
+		}
+	}
+	if free, err := freeSpace(a.exportPath); err == nil && free < size {
+		return fmt.Errorf("%d bytes free in %s, %d needed to export the aggregate", free, a.exportPath, size)
+	}
+	if staged != nil {
+		file, err := os.Create(tmp)
+		if err != nil {
+			return fmt.Errorf("failed to create file: %w", err)
+		}
+		_, err = io.Copy(file, staged)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to copy staged aggregate: %w", err)
+		}
+	} else if err := a.saveAggregateToFile(rec.TransferID, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, location)
+}
+
+func (a *aggregator) readManifest(aggCommp cid.Cid) (*offlineManifest, error) {
+	bs, err := os.ReadFile(a.manifestPath(aggCommp))
+	if err != nil {
+		return nil, err
+	}
+	var manifest offlineManifest
+	if err := json.Unmarshal(bs, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+func (a *aggregator) writeManifest(aggCommp cid.Cid, manifest *offlineManifest) error {
+	bs, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	tmp := a.manifestPath(aggCommp) + ".tmp"
+	if err := os.WriteFile(tmp, bs, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return os.Rename(tmp, a.manifestPath(aggCommp))
+}
+
+// Add an accepted offline deal to the manifest of the exported aggregate
+func (a *aggregator) addOfflineDeal(rec aggregateRecord, deal dealRecord) error {
+	manifest, err := a.readManifest(rec.AggCommP)
+	if errors.Is(err, fs.ErrNotExist) {
+		manifest = &offlineManifest{
+			PieceCID:      rec.AggCommP.String(),
+			PieceSize:     rec.DealSize,
+			PieceFile:     filepath.Base(a.exportedAggregatePath(rec.AggCommP)),
+			PieceFileSize: uint64(filabi.PaddedPieceSize(rec.DealSize).Unpadded()),
+		}
+	} else if err != nil {
+		return err
+	}
+	entry := offlineDeal{DealUUID: deal.DealUUID, Provider: deal.Provider, StartEpoch: deal.StartEpoch, AllocationID: deal.AllocationID}
+	if deal.AllocationID != 0 {
+		client, err := a.dealClient()
+		if err != nil {
+			return err
+		}
+		entry.Client = client.String()
+	}
+	manifest.Deals = append(manifest.Deals, entry)
+	return a.writeManifest(rec.AggCommP, manifest)
+}
+
+// Record that the provider imported the data of an offline deal. The exported
+// aggregate is removed once every deal in its manifest was imported.
+func (a *aggregator) markImported(dealUUID uuid.UUID) error {
+	a.replicateLk.Lock()
+	defer a.replicateLk.Unlock()
+
+	aggs, err := a.store.aggregates()
+	if err != nil {
+		return err
+	}
+	var rec *aggregateRecord
+	for i := range aggs {
+		for _, deal := range aggs[i].Deals {
+			if deal.DealUUID == dealUUID {
+				if !deal.Offline {
+					return fmt.Errorf("deal %s is not an offline deal", dealUUID)
+				}
+				rec = &aggs[i]
+			}
+		}
+	}
+	if rec == nil {
+		return fmt.Errorf("no deal found with UUID %s", dealUUID)
+	}
+	err = a.store.updateAggregate(rec.TransferID, func(r *aggregateRecord) {
+		for i := range r.Deals {
+			if r.Deals[i].DealUUID == dealUUID {
+				r.Deals[i].Imported = true
+			}
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to persist import of deal %s: %w", dealUUID, err)
+	}
+	log.Printf("Deal %s for aggregate %s was imported", dealUUID, rec.AggCommP)
+
+	manifest, err := a.readManifest(rec.AggCommP)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest of aggregate %s: %w", rec.AggCommP, err)
+	}
+	imported := true
+	for i := range manifest.Deals {
+		if manifest.Deals[i].DealUUID == dealUUID {
+			manifest.Deals[i].Imported = true
+		}
+		imported = imported && manifest.Deals[i].Imported
+	}
+	if err := a.writeManifest(rec.AggCommP, manifest); err != nil {
+		return err
+	}
+	if imported {
+		log.Printf("Every offline deal for aggregate %s was imported, removing its export", rec.AggCommP)
+		if err := os.Remove(a.exportedAggregatePath(rec.AggCommP)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove exported aggregate: %w", err)
+		}
+	}
+	return nil
+}
+
+// Mark the offline deal in the `deal` query parameter as imported
+func (a *aggregator) importedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dealUUID, err := uuid.Parse(r.URL.Query().Get("deal"))
+	if err != nil {
+		http.Error(w, "Invalid deal UUID", http.StatusBadRequest)
+		return
+	}
+	if err := a.markImported(dealUUID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Mark an offline deal as imported by its provider, in the state store or through
+// the running aggregation daemon which holds the store open
+func MarkImportedAction(cctx *cli.Context) error {
+	if cctx.Args().Len() != 1 {
+		return fmt.Errorf("Usage: <dealUUID>")
+	}
+	dealUUID, err := uuid.Parse(cctx.Args().Get(0))
+	if err != nil {
+		return fmt.Errorf("invalid deal UUID: %w", err)
+	}
+	cfg, err := config.LoadConfig(cctx.String("config"))
+	if err != nil {
+		return err
+	}
+	srcCfg, err := config.GetSourceConfig(cfg, cctx.String("chain"))
+	if err != nil {
+		return err
+	}
+	exportPath, err := offlineExportPath(cfg)
+	if err != nil {
+		return err
+	}
+
+	store, err := openStateStore(stateStorePath(cfg, srcCfg.ChainID))
+	if err != nil {
+		return postImported(cfg, srcCfg.ChainID, dealUUID)
+	}
+	defer store.Close()
+	if err := (&aggregator{store: store, exportPath: exportPath}).markImported(dealUUID); err != nil {
+		return err
+	}
+	fmt.Printf("Deal %s is marked imported\n", dealUUID)
+	return nil
+}
+
+func postImported(cfg *config.Config, chainID int, dealUUID uuid.UUID) error {
+	host := cfg.TransferIP
+	if host == "" || host == "0.0.0.0" {
+		host = "127.0.0.1"
+	}
+	url := fmt.Sprintf("http://%s:%d/imported?deal=%s&chain=%d", host, cfg.TransferPort, dealUUID, chainID)
+	resp, err := http.Post(url, "", nil)
+	if err != nil {
+		return fmt.Errorf("state store is not available and the aggregation daemon cannot be reached: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to mark deal imported with aggregation daemon: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	fmt.Printf("Deal %s is marked imported\n", dealUUID)
+	return nil
+}
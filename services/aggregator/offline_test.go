@@ -0,0 +1,83 @@
+package aggregator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineExport(t *testing.T) {
+	store, err := openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	a := &aggregator{
+		store:          store,
+		stagingPath:    t.TempDir(),
+		stagedVerified: make(map[cid.Cid]time.Time),
+		exportPath:     t.TempDir(),
+		offlineDeals:   true,
+		offlineMinSize: 2048,
+	}
+	assert.False(t, a.isOffline(1024))
+	assert.True(t, a.isOffline(2048))
+
+	p1, _ := address.NewIDAddress(1000)
+	p2, _ := address.NewIDAddress(1001)
+	deals := []dealRecord{
+		{Provider: p1, DealUUID: uuid.New(), Accepted: true, Offline: true},
+		{Provider: p2, DealUUID: uuid.New(), Accepted: true, Offline: true},
+	}
+	rec := aggregateRecord{TransferID: 1, AggCommP: testAggCommp(t, 1), DealSize: 2048, Deals: deals}
+	assert.NoError(t, store.saveAggregate(rec, nil, nil))
+
+	// The staged aggregate is exported, its commp was verified when it was staged
+	staged := a.stagedAggregatePath(rec.AggCommP)
+	assert.NoError(t, os.WriteFile(staged, make([]byte, 2032), 0644))
+	info, _ := os.Stat(staged)
+	a.markStagedVerified(rec.AggCommP, info.ModTime())
+	assert.NoError(t, a.exportAggregate(rec))
+	assert.FileExists(t, a.exportedAggregatePath(rec.AggCommP))
+	// Exports survive the removal of the staged aggregate
+	assert.NoError(t, os.Remove(staged))
+	assert.NoError(t, a.exportAggregate(rec))
+
+	for _, deal := range deals {
+		assert.NoError(t, a.addOfflineDeal(rec, deal))
+	}
+	manifest, err := a.readManifest(rec.AggCommP)
+	assert.NoError(t, err)
+	assert.Equal(t, rec.AggCommP.String(), manifest.PieceCID)
+	assert.EqualValues(t, 2048, manifest.PieceSize)
+	assert.EqualValues(t, 2032, manifest.PieceFileSize)
+	if assert.Len(t, manifest.Deals, 2) {
+		assert.Equal(t, deals[0].DealUUID, manifest.Deals[0].DealUUID)
+		assert.Equal(t, p2, manifest.Deals[1].Provider)
+	}
+
+	assert.Error(t, a.markImported(uuid.New()))
+	assert.NoError(t, a.markImported(deals[0].DealUUID))
+	saved, _, _ := store.getAggregate(rec.TransferID)
+	assert.True(t, saved.Deals[0].Imported)
+	assert.False(t, saved.Deals[1].Imported)
+	assert.FileExists(t, a.exportedAggregatePath(rec.AggCommP))
+
+	// The export is removed once every deal was imported
+	w := httptest.NewRecorder()
+	a.importedHandler(w, httptest.NewRequest(http.MethodPost, "/imported?deal="+deals[1].DealUUID.String(), nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.NoFileExists(t, a.exportedAggregatePath(rec.AggCommP))
+	manifest, err = a.readManifest(rec.AggCommP)
+	assert.NoError(t, err)
+	for _, deal := range manifest.Deals {
+		assert.True(t, deal.Imported)
+	}
+}
@@ -0,0 +1,121 @@
+package aggregator
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/filecoin-project/go-data-segment/datasegment"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+)
+
+const (
+	// Place offers in arrival order, skipping those that no longer fit
+	PackingFirstFit = "first-fit"
+	// Place the largest offers first so that alignment padding is minimal
+	PackingBestFitDecreasing = "best-fit-decreasing"
+	// Select offers paying the most per padded byte first
+	PackingPaymentPriority = "payment-priority"
+)
+
+// PackingStrategy decides which pending offers are sealed into the next aggregate
+// and in which order they are placed in it
+type PackingStrategy interface {
+	// Pack returns the offers placed into an aggregate of dealSize, in placement order,
+	// and the offers left pending, in their original order
+	Pack(pending []DataReadyEvent, dealSize filabi.PaddedPieceSize) (packed, rest []DataReadyEvent)
+}
+
+// Return the packing strategy configured by name, first-fit if empty
+func NewPackingStrategy(name string) (PackingStrategy, error) {
+	switch name {
+	case "", PackingFirstFit:
+		return firstFit{}, nil
+	case PackingBestFitDecreasing:
+		return bestFitDecreasing{}, nil
+	case PackingPaymentPriority:
+		return paymentPriority{}, nil
+	default:
+		return nil, fmt.Errorf("unknown packing strategy %q", name)
+	}
+}
+
+type firstFit struct{}
+
+func (firstFit) Pack(pending []DataReadyEvent, dealSize filabi.PaddedPieceSize) ([]DataReadyEvent, []DataReadyEvent) {
+	return packInOrder(pending, pending, dealSize)
+}
+
+type bestFitDecreasing struct{}
+
+func (bestFitDecreasing) Pack(pending []DataReadyEvent, dealSize filabi.PaddedPieceSize) ([]DataReadyEvent, []DataReadyEvent) {
+	return packInOrder(pending, bySizeDecreasing(pending), dealSize)
+}
+
+type paymentPriority struct{}
+
+func (paymentPriority) Pack(pending []DataReadyEvent, dealSize filabi.PaddedPieceSize) ([]DataReadyEvent, []DataReadyEvent) {
+	order := append([]DataReadyEvent(nil), pending...)
+	sort.SliceStable(order, func(i, j int) bool {
+		return pricePerByte(order[i].Offer).Cmp(pricePerByte(order[j].Offer)) > 0
+	})
+	packed, rest := packInOrder(pending, order, dealSize)
+	// Selection is by payment but placement is by size which only shrinks the layout
+	return bySizeDecreasing(packed), rest
+}
+
+// Greedily place offers in the given order, keeping each one only if the
+// aggregate remains valid. Offers that are not placed are returned in pending order.
+func packInOrder(pending, order []DataReadyEvent, dealSize filabi.PaddedPieceSize) ([]DataReadyEvent, []DataReadyEvent) {
+	var packed []DataReadyEvent
+	placed := make(map[offerRef]struct{})
+	for _, event := range order {
+		if fitsAggregate(append(packed, event), dealSize) {
+			packed = append(packed, event)
+			placed[event.ref()] = struct{}{}
+		}
+	}
+	var rest []DataReadyEvent
+	for _, event := range pending {
+		if _, ok := placed[event.ref()]; !ok {
+			rest = append(rest, event)
+		}
+	}
+	return packed, rest
+}
+
+// Report whether the offers placed in order make a valid aggregate of dealSize.
+// These are the same checks datasegment.NewAggregate does without building the tree.
+func fitsAggregate(events []DataReadyEvent, dealSize filabi.PaddedPieceSize) bool {
+	if dealSize.Validate() != nil {
+		return false
+	}
+	pieces, err := offerPieces(events)
+	if err != nil {
+		return false
+	}
+	maxEntries := datasegment.MaxIndexEntriesInDeal(dealSize)
+	if uint(len(pieces)) > maxEntries {
+		return false
+	}
+	_, size, err := datasegment.ComputeDealPlacement(pieces)
+	if err != nil {
+		return false
+	}
+	return size+uint64(maxEntries)*datasegment.EntrySize <= uint64(dealSize)
+}
+
+func bySizeDecreasing(events []DataReadyEvent) []DataReadyEvent {
+	sorted := append([]DataReadyEvent(nil), events...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Offer.Size > sorted[j].Offer.Size
+	})
+	return sorted
+}
+
+func pricePerByte(o Offer) *big.Rat {
+	if o.Amount == nil || o.Size == 0 {
+		return new(big.Rat)
+	}
+	return new(big.Rat).SetFrac(o.Amount, new(big.Int).SetUint64(o.Size))
+}
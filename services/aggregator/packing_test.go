@@ -0,0 +1,73 @@
+package aggregator
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/filecoin-project/go-data-segment/datasegment"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/assert"
+)
+
+func pieceEvent(t *testing.T, id uint64, size uint64, amount int64) DataReadyEvent {
+	commP := make([]byte, 32)
+	commP[0] = byte(id)
+	c, err := commcid.DataCommitmentV1ToCID(commP)
+	if err != nil {
+		t.Fatalf("failed to make commp cid: %v", err)
+	}
+	return DataReadyEvent{
+		OfferID: id,
+		Offer: Offer{
+			CommP:  c.Bytes(),
+			Size:   size,
+			Amount: big.NewInt(amount),
+		},
+	}
+}
+
+func offerIDs(events []DataReadyEvent) []uint64 {
+	ids := make([]uint64, len(events))
+	for i, event := range events {
+		ids[i] = event.OfferID
+	}
+	return ids
+}
+
+// Test that each strategy only returns placements accepted by datasegment.NewAggregate
+func TestPackingStrategies(t *testing.T) {
+	const dealSize = filabi.PaddedPieceSize(1 << 20)
+	pending := []DataReadyEvent{
+		pieceEvent(t, 1, 128<<10, 10),
+		pieceEvent(t, 2, 512<<10, 10),
+		pieceEvent(t, 3, 256<<10, 1000),
+		pieceEvent(t, 4, 256<<10, 10),
+	}
+
+	// Arrival order aligns offer 2 past the index area so it is skipped
+	packed, rest := firstFit{}.Pack(pending, dealSize)
+	assert.Equal(t, []uint64{1, 3, 4}, offerIDs(packed))
+	assert.Equal(t, []uint64{2}, offerIDs(rest))
+
+	// Largest first fills 896KiB instead of 640KiB
+	packed, rest = bestFitDecreasing{}.Pack(pending, dealSize)
+	assert.Equal(t, []uint64{2, 3, 1}, offerIDs(packed))
+	assert.Equal(t, []uint64{4}, offerIDs(rest))
+
+	// Best paying offers are selected first and then placed largest first
+	packed, rest = paymentPriority{}.Pack(pending, dealSize)
+	assert.Equal(t, []uint64{3, 4, 1}, offerIDs(packed))
+	assert.Equal(t, []uint64{2}, offerIDs(rest))
+
+	for _, strategy := range []PackingStrategy{firstFit{}, bestFitDecreasing{}, paymentPriority{}} {
+		packed, _ := strategy.Pack(pending, dealSize)
+		pieces, err := offerPieces(packed)
+		assert.NoError(t, err)
+		_, err = datasegment.NewAggregate(dealSize, pieces)
+		assert.NoError(t, err)
+	}
+
+	_, err := NewPackingStrategy("worst-fit")
+	assert.Error(t, err)
+}
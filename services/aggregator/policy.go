@@ -0,0 +1,106 @@
+package aggregator
+
+import (
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// admissionPolicy decides which offers are accepted for aggregation.
+// Empty rules allow everything.
+type admissionPolicy struct {
+	allowedTokens    map[common.Address]struct{}
+	minPricePerByte  map[common.Address]*big.Rat
+	maxPieceSize     uint64
+	allowedSchemes   map[string]struct{}
+	allowedHosts     map[string]struct{}
+	deniedSubmitters map[common.Address]struct{}
+}
+
+func newAdmissionPolicy(cfg config.AdmissionPolicyConfig) (*admissionPolicy, error) {
+	allowedTokens, err := addressSet("AllowedTokens", cfg.AllowedTokens)
+	if err != nil {
+		return nil, err
+	}
+	deniedSubmitters, err := addressSet("DeniedSubmitters", cfg.DeniedSubmitters)
+	if err != nil {
+		return nil, err
+	}
+	p := &admissionPolicy{
+		allowedTokens:    allowedTokens,
+		minPricePerByte:  make(map[common.Address]*big.Rat),
+		maxPieceSize:     cfg.MaxPieceSize,
+		allowedSchemes:   make(map[string]struct{}),
+		allowedHosts:     make(map[string]struct{}),
+		deniedSubmitters: deniedSubmitters,
+	}
+	for token, priceStr := range cfg.MinPricePerByte {
+		if !common.IsHexAddress(token) {
+			return nil, fmt.Errorf("invalid token address %q in MinPricePerByte", token)
+		}
+		price, ok := new(big.Rat).SetString(priceStr)
+		if !ok {
+			return nil, fmt.Errorf("invalid minimum price %q for token %s", priceStr, token)
+		}
+		p.minPricePerByte[common.HexToAddress(token)] = price
+	}
+	for _, scheme := range cfg.AllowedSchemes {
+		p.allowedSchemes[strings.ToLower(scheme)] = struct{}{}
+	}
+	for _, host := range cfg.AllowedHosts {
+		p.allowedHosts[strings.ToLower(host)] = struct{}{}
+	}
+	return p, nil
+}
+
+func addressSet(name string, addrs []string) (map[common.Address]struct{}, error) {
+	set := make(map[common.Address]struct{}, len(addrs))
+	for _, addr := range addrs {
+		if !common.IsHexAddress(addr) {
+			return nil, fmt.Errorf("invalid address %q in %s", addr, name)
+		}
+		set[common.HexToAddress(addr)] = struct{}{}
+	}
+	return set, nil
+}
+
+// Report whether evaluating the policy requires the address that submitted the offer
+func (p *admissionPolicy) needsSubmitter() bool {
+	return len(p.deniedSubmitters) > 0
+}
+
+// Return the reason the offer is rejected, or an empty string if it is admitted
+func (p *admissionPolicy) evaluate(event DataReadyEvent) string {
+	offer := event.Offer
+	if len(p.allowedTokens) > 0 {
+		if _, ok := p.allowedTokens[offer.Token]; !ok {
+			return fmt.Sprintf("payment token %s is not allowed", offer.Token.Hex())
+		}
+	}
+	if minPrice, ok := p.minPricePerByte[offer.Token]; ok && pricePerByte(offer).Cmp(minPrice) < 0 {
+		return fmt.Sprintf("payment %s for %d bytes is below the minimum price of %s per byte", offer.Amount, offer.Size, minPrice.FloatString(18))
+	}
+	if p.maxPieceSize > 0 && offer.Size > p.maxPieceSize {
+		return fmt.Sprintf("piece size %d exceeds the maximum of %d", offer.Size, p.maxPieceSize)
+	}
+	if len(p.allowedSchemes) > 0 || len(p.allowedHosts) > 0 {
+		u, err := url.Parse(offer.Location)
+		if err != nil {
+			return fmt.Sprintf("location %q is not a valid URL", offer.Location)
+		}
+		if _, ok := p.allowedSchemes[strings.ToLower(u.Scheme)]; len(p.allowedSchemes) > 0 && !ok {
+			return fmt.Sprintf("location scheme %q is not allowed", u.Scheme)
+		}
+		if _, ok := p.allowedHosts[strings.ToLower(u.Hostname())]; len(p.allowedHosts) > 0 && !ok {
+			return fmt.Sprintf("location host %q is not allowed", u.Hostname())
+		}
+	}
+	if _, ok := p.deniedSubmitters[event.Submitter]; ok {
+		return fmt.Sprintf("submitter %s is denied", event.Submitter.Hex())
+	}
+	return ""
+}
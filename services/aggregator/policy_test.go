@@ -0,0 +1,61 @@
+package aggregator
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmissionPolicy(t *testing.T) {
+	token := common.HexToAddress("0x6b175474e89094c44da98b954eedeac495271d0f")
+	denied := common.HexToAddress("0x5c31e78f3f7329769734f5ff1ac7e22c243e817e")
+	policy, err := newAdmissionPolicy(config.AdmissionPolicyConfig{
+		AllowedTokens:    []string{token.Hex()},
+		MinPricePerByte:  map[string]string{token.Hex(): "0.5"},
+		MaxPieceSize:     1024,
+		AllowedSchemes:   []string{"https"},
+		AllowedHosts:     []string{"buffer.example.com"},
+		DeniedSubmitters: []string{denied.Hex()},
+	})
+	if err != nil {
+		t.Fatalf("failed to create policy: %v", err)
+	}
+	assert.True(t, policy.needsSubmitter())
+
+	admitted := DataReadyEvent{
+		OfferID: 1,
+		Offer: Offer{
+			Size:     512,
+			Location: "https://buffer.example.com/get?id=1",
+			Amount:   big.NewInt(256),
+			Token:    token,
+		},
+	}
+	assert.Empty(t, policy.evaluate(admitted))
+
+	tests := map[string]func(e *DataReadyEvent){
+		"token":     func(e *DataReadyEvent) { e.Offer.Token = common.Address{} },
+		"price":     func(e *DataReadyEvent) { e.Offer.Amount = big.NewInt(255) },
+		"size":      func(e *DataReadyEvent) { e.Offer.Size = 2048; e.Offer.Amount = big.NewInt(4096) },
+		"scheme":    func(e *DataReadyEvent) { e.Offer.Location = "http://buffer.example.com/get?id=1" },
+		"host":      func(e *DataReadyEvent) { e.Offer.Location = "https://other.example.com/get?id=1" },
+		"submitter": func(e *DataReadyEvent) { e.Submitter = denied },
+	}
+	for name, mutate := range tests {
+		event := admitted
+		mutate(&event)
+		assert.NotEmpty(t, policy.evaluate(event), name)
+	}
+
+	_, err = newAdmissionPolicy(config.AdmissionPolicyConfig{
+		MinPricePerByte: map[string]string{token.Hex(): "cheap"},
+	})
+	assert.Error(t, err)
+	_, err = newAdmissionPolicy(config.AdmissionPolicyConfig{AllowedTokens: []string{"USDFC"}})
+	assert.Error(t, err)
+	_, err = newAdmissionPolicy(config.AdmissionPolicyConfig{DeniedSubmitters: []string{"0x1234"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,198 @@
+package aggregator
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/filecoin-project/go-data-segment/datasegment"
+	"github.com/filecoin-project/go-data-segment/merkletree"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+)
+
+// OfferProof is the portable JSON form of the PODSI inclusion proof of an offer's
+// piece in the aggregate committed for it
+type OfferProof struct {
+	ChainID      int       `json:"chainID"` // source chain the offer was made on
+	OfferID      uint64    `json:"offerID"`
+	AggCommP     string    `json:"aggregateCommP"`
+	AggSize      uint64    `json:"aggregateSize"` // padded deal size of the aggregate
+	CommP        string    `json:"commP"`
+	Size         uint64    `json:"size"`   // padded size of the offer's piece
+	Offset       uint64    `json:"offset"` // padded byte offset of the piece in the aggregate
+	SubtreeProof ProofPath `json:"subtreeProof"`
+	IndexProof   ProofPath `json:"indexProof"`
+}
+
+// ProofPath is a merkle proof with hex encoded nodes
+type ProofPath struct {
+	Index uint64   `json:"index"`
+	Path  []string `json:"path"`
+}
+
+func newProofPath(p merkletree.ProofData) ProofPath {
+	path := make([]string, len(p.Path))
+	for i, node := range p.Path {
+		path[i] = hex.EncodeToString(node[:])
+	}
+	return ProofPath{Index: p.Index, Path: path}
+}
+
+func (p ProofPath) proofData() (merkletree.ProofData, error) {
+	nodes := make([]merkletree.Node, len(p.Path))
+	for i, s := range p.Path {
+		bs, err := hex.DecodeString(s)
+		if err != nil || len(bs) != len(nodes[i]) {
+			return merkletree.ProofData{}, fmt.Errorf("invalid proof node %d: %q", i, s)
+		}
+		copy(nodes[i][:], bs)
+	}
+	return merkletree.ProofData{Path: nodes, Index: p.Index}, nil
+}
+
+func newOfferProof(proof *proofRecord) OfferProof {
+	return OfferProof{
+		ChainID:      proof.ChainID,
+		OfferID:      proof.OfferID,
+		AggCommP:     proof.AggCommP.String(),
+		AggSize:      uint64(proof.DealSize),
+		CommP:        proof.Piece.PieceCID.String(),
+		Size:         uint64(proof.Piece.Size),
+		Offset:       proof.Offset,
+		SubtreeProof: newProofPath(proof.Proof.ProofSubtree),
+		IndexProof:   newProofPath(proof.Proof.ProofIndex),
+	}
+}
+
+// Verify checks that the offer's piece is included at its offset in the aggregate
+// and indexed in the aggregate's data segment index. No network access is needed.
+func (p OfferProof) Verify() error {
+	commP, err := cid.Decode(p.CommP)
+	if err != nil {
+		return fmt.Errorf("invalid commP: %w", err)
+	}
+	aggCommP, err := cid.Decode(p.AggCommP)
+	if err != nil {
+		return fmt.Errorf("invalid aggregate commP: %w", err)
+	}
+	subtree, err := p.SubtreeProof.proofData()
+	if err != nil {
+		return fmt.Errorf("invalid subtree proof: %w", err)
+	}
+	index, err := p.IndexProof.proofData()
+	if err != nil {
+		return fmt.Errorf("invalid index proof: %w", err)
+	}
+	if subtree.Index*p.Size != p.Offset {
+		return fmt.Errorf("subtree proof is for offset %d, not %d", subtree.Index*p.Size, p.Offset)
+	}
+
+	proof := datasegment.InclusionProof{ProofSubtree: subtree, ProofIndex: index}
+	aux, err := proof.ComputeExpectedAuxData(datasegment.InclusionVerifierData{
+		CommPc: commP,
+		SizePc: filabi.PaddedPieceSize(p.Size),
+	})
+	if err != nil {
+		return fmt.Errorf("invalid inclusion proof: %w", err)
+	}
+	if !aux.CommPa.Equals(aggCommP) {
+		return fmt.Errorf("proof is for aggregate %s, not %s", aux.CommPa, aggCommP)
+	}
+	if uint64(aux.SizePa) != p.AggSize {
+		return fmt.Errorf("proof is for an aggregate of %d bytes, not %d", aux.SizePa, p.AggSize)
+	}
+	return nil
+}
+
+// Load the inclusion proof of an offer from the state store, or from the running
+// aggregation daemon which holds the store open
+func loadOfferProof(cfg *config.Config, srcCfg *config.SourceChainConfig, offerID uint64) (*OfferProof, error) {
+	store, err := openStateStore(stateStorePath(cfg, srcCfg.ChainID))
+	if err != nil {
+		return fetchOfferProof(cfg, srcCfg.ChainID, offerID)
+	}
+	defer store.Close()
+	proof, err := (&aggregator{store: store}).inclusionProof(offerRef{ChainID: srcCfg.ChainID, OfferID: offerID})
+	if err != nil {
+		return nil, err
+	}
+	p := newOfferProof(proof)
+	return &p, nil
+}
+
+func fetchOfferProof(cfg *config.Config, chainID int, offerID uint64) (*OfferProof, error) {
+	host := cfg.TransferIP
+	if host == "" || host == "0.0.0.0" {
+		host = "127.0.0.1"
+	}
+	url := fmt.Sprintf("http://%s:%d/proof?offer=%d&chain=%d", host, cfg.TransferPort, offerID, chainID)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("state store is not available and the aggregation daemon cannot be reached: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to get proof from aggregation daemon: %s: %s", resp.Status, msg)
+	}
+	var proof proofRecord
+	if err := json.NewDecoder(resp.Body).Decode(&proof); err != nil {
+		return nil, fmt.Errorf("failed to decode proof: %w", err)
+	}
+	p := newOfferProof(&proof)
+	return &p, nil
+}
+
+// Print the inclusion proof of an aggregated offer as JSON
+func ProofExportAction(cctx *cli.Context) error {
+	if cctx.Args().Len() != 1 {
+		return fmt.Errorf("Usage: <offerID>")
+	}
+	offerID, err := strconv.ParseUint(cctx.Args().Get(0), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid offer ID: %w", err)
+	}
+	cfg, err := config.LoadConfig(cctx.String("config"))
+	if err != nil {
+		return err
+	}
+	srcCfg, err := config.GetSourceConfig(cfg, cctx.String("chain"))
+	if err != nil {
+		return err
+	}
+
+	proof, err := loadOfferProof(cfg, srcCfg, offerID)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(proof)
+}
+
+// Verify an inclusion proof JSON file produced by ProofExportAction
+func ProofVerifyAction(cctx *cli.Context) error {
+	if cctx.Args().Len() != 1 {
+		return fmt.Errorf("Usage: <proof.json>")
+	}
+	bs, err := os.ReadFile(cctx.Args().Get(0))
+	if err != nil {
+		return fmt.Errorf("failed to read proof: %w", err)
+	}
+	var proof OfferProof
+	if err := json.Unmarshal(bs, &proof); err != nil {
+		return fmt.Errorf("failed to decode proof: %w", err)
+	}
+	if err := proof.Verify(); err != nil {
+		return fmt.Errorf("proof of offer %d of chain %d is invalid: %w", proof.OfferID, proof.ChainID, err)
+	}
+	fmt.Printf("Offer %d of chain %d with commP %s is included at offset %d of aggregate %s\n", proof.OfferID, proof.ChainID, proof.CommP, proof.Offset, proof.AggCommP)
+	return nil
+}
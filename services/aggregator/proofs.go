@@ -0,0 +1,118 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/filecoin-project/go-data-segment/datasegment"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+)
+
+// Full PODSI inclusion proof of an offer's piece in the aggregate it was committed in
+type proofRecord struct {
+	ChainID    int                        `json:"chainID"` // source chain the offer was made on
+	OfferID    uint64                     `json:"offerID"`
+	TransferID int                        `json:"transferID"`
+	AggCommP   cid.Cid                    `json:"aggCommP"`
+	DealSize   filabi.PaddedPieceSize     `json:"dealSize"`
+	Piece      filabi.PieceInfo           `json:"piece"`
+	Offset     uint64                     `json:"offset"` // padded byte offset of the piece in the aggregate
+	Proof      datasegment.InclusionProof `json:"proof"`
+}
+
+// Compute the subtree and index proofs of every piece in the aggregate
+func computeProofs(agg *datasegment.Aggregate, rec aggregateRecord) ([]proofRecord, error) {
+	if len(rec.OfferIDs) != len(rec.Pieces) {
+		return nil, fmt.Errorf("aggregate %d has %d offers for %d pieces", rec.TransferID, len(rec.OfferIDs), len(rec.Pieces))
+	}
+	proofs := make([]proofRecord, len(rec.Pieces))
+	for i, piece := range rec.Pieces {
+		podsi, err := agg.ProofForPieceInfo(piece)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute inclusion proof of offer %d: %w", rec.OfferIDs[i], err)
+		}
+		proofs[i] = proofRecord{
+			ChainID:    rec.ChainID,
+			OfferID:    rec.OfferIDs[i],
+			TransferID: rec.TransferID,
+			AggCommP:   rec.AggCommP,
+			DealSize:   agg.DealSize,
+			Piece:      piece,
+			Offset:     podsi.ProofSubtree.Index * uint64(piece.Size),
+			Proof:      *podsi,
+		}
+	}
+	return proofs, nil
+}
+
+// Return the inclusion proof of an aggregated offer. Proofs of aggregates
+// committed before proofs were persisted are recomputed and stored.
+func (a *aggregator) inclusionProof(ref offerRef) (*proofRecord, error) {
+	proof, found, err := a.store.getProof(ref)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return proof, nil
+	}
+
+	offer, found, err := a.store.getOffer(ref)
+	if err != nil {
+		return nil, err
+	}
+	if !found || offer.Status != offerAggregated {
+		return nil, fmt.Errorf("offer %d of chain %d is not aggregated", ref.OfferID, ref.ChainID)
+	}
+	rec, found, err := a.store.getAggregate(offer.TransferID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no aggregate found for transfer ID %d", offer.TransferID)
+	}
+	agg, err := datasegment.NewAggregate(filabi.PaddedPieceSize(rec.DealSize), rec.Pieces)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rebuild aggregate for transfer %d: %w", rec.TransferID, err)
+	}
+	proofs, err := computeProofs(agg, *rec)
+	if err != nil {
+		return nil, err
+	}
+	for i := range proofs {
+		if proofs[i].OfferID == ref.OfferID && proofs[i].ChainID == ref.ChainID {
+			// Other offers of the aggregate may have failed to commit and been aggregated again
+			if err := a.store.putProofs(proofs[i : i+1]); err != nil {
+				return nil, fmt.Errorf("failed to persist proof of offer %d: %w", ref.OfferID, err)
+			}
+			return &proofs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("offer %d of chain %d is not part of aggregate %s", ref.OfferID, ref.ChainID, rec.AggCommP)
+}
+
+// Serve the inclusion proof of the offer given by the `offer` and `chain` query parameters as JSON
+func (a *aggregator) proofHandler(w http.ResponseWriter, r *http.Request) {
+	offerID, err := strconv.ParseUint(r.URL.Query().Get("offer"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid offer ID", http.StatusBadRequest)
+		return
+	}
+	chainID, err := a.requestChain(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	proof, err := a.inclusionProof(offerRef{ChainID: chainID, OfferID: offerID})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(proof); err != nil {
+		log.Printf("failed to write proof: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/filecoin-project/go-data-segment/datasegment"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that persisted proofs verify against the aggregate and that proofs of
+// aggregates stored without them are recomputed
+func TestInclusionProof(t *testing.T) {
+	store, err := openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	events := []DataReadyEvent{pieceEvent(t, 1, 256, 0), pieceEvent(t, 2, 512, 0), pieceEvent(t, 3, 256, 0)}
+	pieces, err := offerPieces(events)
+	assert.NoError(t, err)
+	agg, err := datasegment.NewAggregate(filabi.PaddedPieceSize(8192), pieces)
+	if err != nil {
+		t.Fatalf("failed to create aggregate: %v", err)
+	}
+	aggCommP, err := agg.PieceCID()
+	assert.NoError(t, err)
+	rec := aggregateRecord{TransferID: 0, AggCommP: aggCommP, DealSize: 8192, Pieces: pieces, OfferIDs: offerIDs(events)}
+	assert.NoError(t, store.saveAggregate(rec, events, nil))
+
+	a := &aggregator{store: store}
+	for i, event := range events {
+		proof, err := a.inclusionProof(event.ref())
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, pieces[i], proof.Piece)
+		aux, err := proof.Proof.ComputeExpectedAuxData(datasegment.VerifierDataForPieceInfo(proof.Piece))
+		if assert.NoError(t, err) {
+			assert.Equal(t, aggCommP, aux.CommPa)
+			assert.Equal(t, agg.DealSize, aux.SizePa)
+		}
+	}
+	offsets := make([]uint64, len(events))
+	for i, event := range events {
+		proof, err := a.inclusionProof(event.ref())
+		if assert.NoError(t, err) {
+			offsets[i] = proof.Offset
+		}
+	}
+	assert.Equal(t, []uint64{0, 512, 1024}, offsets)
+
+	stored, found, err := store.getProof(offerRef{OfferID: 2})
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, aggCommP, stored.AggCommP)
+
+	_, err = a.inclusionProof(offerRef{OfferID: 4})
+	assert.Error(t, err)
+}
+
+// Test that exported proofs verify offline and tampered ones do not
+func TestOfferProofVerify(t *testing.T) {
+	events := []DataReadyEvent{pieceEvent(t, 1, 256, 0), pieceEvent(t, 2, 512, 0)}
+	pieces, err := offerPieces(events)
+	assert.NoError(t, err)
+	agg, err := datasegment.NewAggregate(filabi.PaddedPieceSize(4096), pieces)
+	if err != nil {
+		t.Fatalf("failed to create aggregate: %v", err)
+	}
+	aggCommP, err := agg.PieceCID()
+	assert.NoError(t, err)
+	proofs, err := computeProofs(agg, aggregateRecord{AggCommP: aggCommP, Pieces: pieces, OfferIDs: offerIDs(events)})
+	if err != nil {
+		t.Fatalf("failed to compute proofs: %v", err)
+	}
+
+	bs, err := json.Marshal(newOfferProof(&proofs[1]))
+	assert.NoError(t, err)
+	var proof OfferProof
+	assert.NoError(t, json.Unmarshal(bs, &proof))
+	assert.NoError(t, proof.Verify())
+
+	wrongPiece := proof
+	wrongPiece.CommP = proofs[0].Piece.PieceCID.String()
+	assert.Error(t, wrongPiece.Verify())
+
+	wrongOffset := proof
+	wrongOffset.Offset = 0
+	assert.Error(t, wrongOffset.Verify())
+
+	wrongAggregate := proof
+	wrongAggregate.AggSize = 8192
+	assert.Error(t, wrongAggregate.Verify())
+}
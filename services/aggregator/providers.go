@@ -0,0 +1,160 @@
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+	lotustypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// A storage provider the aggregator makes deals with
+type storageProvider struct {
+	actor address.Address // address of the storage provider actor
+	peer  *peer.AddrInfo  // address to reach boost (or other) deal v 1.2 provider
+}
+
+// Get maddr for dialing boost from on chain miner actor
+func resolveProvider(ctx context.Context, lAPI LotusDaemonAPIClientV0, addr string) (storageProvider, error) {
+	providerAddr, err := address.NewFromString(addr)
+	if err != nil {
+		return storageProvider{}, fmt.Errorf("failed to parse provider address: %w", err)
+	}
+	minfo, err := lAPI.StateMinerInfo(ctx, providerAddr, lotustypes.EmptyTSK)
+	if err != nil {
+		return storageProvider{}, err
+	}
+	if minfo.PeerId == nil {
+		return storageProvider{}, fmt.Errorf("sp %s has no peer id set on chain", providerAddr)
+	}
+	var maddrs []multiaddr.Multiaddr
+	for _, mma := range minfo.Multiaddrs {
+		ma, err := multiaddr.NewMultiaddrBytes(mma)
+		if err != nil {
+			return storageProvider{}, fmt.Errorf("storage provider %s had invalid multiaddrs in their info: %w", providerAddr, err)
+		}
+		maddrs = append(maddrs, ma)
+	}
+	if len(maddrs) == 0 {
+		return storageProvider{}, fmt.Errorf("storage provider %s has no multiaddrs set on-chain", providerAddr)
+	}
+	return storageProvider{
+		actor: providerAddr,
+		peer: &peer.AddrInfo{
+			ID:    *minfo.PeerId,
+			Addrs: maddrs,
+		},
+	}, nil
+}
+
+// Resolve every configured provider, skipping those that cannot be reached
+func resolveProviders(ctx context.Context, lAPI LotusDaemonAPIClientV0, addrs []string) ([]storageProvider, error) {
+	var providers []storageProvider
+	for _, addr := range addrs {
+		sp, err := resolveProvider(ctx, lAPI, addr)
+		if err != nil {
+			log.Printf("[ERROR] skipping storage provider %s: %s", addr, err)
+			continue
+		}
+		providers = append(providers, sp)
+	}
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("none of the storage providers %v could be resolved", addrs)
+	}
+	return providers, nil
+}
+
+// Return the configured provider with the given actor address, resolving it
+// from chain state if it is no longer configured
+func (a *aggregator) providerFor(ctx context.Context, actor address.Address) (storageProvider, error) {
+	for _, sp := range a.providers {
+		if sp.actor == actor {
+			return sp, nil
+		}
+	}
+	return resolveProvider(ctx, a.lotusAPI, actor.String())
+}
+
+// Return the providers to propose the aggregate to next, in order of preference.
+// Providers are rotated by transfer ID so that aggregates are spread over them,
+// and providers already holding a replica are skipped. Without failover only the
+// providers first assigned to the aggregate are used.
+func (a *aggregator) candidateProviders(rec *aggregateRecord) []storageProvider {
+	placed := make(map[address.Address]struct{})
+	failures := make(map[address.Address]int)
+	for _, deal := range rec.Deals {
+		if deal.failed() {
+			failures[deal.Provider]++
+		} else {
+			placed[deal.Provider] = struct{}{}
+		}
+	}
+	var candidates []storageProvider
+	for i := range a.providers {
+		sp := a.providers[(rec.TransferID+i)%len(a.providers)]
+		if !a.retry.failover && i >= a.replicationFactor {
+			break
+		}
+		if _, ok := placed[sp.actor]; ok {
+			continue
+		}
+		candidates = append(candidates, sp)
+	}
+	// Prefer providers that failed the fewest times for this aggregate
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return failures[candidates[i].actor] < failures[candidates[j].actor]
+	})
+	return candidates
+}
+
+// Propose the aggregate to distinct providers until the replication factor is met,
+// every candidate has been tried or the retry budget is spent. Every proposal is
+// recorded on the aggregate. With a deal engine the uploaded aggregate is submitted
+// to it instead.
+func (a *aggregator) replicate(ctx context.Context, transferID int) error {
+	a.replicateLk.Lock()
+	defer a.replicateLk.Unlock()
+
+	rec, found, err := a.store.getAggregate(transferID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no aggregate found for transfer ID %d", transferID)
+	}
+
+	if a.dealEngine != nil && !rec.EngineFailed {
+		submitted, err := a.submitToDealEngine(ctx, rec)
+		if err != nil || submitted {
+			return err
+		}
+		log.Printf("[ERROR] aggregate %s was not uploaded to IPFS, proposing it to providers directly", rec.AggCommP)
+	}
+
+	accepted := rec.acceptedReplicas()
+	for _, sp := range a.candidateProviders(rec) {
+		if accepted >= a.replicationFactor || rec.placementAttempts() >= a.retry.maxAttempts {
+			break
+		}
+		deal, err := a.sendDeal(ctx, sp, *rec)
+		deal.Attempt = len(rec.Deals) + 1
+		if err != nil {
+			log.Printf("[ERROR] failed to send deal for transfer %d to %s (attempt %d): %s", transferID, sp.actor, deal.Attempt, err)
+			deal.setState(dealRejected, err.Error())
+		} else {
+			deal.Accepted = true
+			deal.setState(dealAccepted, "")
+			accepted++
+		}
+		if err := a.store.addDeal(transferID, deal); err != nil {
+			return fmt.Errorf("failed to persist deal %s: %w", deal.DealUUID, err)
+		}
+		rec.Deals = append(rec.Deals, deal)
+	}
+	log.Printf("Aggregate %s has %d of %d replicas accepted", rec.AggCommP, accepted, a.replicationFactor)
+	return nil
+}
@@ -0,0 +1,156 @@
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/google/uuid"
+)
+
+// Return true if the deal holds a replica that ends within window epochs of head
+func (d *dealRecord) expiresWithin(head filabi.ChainEpoch, window filabi.ChainEpoch) bool {
+	live := d.State == dealActive || (d.State == dealExpired && d.wasActive())
+	return live && d.EndEpoch-head <= window
+}
+
+// Return the proposals made to renew the deal
+func (r *aggregateRecord) renewalsOf(dealUUID uuid.UUID) []dealRecord {
+	var renewals []dealRecord
+	for _, deal := range r.Deals {
+		if deal.Renews == dealUUID {
+			renewals = append(renewals, deal)
+		}
+	}
+	return renewals
+}
+
+// Return the providers to renew an expiring deal with: the same provider first
+// and, with failover, the providers not already holding a live replica
+func (a *aggregator) renewalCandidates(ctx context.Context, rec *aggregateRecord, expiring dealRecord) []storageProvider {
+	var candidates []storageProvider
+	if sp, err := a.providerFor(ctx, expiring.Provider); err != nil {
+		log.Printf("[ERROR] cannot resolve provider %s to renew deal %s: %s", expiring.Provider, expiring.DealUUID, err)
+	} else {
+		candidates = append(candidates, sp)
+	}
+	if !a.retry.failover {
+		return candidates
+	}
+
+	live := make(map[address.Address]struct{})
+	for _, deal := range rec.Deals {
+		if !deal.failed() && !isTerminalDealState(deal.State) {
+			live[deal.Provider] = struct{}{}
+		}
+	}
+	for i := range a.providers {
+		sp := a.providers[(rec.TransferID+i)%len(a.providers)]
+		if _, ok := live[sp.actor]; ok || sp.actor == expiring.Provider {
+			continue
+		}
+		candidates = append(candidates, sp)
+	}
+
+	// Prefer providers that failed the fewest renewals of this deal
+	failures := make(map[address.Address]int)
+	for _, deal := range rec.renewalsOf(expiring.DealUUID) {
+		if deal.failed() {
+			failures[deal.Provider]++
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return failures[candidates[i].actor] < failures[candidates[j].actor]
+	})
+	return candidates
+}
+
+// Propose a new deal for every replica that is about to expire. The new deal is
+// recorded on the same aggregate and linked to the deal it renews.
+func (a *aggregator) renewDeals(ctx context.Context) error {
+	if a.renewalWindow <= 0 {
+		return nil
+	}
+	tipset, err := a.lotusAPI.ChainHead(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get chain head: %w", err)
+	}
+	head := tipset.Height()
+
+	aggs, err := a.store.aggregates()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i := range aggs {
+		rec := &aggs[i]
+		for _, deal := range rec.Deals {
+			// The deal engine renews the deals it made
+			if deal.Engine != "" || !deal.expiresWithin(head, a.renewalWindow) {
+				continue
+			}
+			renewals := rec.renewalsOf(deal.DealUUID)
+			var renewed bool
+			for _, r := range renewals {
+				renewed = renewed || !r.failed()
+			}
+			if renewed || len(renewals) >= a.retry.maxAttempts || now.Before(a.retry.nextAttempt(renewals)) {
+				continue
+			}
+			if err := a.renew(ctx, rec.TransferID, deal); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Propose the aggregate to the renewal candidates of the expiring deal until one accepts
+func (a *aggregator) renew(ctx context.Context, transferID int, expiring dealRecord) error {
+	a.replicateLk.Lock()
+	defer a.replicateLk.Unlock()
+
+	rec, found, err := a.store.getAggregate(transferID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no aggregate found for transfer ID %d", transferID)
+	}
+	log.Printf("Renewing deal %s with %s for aggregate %s ending at epoch %d", expiring.DealUUID, expiring.Provider, rec.AggCommP, expiring.EndEpoch)
+
+	// Providers fetch renewals from the transfer server which rebuilds the
+	// aggregate from the staged file or the buffers
+	proposal := *rec
+	proposal.RetrievalURL = ""
+	for _, sp := range a.renewalCandidates(ctx, rec, expiring) {
+		attempts := len(rec.renewalsOf(expiring.DealUUID))
+		if attempts >= a.retry.maxAttempts {
+			log.Printf("[ALERT] giving up renewing deal %s of aggregate %s after %d proposals", expiring.DealUUID, rec.AggCommP, attempts)
+			break
+		}
+		deal, err := a.sendDeal(ctx, sp, proposal)
+		deal.Attempt = len(rec.Deals) + 1
+		deal.Renews = expiring.DealUUID
+		if err != nil {
+			log.Printf("[ERROR] failed to send renewal deal for transfer %d to %s: %s", transferID, sp.actor, err)
+			deal.setState(dealRejected, err.Error())
+		} else {
+			deal.Accepted = true
+			deal.setState(dealAccepted, "")
+		}
+		if err := a.store.addDeal(transferID, deal); err != nil {
+			return fmt.Errorf("failed to persist deal %s: %w", deal.DealUUID, err)
+		}
+		rec.Deals = append(rec.Deals, deal)
+		if deal.Accepted {
+			log.Printf("Deal %s renews deal %s of aggregate %s", deal.DealUUID, expiring.DealUUID, rec.AggCommP)
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package aggregator
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpiresWithin(t *testing.T) {
+	deal := dealRecord{Accepted: true, EndEpoch: 1000}
+	deal.setState(dealSealing, "")
+	assert.False(t, deal.expiresWithin(950, 100))
+
+	deal.setState(dealActive, "")
+	assert.False(t, deal.expiresWithin(800, 100))
+	assert.True(t, deal.expiresWithin(950, 100))
+
+	// Replicas that expired before they could be renewed are renewed too
+	deal.setState(dealExpired, "")
+	assert.True(t, deal.expiresWithin(1100, 100))
+
+	// Deals that never started are retried, not renewed
+	missed := dealRecord{Accepted: true, EndEpoch: 1000}
+	missed.setState(dealExpired, "deal was not published before its start epoch")
+	assert.False(t, missed.expiresWithin(950, 100))
+}
+
+func TestRenewalsOf(t *testing.T) {
+	original := dealRecord{DealUUID: uuid.New(), Accepted: true, State: dealActive}
+	rec := aggregateRecord{Deals: []dealRecord{
+		original,
+		{DealUUID: uuid.New(), Renews: original.DealUUID, State: dealRejected},
+		{DealUUID: uuid.New(), Renews: original.DealUUID, Accepted: true, State: dealAccepted},
+	}}
+	assert.Len(t, rec.renewalsOf(original.DealUUID), 2)
+	assert.Equal(t, 1, rec.placementAttempts())
+}
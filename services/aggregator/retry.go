@@ -0,0 +1,119 @@
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/google/uuid"
+)
+
+const (
+	// default number of proposals made for an aggregate before giving up
+	defaultMaxDealAttempts = 5
+	// default wait before the first deal retry
+	defaultDealRetryBackoff = 10 * time.Minute
+	// default upper bound of the deal retry backoff
+	defaultDealRetryMaxBackoff = 24 * time.Hour
+)
+
+// Decides when and how often failed deal proposals are re-proposed
+type retryPolicy struct {
+	maxAttempts int           // proposals per aggregate before giving up
+	backoff     time.Duration // wait after the first failure
+	maxBackoff  time.Duration // upper bound of the exponential backoff
+	failover    bool          // whether alternate providers may be used
+}
+
+func newRetryPolicy(cfg config.DealRetryConfig) retryPolicy {
+	p := retryPolicy{
+		maxAttempts: cfg.MaxAttempts,
+		backoff:     time.Duration(cfg.Backoff) * time.Second,
+		maxBackoff:  time.Duration(cfg.MaxBackoff) * time.Second,
+		failover:    cfg.Failover,
+	}
+	if p.maxAttempts <= 0 {
+		p.maxAttempts = defaultMaxDealAttempts
+	}
+	if p.backoff <= 0 {
+		p.backoff = defaultDealRetryBackoff
+	}
+	if p.maxBackoff <= 0 {
+		p.maxBackoff = defaultDealRetryMaxBackoff
+	}
+	return p
+}
+
+// Return the wait before retrying after the given number of failed proposals
+func (p retryPolicy) delay(failures int) time.Duration {
+	d := p.backoff
+	for i := 1; i < failures && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	return d
+}
+
+// Return when the deals are due for another proposal given the failed ones,
+// the zero time if none failed
+func (p retryPolicy) nextAttempt(deals []dealRecord) time.Time {
+	var failures int
+	var last time.Time
+	for _, deal := range deals {
+		if !deal.failed() {
+			continue
+		}
+		failures++
+		if at := deal.lastUpdate(); at.After(last) {
+			last = at
+		}
+	}
+	if failures == 0 {
+		return time.Time{}
+	}
+	return last.Add(p.delay(failures))
+}
+
+// Re-propose every aggregate that is short of replicas once its backoff has
+// passed, giving up when the retry budget is spent
+func (a *aggregator) retryDeals(ctx context.Context) error {
+	aggs, err := a.store.aggregates()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i := range aggs {
+		rec := &aggs[i]
+		// The deal engine replicates and repairs aggregates submitted to it unless
+		// it made deals for another piece, aggregates are replicated once committed
+		if rec.GaveUp || (rec.DealEngineCID != "" && !rec.EngineFailed) || !rec.Committed || rec.acceptedReplicas() >= a.replicationFactor {
+			continue
+		}
+		if rec.placementAttempts() >= a.retry.maxAttempts {
+			log.Printf("[ALERT] giving up on aggregate %s after %d deal proposals, %d of %d replicas accepted",
+				rec.AggCommP, rec.placementAttempts(), rec.acceptedReplicas(), a.replicationFactor)
+			if err := a.store.updateAggregate(rec.TransferID, func(r *aggregateRecord) { r.GaveUp = true }); err != nil {
+				return fmt.Errorf("failed to persist aggregate %d: %w", rec.TransferID, err)
+			}
+			continue
+		}
+		var placements []dealRecord
+		for _, deal := range rec.Deals {
+			if deal.Renews == uuid.Nil {
+				placements = append(placements, deal)
+			}
+		}
+		if now.Before(a.retry.nextAttempt(placements)) {
+			continue
+		}
+		log.Printf("Retrying deals for aggregate %s, %d of %d replicas accepted", rec.AggCommP, rec.acceptedReplicas(), a.replicationFactor)
+		if err := a.replicate(ctx, rec.TransferID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package aggregator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/filecoin-project/go-address"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	p := newRetryPolicy(config.DealRetryConfig{Backoff: 60, MaxBackoff: 300})
+	assert.Equal(t, defaultMaxDealAttempts, p.maxAttempts)
+	assert.Equal(t, time.Minute, p.delay(1))
+	assert.Equal(t, 2*time.Minute, p.delay(2))
+	assert.Equal(t, 4*time.Minute, p.delay(3))
+	assert.Equal(t, 5*time.Minute, p.delay(10))
+
+	proposed := time.Now()
+	rec := aggregateRecord{}
+	assert.True(t, p.nextAttempt(rec.Deals).IsZero())
+	rec.Deals = append(rec.Deals, dealRecord{Accepted: true, State: dealSealing, ProposedAt: proposed})
+	assert.True(t, p.nextAttempt(rec.Deals).IsZero())
+	rec.Deals = append(rec.Deals, dealRecord{ProposedAt: proposed})
+	rec.Deals[1].setState(dealRejected, "busy")
+	assert.Equal(t, rec.Deals[1].lastUpdate().Add(time.Minute), p.nextAttempt(rec.Deals))
+}
+
+func TestCandidateProviders(t *testing.T) {
+	var providers []storageProvider
+	for _, addr := range []string{"t01000", "t01001", "t01002"} {
+		actor, err := address.NewFromString(addr)
+		assert.NoError(t, err)
+		providers = append(providers, storageProvider{actor: actor})
+	}
+	a := &aggregator{providers: providers, replicationFactor: 1, retry: retryPolicy{failover: true}}
+	actors := func(sps []storageProvider) []address.Address {
+		var out []address.Address
+		for _, sp := range sps {
+			out = append(out, sp.actor)
+		}
+		return out
+	}
+
+	// Rotated by transfer ID, failed providers last, placed providers skipped
+	rec := aggregateRecord{TransferID: 1, Deals: []dealRecord{
+		{Provider: providers[1].actor, State: dealRejected},
+		{Provider: providers[0].actor, Accepted: true, State: dealActive},
+	}}
+	assert.Equal(t, []address.Address{providers[2].actor, providers[1].actor}, actors(a.candidateProviders(&rec)))
+
+	// Without failover only the assigned provider is retried
+	a.retry.failover = false
+	assert.Equal(t, []address.Address{providers[1].actor}, actors(a.candidateProviders(&rec)))
+}
@@ -0,0 +1,230 @@
+package aggregator
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/ipfs/go-cid"
+)
+
+// size of the parts of multipart uploads, larger files are uploaded in parts
+var s3PartSize int64 = 256 << 20
+
+// Uploads aggregates to a bucket of an S3-compatible object store, named by their commp
+type s3Uploader struct {
+	client    *http.Client
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	publicURL string // base URL providers fetch objects from
+}
+
+func newS3Uploader(cfg config.S3Config) (*s3Uploader, error) {
+	if cfg.Endpoint == "" || cfg.Region == "" || cfg.Bucket == "" || cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("s3 upload requires Upload.S3.Endpoint, Region, Bucket, AccessKeyID and SecretAccessKey")
+	}
+	u := &s3Uploader{
+		client:    &http.Client{Timeout: 2 * time.Hour},
+		endpoint:  strings.TrimSuffix(cfg.Endpoint, "/"),
+		region:    cfg.Region,
+		bucket:    cfg.Bucket,
+		accessKey: cfg.AccessKeyID,
+		secretKey: cfg.SecretAccessKey,
+		publicURL: strings.TrimSuffix(cfg.PublicURL, "/"),
+	}
+	if u.publicURL == "" {
+		u.publicURL = u.endpoint + "/" + u.bucket
+	}
+	return u, nil
+}
+
+func (u *s3Uploader) Upload(ctx context.Context, path string, aggCommp cid.Cid) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	key := aggCommp.String()
+	if info.Size() <= s3PartSize {
+		_, _, err = u.do(ctx, http.MethodPut, key, nil, io.NewSectionReader(file, 0, info.Size()), info.Size())
+	} else {
+		err = u.multipartUpload(ctx, key, file, info.Size())
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to upload to s3: %w", err)
+	}
+	return u.publicURL + "/" + key, nil
+}
+
+// Upload the file in parts of s3PartSize, aborting the upload on failure
+func (u *s3Uploader) multipartUpload(ctx context.Context, key string, file *os.File, size int64) error {
+	_, resp, err := u.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, 0)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp, &initiated); err != nil {
+		return fmt.Errorf("failed to decode multipart upload: %w", err)
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	err = func() error {
+		for offset, number := int64(0), 1; offset < size; offset, number = offset+s3PartSize, number+1 {
+			length := min(s3PartSize, size-offset)
+			params := url.Values{"partNumber": {fmt.Sprint(number)}, "uploadId": {initiated.UploadID}}
+			header, _, err := u.do(ctx, http.MethodPut, key, params, io.NewSectionReader(file, offset, length), length)
+			if err != nil {
+				return fmt.Errorf("failed to upload part %d: %w", number, err)
+			}
+			complete.Parts = append(complete.Parts, part{PartNumber: number, ETag: header.Get("ETag")})
+		}
+		body, err := xml.Marshal(complete)
+		if err != nil {
+			return fmt.Errorf("failed to encode parts: %w", err)
+		}
+		_, _, err = u.do(ctx, http.MethodPost, key, url.Values{"uploadId": {initiated.UploadID}}, bytes.NewReader(body), int64(len(body)))
+		return err
+	}()
+	if err != nil {
+		if _, _, abortErr := u.do(context.Background(), http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, 0); abortErr != nil {
+			return fmt.Errorf("%w, failed to abort upload: %s", err, abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Send a signed request for the object with the given key, return the response headers and body
+func (u *s3Uploader) do(ctx context.Context, method, key string, params url.Values, body io.Reader, length int64) (http.Header, []byte, error) {
+	target := u.endpoint + "/" + u.bucket + "/" + key
+	if len(params) > 0 {
+		target += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.ContentLength = length
+	signV4(req, "UNSIGNED-PAYLOAD", u.accessKey, u.secretKey, u.region, time.Now())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, nil, fmt.Errorf("%s %s: %s %s", method, req.URL.Path, resp.Status, respBody)
+	}
+	return resp.Header, respBody, nil
+}
+
+// Sign the request for S3 with AWS signature version 4, covering the host and all
+// headers set on the request
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var canonicalQuery []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			canonicalQuery = append(canonicalQuery, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscape(req.URL.Path, false),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// URI encode s as required by AWS signatures, slashes are kept unless encodeSlash
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,177 @@
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/FIL-Builders/xchainClient/utils"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// The part of an Ethereum client used to follow a source chain
+type chainClient interface {
+	ethereum.LogFilterer
+	ethereum.BlockNumberReader
+	ethereum.TransactionReader
+	TransactionSender(ctx context.Context, tx *types.Transaction, block common.Hash, index uint) (common.Address, error)
+	Close()
+}
+
+// A source chain the aggregator takes offers from and commits aggregates to
+type sourceChain struct {
+	chainID       int
+	client        chainClient      // raw client for log subscriptions
+	onrampAddr    common.Address   // onramp address for log subscription and message sending
+	txm           *utils.TxManager // sends messages to the onramp
+	startBlock    uint64           // block to backfill from when no checkpoint is stored
+	backfillRange uint64           // max blocks per FilterLogs query while backfilling
+	confirmations uint64           // blocks an event must be buried under before aggregation
+
+	scanLk     sync.Mutex
+	scanned    uint64         // every block before it was scanned for events
+	inflight   map[uint64]int // number of events held or queued for aggregation by block, not persisted yet
+	checkpoint uint64         // last persisted checkpoint
+}
+
+// Identifies an offer across source chains, offer IDs are only unique per OnRamp
+type offerRef struct {
+	ChainID int
+	OfferID uint64
+}
+
+func (e DataReadyEvent) ref() offerRef {
+	return offerRef{ChainID: e.ChainID, OfferID: e.OfferID}
+}
+
+func newSourceChain(ctx context.Context, cfg *config.Config, srcCfg *config.SourceChainConfig) (*sourceChain, error) {
+	client, err := ethclient.Dial(srcCfg.Api)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Ethereum client for source chain at %s: %w", srcCfg.Api, err)
+	}
+	// Aggregates are labeled with the configured chain ID, make sure it is the right one
+	chainID, err := client.ChainID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chain ID of source chain at %s: %w", srcCfg.Api, err)
+	}
+	if chainID.Cmp(big.NewInt(int64(srcCfg.ChainID))) != 0 {
+		return nil, fmt.Errorf("source chain at %s has chain ID %s, configured as %d", srcCfg.Api, chainID, srcCfg.ChainID)
+	}
+
+	onRampContractAddress := common.HexToAddress(srcCfg.OnRampAddress)
+
+	//aggregator need to call smart contract on source Chain to send podsi proof
+	auth, err := utils.LoadPrivateKey(cfg, srcCfg.ChainID)
+	if err != nil {
+		return nil, err
+	}
+
+	backfillRange := srcCfg.BackfillRange
+	if backfillRange == 0 {
+		backfillRange = defaultBackfillRange
+	}
+	return &sourceChain{
+		chainID:       srcCfg.ChainID,
+		client:        client,
+		onrampAddr:    onRampContractAddress,
+		txm:           utils.NewTxManager(client, auth, srcCfg.Tx),
+		startBlock:    srcCfg.StartBlock,
+		backfillRange: backfillRange,
+		confirmations: srcCfg.Confirmations,
+	}, nil
+}
+
+// Record that every block of the source chain before `block` was scanned for events
+func (a *aggregator) scannedTo(src *sourceChain, block uint64) error {
+	src.scanLk.Lock()
+	defer src.scanLk.Unlock()
+	src.scanned = max(src.scanned, block)
+	return a.saveCheckpoint(src)
+}
+
+// Record an event accepted for aggregation, scanning resumes from its block until it is persisted
+func (src *sourceChain) eventAccepted(block uint64) {
+	src.scanLk.Lock()
+	defer src.scanLk.Unlock()
+	if src.inflight == nil {
+		src.inflight = make(map[uint64]int)
+	}
+	src.inflight[block]++
+}
+
+// Record that an accepted event was persisted or dropped
+func (a *aggregator) eventSettled(block uint64) error {
+	src := a.src
+	src.scanLk.Lock()
+	defer src.scanLk.Unlock()
+	if _, ok := src.inflight[block]; !ok {
+		return nil
+	}
+	if src.inflight[block]--; src.inflight[block] <= 0 {
+		delete(src.inflight, block)
+	}
+	return a.saveCheckpoint(src)
+}
+
+// Forget the held events of a subscription that ended and rescan from the checkpoint,
+// before which they were found again
+func (src *sourceChain) rewind(held []uint64) {
+	src.scanLk.Lock()
+	defer src.scanLk.Unlock()
+	for _, block := range held {
+		if _, ok := src.inflight[block]; !ok {
+			continue
+		}
+		if src.inflight[block]--; src.inflight[block] <= 0 {
+			delete(src.inflight, block)
+		}
+	}
+	src.scanned = src.checkpoint
+}
+
+// Persist the block scanning resumes from after a restart: the first block not fully
+// scanned or holding an event that is not persisted yet. Must be called with scanLk held.
+func (a *aggregator) saveCheckpoint(src *sourceChain) error {
+	checkpoint := src.scanned
+	for block := range src.inflight {
+		checkpoint = min(checkpoint, block)
+	}
+	if checkpoint <= src.checkpoint {
+		return nil
+	}
+	if err := a.store.putCheckpoint(src.chainID, checkpoint); err != nil {
+		return fmt.Errorf("failed to persist checkpoint: %w", err)
+	}
+	src.checkpoint = checkpoint
+	return nil
+}
+
+// Return the source chain given by the `chain` query parameter of the request,
+// the source chain of the aggregator if it is omitted
+func (a *aggregator) requestChain(r *http.Request) (int, error) {
+	chain := r.URL.Query().Get("chain")
+	if chain == "" {
+		return a.src.chainID, nil
+	}
+	chainID, err := strconv.Atoi(chain)
+	if err != nil {
+		return 0, fmt.Errorf("invalid chain %q", chain)
+	}
+	if chainID != a.src.chainID {
+		return 0, fmt.Errorf("chain %d is not the source of this aggregator", chainID)
+	}
+	return chainID, nil
+}
+
+// Return the deal label of an aggregate: the ID of the source chain it is committed to,
+// as expected by the prover contract and relayer
+func dealLabel(chainID int) string {
+	return strconv.Itoa(chainID)
+}
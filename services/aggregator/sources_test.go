@@ -0,0 +1,231 @@
+package aggregator
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/FIL-Builders/xchainClient/utils"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// Return the DataReady log of the offer emitted in the block
+func dataReadyLog(t *testing.T, onrampABI *abi.ABI, event DataReadyEvent, block uint64, hash common.Hash) types.Log {
+	offer := struct {
+		CommP    []byte
+		Size     uint64
+		Location string
+		Amount   *big.Int
+		Token    common.Address
+	}{event.Offer.CommP, event.Offer.Size, event.Offer.Location, event.Offer.Amount, event.Offer.Token}
+	data, err := onrampABI.Events["DataReady"].Inputs.Pack(offer, event.OfferID)
+	if err != nil {
+		t.Fatalf("failed to pack DataReady event: %v", err)
+	}
+	return types.Log{Data: data, BlockNumber: block, BlockHash: hash}
+}
+
+// Return the next event handed over for aggregation, nil if none arrives
+func nextEvent(ch chan DataReadyEvent) *DataReadyEvent {
+	select {
+	case event := <-ch:
+		return &event
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+// Test that the checkpoint advances over scanned blocks but not past unpersisted events
+func TestBackfillCheckpoint(t *testing.T) {
+	store, err := openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	client := &fakeChainClient{head: 100}
+	src := &sourceChain{chainID: 1, client: client, startBlock: 10, backfillRange: 20}
+	a := &aggregator{store: store, src: src}
+	ctx := context.Background()
+	checkpoint := func() uint64 {
+		block, err := store.checkpoint(1)
+		assert.NoError(t, err)
+		return block
+	}
+
+	// Ranges without offers are not scanned again
+	var handled []uint64
+	handleLog := func(vLog types.Log) error {
+		handled = append(handled, vLog.BlockNumber)
+		src.eventAccepted(vLog.BlockNumber)
+		return nil
+	}
+	assert.NoError(t, a.backfill(ctx, src, ethereum.FilterQuery{}, handleLog))
+	assert.Empty(t, handled)
+	assert.EqualValues(t, 101, checkpoint())
+
+	// Scanning resumes from accepted events until they are persisted
+	client.head = 200
+	client.logs = []types.Log{{BlockNumber: 120}, {BlockNumber: 150}}
+	assert.NoError(t, a.backfill(ctx, src, ethereum.FilterQuery{}, handleLog))
+	assert.Equal(t, []uint64{120, 150}, handled)
+	assert.EqualValues(t, 120, checkpoint())
+	assert.NoError(t, a.eventSettled(120))
+	assert.EqualValues(t, 150, checkpoint())
+
+	// Events held by an ended subscription are found again
+	src.rewind([]uint64{150})
+	assert.EqualValues(t, 150, checkpoint())
+	assert.NoError(t, a.backfill(ctx, src, ethereum.FilterQuery{}, handleLog))
+	assert.Equal(t, []uint64{120, 150, 150}, handled)
+	assert.NoError(t, a.eventSettled(150))
+	assert.EqualValues(t, 201, checkpoint())
+	// Events not accepted through the subscription do not affect the checkpoint
+	assert.NoError(t, a.eventSettled(300))
+	assert.EqualValues(t, 201, checkpoint())
+}
+
+// Test that offers are only handed over once buried under the confirmation depth,
+// and that held offers removed by a reorg are dropped
+func TestConfirmationDepth(t *testing.T) {
+	interval := confirmationPollInterval
+	confirmationPollInterval = time.Millisecond
+	defer func() { confirmationPollInterval = interval }()
+
+	store, err := openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	onrampABI, err := utils.LoadAbi("../../config/onramp-abi.json")
+	if err != nil {
+		t.Fatalf("failed to load abi: %v", err)
+	}
+	policy, err := newAdmissionPolicy(config.AdmissionPolicyConfig{})
+	assert.NoError(t, err)
+
+	held := dataReadyLog(t, onrampABI, pieceEvent(t, 2, 256, 0), 99, common.HexToHash("0x99"))
+	client := &fakeChainClient{head: 100, logs: []types.Log{
+		dataReadyLog(t, onrampABI, pieceEvent(t, 1, 256, 0), 95, common.HexToHash("0x95")),
+		held,
+	}}
+	src := &sourceChain{chainID: 1, client: client, startBlock: 90, backfillRange: 20, confirmations: 3}
+	a := &aggregator{
+		store:     store,
+		src:       src,
+		abi:       onrampABI,
+		policy:    policy,
+		ch:        make(chan DataReadyEvent, 8),
+		retractCh: make(chan DataReadyEvent, 8),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.SubscribeQuery(ctx, src, ethereum.FilterQuery{}) }()
+
+	// Only the offer 3 blocks deep is handed over
+	if event := nextEvent(a.ch); assert.NotNil(t, event) {
+		assert.EqualValues(t, 1, event.OfferID)
+		assert.EqualValues(t, 95, event.BlockNumber)
+	}
+	assert.Nil(t, nextEvent(a.ch))
+	checkpoint, err := store.checkpoint(1)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 95, checkpoint)
+
+	// The held offer is removed by a reorg while a new one arrives
+	client.lk.Lock()
+	sub := client.sub
+	client.lk.Unlock()
+	held.Removed = true
+	sub <- held
+	sub <- dataReadyLog(t, onrampABI, pieceEvent(t, 3, 256, 0), 101, common.HexToHash("0x101"))
+	assert.Nil(t, nextEvent(a.ch))
+	client.setHead(104)
+	if event := nextEvent(a.ch); assert.NotNil(t, event) {
+		assert.EqualValues(t, 3, event.OfferID)
+	}
+	assert.Nil(t, nextEvent(a.ch))
+	assert.Empty(t, a.retractCh)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+// Test that retracted offers are not aggregated from events still queued, whatever
+// order runAggregate receives them in, but are when a reorg includes them again
+func TestRetraction(t *testing.T) {
+	store, err := openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	a := &aggregator{
+		store:       store,
+		src:         &sourceChain{},
+		ch:          make(chan DataReadyEvent, 8),
+		retractCh:   make(chan DataReadyEvent, 8),
+		transfers:   make(map[int]AggregateTransfer),
+		packer:      firstFit{},
+		minDealSize: 1 << 20,
+		maxDealSize: 1 << 20,
+	}
+	offer := func(id uint64, hash string) DataReadyEvent {
+		event := pieceEvent(t, id, 256, 0)
+		event.BlockHash = common.HexToHash(hash)
+		return event
+	}
+	status := func(id uint64) (string, common.Hash) {
+		rec, found, err := store.getOffer(offerRef{OfferID: id})
+		if err != nil || !found {
+			return "", common.Hash{}
+		}
+		return rec.Status, rec.Event.BlockHash
+	}
+
+	// The removal is queued after the event it retracts
+	a.ch <- offer(1, "0x01")
+	a.retractCh <- offer(1, "0x01")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.runAggregate(ctx) }()
+	assert.Eventually(t, func() bool {
+		s, _ := status(1)
+		return s == offerRetracted && len(a.ch) == 0
+	}, time.Second, time.Millisecond)
+
+	// Events of the removed block still queued are skipped, the offer is included again in another block
+	a.ch <- offer(1, "0x01")
+	a.ch <- offer(1, "0x02")
+	assert.Eventually(t, func() bool {
+		s, hash := status(1)
+		return s == offerPending && hash == common.HexToHash("0x02")
+	}, time.Second, time.Millisecond)
+
+	// Removals of earlier inclusions are ignored
+	a.retractCh <- offer(1, "0x01")
+	a.ch <- offer(2, "0x03")
+	assert.Eventually(t, func() bool {
+		s, _ := status(2)
+		return s == offerPending
+	}, time.Second, time.Millisecond)
+	s, hash := status(1)
+	assert.Equal(t, offerPending, s)
+	assert.Equal(t, common.HexToHash("0x02"), hash)
+
+	// Pending offers are dropped
+	a.retractCh <- offer(2, "0x03")
+	assert.Eventually(t, func() bool {
+		s, _ := status(2)
+		return s == offerRetracted
+	}, time.Second, time.Millisecond)
+	cancel()
+	assert.NoError(t, <-done)
+	pending, err := store.pendingOffers()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1}, offerIDs(pending))
+}
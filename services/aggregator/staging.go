@@ -0,0 +1,155 @@
+package aggregator
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/ipfs/go-cid"
+)
+
+// default directory aggregate files are staged in
+const defaultStagingPath = "~/.xchain/staging"
+
+// Return where the aggregate file with the given commp is staged
+func (a *aggregator) stagedAggregatePath(aggCommp cid.Cid) string {
+	return filepath.Join(a.stagingPath, aggCommp.String())
+}
+
+// Write the aggregate of the transfer to its staging file, unless that would leave
+// less than the configured free space. Partially written files are removed.
+func (a *aggregator) stageAggregate(transferID int, aggCommp cid.Cid, size uint64) (string, error) {
+	location := a.stagedAggregatePath(aggCommp)
+	free, err := freeSpace(a.stagingPath)
+	if err != nil {
+		log.Printf("failed to check free space in %s, staging anyway: %s", a.stagingPath, err)
+	} else if free < size+a.stagingMinFree {
+		return "", fmt.Errorf("%d bytes free in %s, %d needed to stage %d bytes", free, a.stagingPath, size+a.stagingMinFree, size)
+	}
+	if err := a.saveAggregateToFile(transferID, location); err != nil {
+		os.Remove(location)
+		return "", err
+	}
+	// Its commp was checked while writing it
+	if info, err := os.Stat(location); err == nil {
+		a.markStagedVerified(aggCommp, info.ModTime())
+	}
+	return location, nil
+}
+
+// Open the staged aggregate with the given commp and unpadded size for serving. Returns
+// nil if it is missing or does not match the commp, mismatching files are removed.
+// The commp is only computed again after the file was modified.
+func (a *aggregator) openStaged(aggCommp cid.Cid, size uint64) *os.File {
+	location := a.stagedAggregatePath(aggCommp)
+	file, err := os.Open(location)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("failed to open staged aggregate %s: %s", aggCommp, err)
+		}
+		return nil
+	}
+	info, err := file.Stat()
+	if err != nil {
+		log.Printf("failed to stat staged aggregate %s: %s", aggCommp, err)
+		file.Close()
+		return nil
+	}
+
+	a.stagingLk.Lock()
+	verifiedAt, verified := a.stagedVerified[aggCommp]
+	a.stagingLk.Unlock()
+	if verified && verifiedAt.Equal(info.ModTime()) {
+		return file
+	}
+
+	_, err, _ = a.stagingVerify.Do(aggCommp.String(), func() (interface{}, error) {
+		if uint64(info.Size()) != size {
+			return nil, fmt.Errorf("staged aggregate has %d bytes, expected %d", info.Size(), size)
+		}
+		log.Printf("Verifying commp of staged aggregate %s", aggCommp)
+		cp := new(commp.Calc)
+		if _, err := io.Copy(cp, io.NewSectionReader(file, 0, info.Size())); err != nil {
+			return nil, fmt.Errorf("failed to read staged aggregate: %w", err)
+		}
+		return nil, checkCommp(cp, aggCommp)
+	})
+	if err != nil {
+		log.Printf("[ERROR] staged aggregate %s is removed and served from the buffers: %s", aggCommp, err)
+		file.Close()
+		os.Remove(location)
+		return nil
+	}
+	a.markStagedVerified(aggCommp, info.ModTime())
+	return file
+}
+
+func (a *aggregator) markStagedVerified(aggCommp cid.Cid, modTime time.Time) {
+	a.stagingLk.Lock()
+	defer a.stagingLk.Unlock()
+	a.stagedVerified[aggCommp] = modTime
+}
+
+// Check that the data written to cp has the expected piece commp
+func checkCommp(cp *commp.Calc, expected cid.Cid) error {
+	rawCommP, _, err := cp.Digest()
+	if err != nil {
+		return fmt.Errorf("failed to compute commp: %w", err)
+	}
+	commCid, err := commcid.DataCommitmentV1ToCID(rawCommP)
+	if err != nil {
+		return fmt.Errorf("failed to convert commp to cid: %w", err)
+	}
+	if !commCid.Equals(expected) {
+		return fmt.Errorf("commp %s does not match %s", commCid, expected)
+	}
+	return nil
+}
+
+// Remove staged aggregates whose deals reached the retention state
+func (a *aggregator) cleanupStaged() error {
+	if a.stagingRetention == "" {
+		return nil
+	}
+	aggs, err := a.store.aggregates()
+	if err != nil {
+		return err
+	}
+	for _, rec := range aggs {
+		if !a.retentionReached(rec) {
+			continue
+		}
+		err := os.Remove(a.stagedAggregatePath(rec.AggCommP))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			log.Printf("failed to remove staged aggregate %s: %s", rec.AggCommP, err)
+			continue
+		}
+		a.stagingLk.Lock()
+		delete(a.stagedVerified, rec.AggCommP)
+		a.stagingLk.Unlock()
+		log.Printf("Removed staged aggregate %s of transfer %d, its deals are %s", rec.AggCommP, rec.TransferID, a.stagingRetention)
+	}
+	return nil
+}
+
+// Report whether deals with as many providers as the replication factor reached the retention state
+func (a *aggregator) retentionReached(rec aggregateRecord) bool {
+	providers := make(map[address.Address]struct{})
+	for _, deal := range rec.Deals {
+		if deal.reached(a.stagingRetention) {
+			providers[deal.Provider] = struct{}{}
+		}
+	}
+	return len(providers) >= a.replicationFactor
+}
@@ -0,0 +1,147 @@
+package aggregator
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-data-segment/datasegment"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+)
+
+func testAggCommp(t *testing.T, b byte) cid.Cid {
+	commP := make([]byte, 32)
+	commP[0] = b
+	c, err := commcid.DataCommitmentV1ToCID(commP)
+	if err != nil {
+		t.Fatalf("failed to make commp cid: %v", err)
+	}
+	return c
+}
+
+func TestCleanupStaged(t *testing.T) {
+	store, err := openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	a := &aggregator{store: store, stagingPath: t.TempDir(), stagingRetention: dealActive, replicationFactor: 2}
+
+	p1, _ := address.NewIDAddress(1000)
+	p2, _ := address.NewIDAddress(1001)
+	active := func(provider address.Address) dealRecord {
+		deal := dealRecord{Provider: provider, Accepted: true}
+		deal.setState(dealActive, "")
+		// Later transitions don't undo reaching the retention state
+		deal.setState(dealExpired, "")
+		return deal
+	}
+	sealing := dealRecord{Provider: p2, Accepted: true}
+	sealing.setState(dealSealing, "")
+
+	done := aggregateRecord{TransferID: 1, AggCommP: testAggCommp(t, 1), Deals: []dealRecord{active(p1), active(p2)}}
+	// Both deals are with the same provider, short of the replication factor
+	oneProvider := aggregateRecord{TransferID: 2, AggCommP: testAggCommp(t, 2), Deals: []dealRecord{active(p1), active(p1)}}
+	inProgress := aggregateRecord{TransferID: 3, AggCommP: testAggCommp(t, 3), Deals: []dealRecord{active(p1), sealing}}
+	for _, rec := range []aggregateRecord{done, oneProvider, inProgress} {
+		assert.NoError(t, store.saveAggregate(rec, nil, nil))
+		assert.NoError(t, os.WriteFile(a.stagedAggregatePath(rec.AggCommP), []byte("aggregate"), 0644))
+	}
+
+	assert.NoError(t, a.cleanupStaged())
+	assert.NoFileExists(t, a.stagedAggregatePath(done.AggCommP))
+	assert.FileExists(t, a.stagedAggregatePath(oneProvider.AggCommP))
+	assert.FileExists(t, a.stagedAggregatePath(inProgress.AggCommP))
+
+	// Without a retention state staged aggregates are kept
+	a.stagingRetention = ""
+	a.replicationFactor = 1
+	assert.NoError(t, a.cleanupStaged())
+	assert.FileExists(t, a.stagedAggregatePath(oneProvider.AggCommP))
+}
+
+func TestStageAggregateFreeSpace(t *testing.T) {
+	a := &aggregator{stagingPath: t.TempDir(), stagingMinFree: 1 << 62}
+	_, err := a.stageAggregate(1, testAggCommp(t, 1), 1<<20)
+	assert.Error(t, err)
+	assert.NoFileExists(t, a.stagedAggregatePath(testAggCommp(t, 1)))
+}
+
+func TestServeStaged(t *testing.T) {
+	// Sub pieces with their real commps so the aggregate commp matches its data
+	var pieces []filabi.PieceInfo
+	var data [][]byte
+	for _, size := range []int{1000, 3000} {
+		piece := bytes.Repeat([]byte{byte(size)}, size)
+		cp := new(commp.Calc)
+		cp.Write(piece)
+		rawCommP, paddedSize, err := cp.Digest()
+		if err != nil {
+			t.Fatalf("failed to compute commp: %v", err)
+		}
+		c, err := commcid.DataCommitmentV1ToCID(rawCommP)
+		if err != nil {
+			t.Fatalf("failed to convert commp: %v", err)
+		}
+		pieces = append(pieces, filabi.PieceInfo{Size: filabi.PaddedPieceSize(paddedSize), PieceCID: c})
+		data = append(data, piece)
+	}
+	buffer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+		w.Write(data[id])
+	}))
+	agg, err := datasegment.NewAggregate(filabi.PaddedPieceSize(1<<20), pieces)
+	if err != nil {
+		t.Fatalf("failed to create aggregate: %v", err)
+	}
+	aggCommp, err := agg.PieceCID()
+	if err != nil {
+		t.Fatalf("failed to get commp: %v", err)
+	}
+	size := uint64(agg.DealSize.Unpadded())
+
+	a := &aggregator{
+		stagingPath:    t.TempDir(),
+		stagedVerified: make(map[cid.Cid]time.Time),
+		fetcher:        newPieceFetcher(config.PieceFetchConfig{}, t.TempDir()),
+		transfers: map[int]AggregateTransfer{
+			1: {locations: []string{buffer.URL + "/?id=0", buffer.URL + "/?id=1"}, agg: agg},
+		},
+	}
+	location, err := a.stageAggregate(1, aggCommp, size)
+	assert.NoError(t, err)
+	assert.Contains(t, a.stagedVerified, aggCommp)
+	staged, err := os.ReadFile(location)
+	assert.NoError(t, err)
+
+	// Transfers are served from the staged aggregate without the buffer
+	buffer.Close()
+	w := httptest.NewRecorder()
+	a.transferHandler(w, httptest.NewRequest(http.MethodGet, "/?id=1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, bytes.Equal(staged, w.Body.Bytes()))
+
+	// Staged aggregates found on startup are verified before they are served
+	delete(a.stagedVerified, aggCommp)
+	file := a.openStaged(aggCommp, size)
+	if assert.NotNil(t, file) {
+		file.Close()
+	}
+
+	// Modified staged aggregates are verified again and removed if they don't match
+	staged[0]++
+	assert.NoError(t, os.WriteFile(location, staged, 0644))
+	assert.NoError(t, os.Chtimes(location, time.Now(), time.Now().Add(time.Hour)))
+	assert.Nil(t, a.openStaged(aggCommp, size))
+	assert.NoFileExists(t, location)
+}
@@ -0,0 +1,441 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	verifregtypes "github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/mitchellh/go-homedir"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	// Offer is waiting in the pending queue for aggregation
+	offerPending = "pending"
+	// Offer is part of a committed aggregate
+	offerAggregated = "aggregated"
+	// Offer was removed from the source chain by a reorg
+	offerRetracted = "retracted"
+	// Offer was refused by the admission policy
+	offerRejected = "rejected"
+)
+
+const (
+	offerPrefix     = "offer/"
+	aggregatePrefix = "aggregate/"
+	proofPrefix     = "proof/"
+	transferIDKey   = "meta/transferID"
+	checkpointKey   = "meta/checkpoint/"
+	notifyKey       = "meta/notifyCheckpoint"
+)
+
+// Durable state of a single offer seen by the aggregator
+type offerRecord struct {
+	Event      DataReadyEvent `json:"event"`
+	Status     string         `json:"status"`
+	TransferID int            `json:"transferID"`
+	Reason     string         `json:"reason,omitempty"`
+}
+
+// Durable state of a committed aggregate.
+// The datasegment.Aggregate is not stored, it is rebuilt from DealSize and Pieces on load.
+type aggregateRecord struct {
+	TransferID    int                `json:"transferID"`
+	AggCommP      cid.Cid            `json:"aggCommP"`
+	DealSize      uint64             `json:"dealSize"`
+	Pieces        []filabi.PieceInfo `json:"pieces"`
+	OfferIDs      []uint64           `json:"offerIDs"`
+	ChainID       int                `json:"chainID"`   // source chain of the offers, whose OnRamp the aggregate is committed to
+	Committed     bool               `json:"committed"` // the aggregate is being committed until its commit is included
+	Locations     []string           `json:"locations"`
+	RetrievalURL  string             `json:"retrievalURL"` // where providers fetch the aggregate, the transfer server if empty
+	Deals         []dealRecord       `json:"deals"`
+	GaveUp        bool               `json:"gaveUp,omitempty"`        // retry budget exhausted before replication was met
+	DealEngineCID string             `json:"dealEngineCID,omitempty"` // uploaded content submitted to the deal engine
+	EngineFailed  bool               `json:"engineFailed,omitempty"`  // deal engine made deals for another piece, replicated by the aggregator instead
+	CommitTxs     []common.Hash      `json:"commitTxs,omitempty"`     // commit transactions sent to the OnRamp
+	// Allocate transactions sent for each provider whose allocation is not recorded on a deal yet
+	Allocating map[filabi.ActorID][]common.Hash `json:"allocating,omitempty"`
+}
+
+// A deal proposal made to a storage provider for an aggregate
+type dealRecord struct {
+	Provider     address.Address            `json:"provider"`
+	DealUUID     uuid.UUID                  `json:"dealUUID"`
+	Attempt      int                        `json:"attempt"`          // 1 for the first proposal made for the aggregate
+	Renews       uuid.UUID                  `json:"renews,omitempty"` // expiring deal this proposal renews
+	Accepted     bool                       `json:"accepted"`
+	Message      string                     `json:"message,omitempty"` // why the proposal failed
+	ProposedAt   time.Time                  `json:"proposedAt"`
+	StartEpoch   filabi.ChainEpoch          `json:"startEpoch"`
+	EndEpoch     filabi.ChainEpoch          `json:"endEpoch"`
+	DealID       filabi.DealID              `json:"dealID"` // on chain deal ID, 0 until the deal is published
+	State        string                     `json:"state"`
+	Engine       string                     `json:"engine,omitempty"`       // deal engine that made the deal, empty if proposed by the aggregator
+	Offline      bool                       `json:"offline,omitempty"`      // provider imports the exported aggregate instead of fetching it
+	Imported     bool                       `json:"imported,omitempty"`     // provider imported the data of the offline deal
+	AllocationID verifregtypes.AllocationId `json:"allocationID,omitempty"` // verified registry allocation of a directly onboarded deal
+	Transitions  []dealTransition           `json:"transitions"`
+}
+
+// A change of deal state observed by the aggregator
+type dealTransition struct {
+	State   string    `json:"state"`
+	At      time.Time `json:"at"`
+	Message string    `json:"message,omitempty"`
+}
+
+// Move the deal to state, recording the transition if the state changed
+func (d *dealRecord) setState(state string, message string) bool {
+	if d.State == state {
+		return false
+	}
+	d.State = state
+	if message != "" {
+		d.Message = message
+	}
+	d.Transitions = append(d.Transitions, dealTransition{State: state, At: time.Now(), Message: message})
+	return true
+}
+
+// Return true if the deal was in state at some point
+func (d *dealRecord) reached(state string) bool {
+	for _, t := range d.Transitions {
+		if t.State == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if the deal was active at some point
+func (d *dealRecord) wasActive() bool {
+	return d.reached(dealActive)
+}
+
+// Return true if the proposal did not result in a stored replica
+func (d *dealRecord) failed() bool {
+	return !d.Accepted || (isTerminalDealState(d.State) && !d.wasActive())
+}
+
+// Return the time of the last state change of the deal
+func (d *dealRecord) lastUpdate() time.Time {
+	if len(d.Transitions) == 0 {
+		return d.ProposedAt
+	}
+	return d.Transitions[len(d.Transitions)-1].At
+}
+
+// Return the number of proposals made to place the aggregate, not counting renewals
+func (r *aggregateRecord) placementAttempts() int {
+	var n int
+	for _, deal := range r.Deals {
+		if deal.Renews == uuid.Nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Return the number of distinct providers with a replica of the aggregate
+func (r *aggregateRecord) acceptedReplicas() int {
+	providers := make(map[address.Address]struct{})
+	for _, deal := range r.Deals {
+		if !deal.failed() {
+			providers[deal.Provider] = struct{}{}
+		}
+	}
+	return len(providers)
+}
+
+// stateStore is an embedded on-disk database holding everything the aggregator
+// needs to resume after a restart: pending offers, committed aggregates,
+// the next transfer ID and the deal UUIDs sent for each aggregate.
+type stateStore struct {
+	db *leveldb.DB
+	lk sync.Mutex // serializes read-modify-write updates of records
+}
+
+func openStateStore(path string) (*stateStore, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state db at %s: %w", path, err)
+	}
+	return &stateStore{db: db}, nil
+}
+
+func (s *stateStore) Close() error {
+	return s.db.Close()
+}
+
+func offerKey(ref offerRef) []byte {
+	return []byte(fmt.Sprintf("%s%010d/%020d", offerPrefix, ref.ChainID, ref.OfferID))
+}
+
+func aggregateKey(transferID int) []byte {
+	return []byte(fmt.Sprintf("%s%010d", aggregatePrefix, transferID))
+}
+
+func proofKey(ref offerRef) []byte {
+	return []byte(fmt.Sprintf("%s%010d/%020d", proofPrefix, ref.ChainID, ref.OfferID))
+}
+
+func (s *stateStore) putJSON(key []byte, v interface{}) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", key, err)
+	}
+	return s.db.Put(key, bs, nil)
+}
+
+// getJSON decodes the value at key into v, reporting false if the key does not exist
+func (s *stateStore) getJSON(key []byte, v interface{}) (bool, error) {
+	bs, err := s.db.Get(key, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(bs, v); err != nil {
+		return false, fmt.Errorf("failed to unmarshal %s: %w", key, err)
+	}
+	return true, nil
+}
+
+func (s *stateStore) putOffer(rec offerRecord) error {
+	return s.putJSON(offerKey(rec.Event.ref()), rec)
+}
+
+func (s *stateStore) getOffer(ref offerRef) (*offerRecord, bool, error) {
+	var rec offerRecord
+	found, err := s.getJSON(offerKey(ref), &rec)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	return &rec, true, nil
+}
+
+// Return all offers still awaiting aggregation in source chain and offer ID order
+func (s *stateStore) pendingOffers() ([]DataReadyEvent, error) {
+	var pending []DataReadyEvent
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(offerPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var rec offerRecord
+		if err := json.Unmarshal(iter.Value(), &rec); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal %s: %w", iter.Key(), err)
+		}
+		if rec.Status == offerPending {
+			pending = append(pending, rec.Event)
+		}
+	}
+	return pending, iter.Error()
+}
+
+// Atomically record an aggregate and the inclusion proofs of its offers, mark its
+// offers as aggregated and advance the next transfer ID past it
+func (s *stateStore) saveAggregate(rec aggregateRecord, events []DataReadyEvent, proofs []proofRecord) error {
+	batch := new(leveldb.Batch)
+	if err := batchProofs(batch, proofs); err != nil {
+		return err
+	}
+	bs, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal aggregate %d: %w", rec.TransferID, err)
+	}
+	batch.Put(aggregateKey(rec.TransferID), bs)
+	for _, event := range events {
+		bs, err := json.Marshal(offerRecord{
+			Event:      event,
+			Status:     offerAggregated,
+			TransferID: rec.TransferID,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal offer %d: %w", event.OfferID, err)
+		}
+		batch.Put(offerKey(event.ref()), bs)
+	}
+	batch.Put([]byte(transferIDKey), []byte(strconv.Itoa(rec.TransferID+1)))
+	return s.db.Write(batch, nil)
+}
+
+// Atomically settle the commit of an aggregate: record that it was committed with the
+// proofs of its offers, or remove it and return its offers to pending.
+func (s *stateStore) settleCommit(transferID int, committed bool, proofs []proofRecord) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	rec, found, err := s.getAggregate(transferID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no aggregate found for transfer ID %d", transferID)
+	}
+
+	batch := new(leveldb.Batch)
+	if !committed {
+		for _, offerID := range rec.OfferIDs {
+			ref := offerRef{ChainID: rec.ChainID, OfferID: offerID}
+			offer, found, err := s.getOffer(ref)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return fmt.Errorf("offer %d of transfer %d is not stored", offerID, transferID)
+			}
+			bs, err := json.Marshal(offerRecord{Event: offer.Event, Status: offerPending})
+			if err != nil {
+				return fmt.Errorf("failed to marshal offer %d: %w", offerID, err)
+			}
+			batch.Put(offerKey(ref), bs)
+		}
+		batch.Delete(aggregateKey(transferID))
+		return s.db.Write(batch, nil)
+	}
+	if err := batchProofs(batch, proofs); err != nil {
+		return err
+	}
+	rec.Committed = true
+	bs, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal aggregate %d: %w", transferID, err)
+	}
+	batch.Put(aggregateKey(transferID), bs)
+	return s.db.Write(batch, nil)
+}
+
+func batchProofs(batch *leveldb.Batch, proofs []proofRecord) error {
+	for _, proof := range proofs {
+		bs, err := json.Marshal(proof)
+		if err != nil {
+			return fmt.Errorf("failed to marshal proof of offer %d: %w", proof.OfferID, err)
+		}
+		batch.Put(proofKey(offerRef{ChainID: proof.ChainID, OfferID: proof.OfferID}), bs)
+	}
+	return nil
+}
+
+func (s *stateStore) putProofs(proofs []proofRecord) error {
+	batch := new(leveldb.Batch)
+	if err := batchProofs(batch, proofs); err != nil {
+		return err
+	}
+	return s.db.Write(batch, nil)
+}
+
+func (s *stateStore) getProof(ref offerRef) (*proofRecord, bool, error) {
+	var proof proofRecord
+	found, err := s.getJSON(proofKey(ref), &proof)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	return &proof, true, nil
+}
+
+func (s *stateStore) getAggregate(transferID int) (*aggregateRecord, bool, error) {
+	var rec aggregateRecord
+	found, err := s.getJSON(aggregateKey(transferID), &rec)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	return &rec, true, nil
+}
+
+// Return all committed aggregates in transfer ID order
+func (s *stateStore) aggregates() ([]aggregateRecord, error) {
+	var recs []aggregateRecord
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(aggregatePrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var rec aggregateRecord
+		if err := json.Unmarshal(iter.Value(), &rec); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal %s: %w", iter.Key(), err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, iter.Error()
+}
+
+// Apply update to the stored aggregate and write it back
+func (s *stateStore) updateAggregate(transferID int, update func(rec *aggregateRecord)) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	rec, found, err := s.getAggregate(transferID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no aggregate found for transfer ID %d", transferID)
+	}
+	update(rec)
+	return s.putJSON(aggregateKey(transferID), rec)
+}
+
+func (s *stateStore) addDeal(transferID int, deal dealRecord) error {
+	return s.updateAggregate(transferID, func(rec *aggregateRecord) {
+		rec.Deals = append(rec.Deals, deal)
+	})
+}
+
+func (s *stateStore) nextTransferID() (int, error) {
+	bs, err := s.db.Get([]byte(transferIDKey), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(bs))
+}
+
+// Return the block of the source chain to resume event scanning from, 0 if none was recorded
+func (s *stateStore) checkpoint(chainID int) (uint64, error) {
+	bs, err := s.db.Get([]byte(checkpointKey+strconv.Itoa(chainID)), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(bs), 10, 64)
+}
+
+func (s *stateStore) putCheckpoint(chainID int, block uint64) error {
+	return s.db.Put([]byte(checkpointKey+strconv.Itoa(chainID)), []byte(strconv.FormatUint(block, 10)), nil)
+}
+
+// Return the destination chain block to resume scanning deal notifications from
+func (s *stateStore) notifyCheckpoint() (uint64, bool, error) {
+	bs, err := s.db.Get([]byte(notifyKey), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	block, err := strconv.ParseUint(string(bs), 10, 64)
+	return block, err == nil, err
+}
+
+func (s *stateStore) putNotifyCheckpoint(block uint64) error {
+	return s.db.Put([]byte(notifyKey), []byte(strconv.FormatUint(block, 10)), nil)
+}
@@ -0,0 +1,115 @@
+package aggregator
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/filecoin-project/go-address"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func testEvent(id uint64) DataReadyEvent {
+	return DataReadyEvent{
+		OfferID: id,
+		Offer: Offer{
+			CommP:    []byte{0x01, 0x02},
+			Size:     128,
+			Location: "http://localhost:5077/get?id=1",
+			Amount:   big.NewInt(1000),
+			Token:    common.HexToAddress("0x5c31e78f3f7329769734f5ff1ac7e22c243e817e"),
+		},
+	}
+}
+
+// Test that state written before closing the store is restored after reopening it
+func TestStateStoreRestore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openStateStore(dir)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+
+	for _, id := range []uint64{3, 1, 2} {
+		assert.NoError(t, store.putOffer(offerRecord{Event: testEvent(id), Status: offerPending}))
+	}
+	assert.NoError(t, store.saveAggregate(aggregateRecord{
+		TransferID: 0,
+		DealSize:   2048,
+		OfferIDs:   []uint64{1},
+		Locations:  []string{testEvent(1).Offer.Location},
+	}, []DataReadyEvent{testEvent(1)}, nil))
+	provider, err := address.NewFromString("t017840")
+	assert.NoError(t, err)
+	deal := dealRecord{Provider: provider, DealUUID: uuid.New(), Accepted: true}
+	assert.NoError(t, store.addDeal(0, deal))
+	assert.NoError(t, store.Close())
+
+	store, err = openStateStore(dir)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.Close()
+
+	pending, err := store.pendingOffers()
+	assert.NoError(t, err)
+	if assert.Len(t, pending, 2) {
+		assert.Equal(t, uint64(2), pending[0].OfferID)
+		assert.Equal(t, uint64(3), pending[1].OfferID)
+		assert.Equal(t, big.NewInt(1000), pending[0].Offer.Amount)
+	}
+
+	rec, found, err := store.getOffer(offerRef{OfferID: 1})
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, offerAggregated, rec.Status)
+
+	next, err := store.nextTransferID()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, next)
+
+	aggs, err := store.aggregates()
+	assert.NoError(t, err)
+	if assert.Len(t, aggs, 1) {
+		if assert.Len(t, aggs[0].Deals, 1) {
+			assert.Equal(t, deal.DealUUID, aggs[0].Deals[0].DealUUID)
+			assert.Equal(t, provider, aggs[0].Deals[0].Provider)
+		}
+		assert.Equal(t, 1, aggs[0].acceptedReplicas())
+		assert.Equal(t, uint64(2048), aggs[0].DealSize)
+	}
+}
+
+// Test that offers and checkpoints of different source chains are kept apart
+func TestStateStoreChains(t *testing.T) {
+	store, err := openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	other := testEvent(1)
+	other.ChainID = 314159
+	assert.NoError(t, store.putOffer(offerRecord{Event: testEvent(1), Status: offerPending}))
+	assert.NoError(t, store.putOffer(offerRecord{Event: other, Status: offerRejected}))
+
+	rec, found, err := store.getOffer(offerRef{OfferID: 1})
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, offerPending, rec.Status)
+	rec, found, err = store.getOffer(other.ref())
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, offerRejected, rec.Status)
+
+	assert.NoError(t, store.putCheckpoint(314159, 42))
+	block, err := store.checkpoint(314159)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), block)
+	block, err = store.checkpoint(0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), block)
+
+	assert.Equal(t, "314159", dealLabel(314159))
+}
@@ -0,0 +1,359 @@
+package aggregator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	boosttypes "github.com/filecoin-project/boost/storagemarket/types"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/api"
+	lotustypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/google/uuid"
+)
+
+// States of a deal as observed by the deal tracker
+const (
+	dealAccepted     = "accepted"     // proposal accepted by the provider
+	dealTransferring = "transferring" // provider is fetching the aggregate
+	dealSealing      = "sealing"      // data received, deal being published and sealed
+	dealActive       = "active"       // deal is in a proven sector
+	dealSlashed      = "slashed"      // sector holding the deal was terminated
+	dealExpired      = "expired"      // deal reached its end epoch or never started
+	dealFailed       = "failed"       // provider reported an error
+	dealRejected     = "rejected"     // proposal was not accepted
+)
+
+// Boost deal checkpoints, see boost storagemarket/types/dealcheckpoints
+const (
+	checkpointAccepted = "Accepted"
+)
+
+const (
+	// epochs scanned for deal notifications when no checkpoint exists, one day of Filecoin blocks
+	notifyLookback = 2880
+	// max number of epochs per eth_getLogs query, Lotus rejects larger ranges
+	notifyLogsRange = 2000
+)
+
+// Reads the prover's DealNotify events on the destination chain
+type notifyClient interface {
+	ethereum.LogFilterer
+	ethereum.BlockNumberReader
+}
+
+// Return true if the deal will not change state anymore
+func isTerminalDealState(state string) bool {
+	switch state {
+	case dealSlashed, dealExpired, dealFailed, dealRejected:
+		return true
+	}
+	return false
+}
+
+// Map a boost deal status response to a deal state. The chain deal ID is
+// returned once the deal has been published. A response error means the status
+// is unknown, e.g. boost could not verify the request signature of our contract client.
+func boostDealState(resp *boosttypes.DealStatusResponse) (string, filabi.DealID, string) {
+	if resp.Error != "" {
+		return "", 0, resp.Error
+	}
+	if resp.DealStatus == nil {
+		return "", 0, ""
+	}
+	if resp.DealStatus.Error != "" {
+		return dealFailed, 0, resp.DealStatus.Error
+	}
+	if resp.DealStatus.Status == checkpointAccepted {
+		if resp.NBytesReceived > 0 && resp.NBytesReceived < resp.TransferSize {
+			return dealTransferring, 0, ""
+		}
+		return dealAccepted, 0, ""
+	}
+	return dealSealing, resp.DealStatus.ChainDealID, resp.DealStatus.SealingStatus
+}
+
+// Map the market actor state of a published deal to a deal state at the given head
+func marketDealState(md *api.MarketDeal, head filabi.ChainEpoch) string {
+	switch {
+	case md.State.SlashEpoch > 0:
+		return dealSlashed
+	case head > md.Proposal.EndEpoch:
+		return dealExpired
+	case md.State.SectorStartEpoch > 0:
+		return dealActive
+	case head > md.Proposal.StartEpoch:
+		// Deals not in a sector by their start epoch are never activated
+		return dealExpired
+	}
+	return dealSealing
+}
+
+// Ask the provider for the status of a deal over the boost deal status protocol
+func (a *aggregator) dealStatus(ctx context.Context, sp storageProvider, dealUUID uuid.UUID) (*boosttypes.DealStatusResponse, error) {
+	if err := a.host.Connect(ctx, *sp.peer); err != nil {
+		return nil, fmt.Errorf("failed to connect to peer %s: %w", sp.peer.ID, err)
+	}
+	s, err := a.host.NewStream(ctx, sp.peer.ID, DealStatusProtocolv120)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	req := boosttypes.DealStatusRequest{
+		DealUUID: dealUUID,
+		// Signature is unchecked since client is smart contract
+		Signature: crypto.Signature{
+			Type: crypto.SigTypeBLS,
+			Data: []byte{0xc0, 0xff, 0xee},
+		},
+	}
+	var resp boosttypes.DealStatusResponse
+	if err := doRpc(ctx, s, &req, &resp); err != nil {
+		return nil, fmt.Errorf("deal status rpc: %w", err)
+	}
+	return &resp, nil
+}
+
+// Periodically follow every live deal until it reaches a terminal state,
+// re-propose aggregates whose deals failed and renew deals about to expire
+func (a *aggregator) trackDeals(ctx context.Context) error {
+	ticker := time.NewTicker(dealTrackInterval)
+	defer ticker.Stop()
+	for {
+		if err := a.updateDeals(ctx); err != nil {
+			log.Printf("[ERROR] failed to update deal states: %s", err)
+		}
+		if err := a.retryDeals(ctx); err != nil {
+			log.Printf("[ERROR] failed to retry deals: %s", err)
+		}
+		if err := a.renewDeals(ctx); err != nil {
+			log.Printf("[ERROR] failed to renew deals: %s", err)
+		}
+		if err := a.cleanupStaged(); err != nil {
+			log.Printf("[ERROR] failed to clean up staged aggregates: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Query the state of every live deal and record the transitions
+func (a *aggregator) updateDeals(ctx context.Context) error {
+	tipset, err := a.lotusAPI.ChainHead(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get chain head: %w", err)
+	}
+	head := tipset.Height()
+
+	// Boost has no status for deals of the prover, their IDs come from its notifications
+	if a.notifyClient != nil {
+		if err := a.scanDealNotifications(ctx); err != nil {
+			log.Printf("[ERROR] failed to scan deal notifications: %s", err)
+		}
+	}
+
+	aggs, err := a.store.aggregates()
+	if err != nil {
+		return err
+	}
+	for _, agg := range aggs {
+		if a.dealEngine != nil && agg.DealEngineCID != "" {
+			if err := a.updateEngineDeals(ctx, agg); err != nil {
+				return fmt.Errorf("failed to persist deal engine deals of aggregate %d: %w", agg.TransferID, err)
+			}
+			rec, _, err := a.store.getAggregate(agg.TransferID)
+			if err != nil {
+				return err
+			}
+			agg = *rec
+		}
+		for i, deal := range agg.Deals {
+			// Deals made by the deal engine are followed through it until published
+			if !deal.Accepted || isTerminalDealState(deal.State) || (deal.Engine != "" && deal.DealID == 0) {
+				continue
+			}
+			state, dealID, message := a.queryDeal(ctx, deal, head)
+			if state == "" || (state == deal.State && dealID == deal.DealID) {
+				continue
+			}
+			err := a.store.updateAggregate(agg.TransferID, func(rec *aggregateRecord) {
+				d := &rec.Deals[i]
+				if dealID != 0 {
+					d.DealID = dealID
+				}
+				if d.setState(state, message) {
+					log.Printf("Deal %s with %s for aggregate %s is %s", d.DealUUID, d.Provider, rec.AggCommP, state)
+				}
+			})
+			if err != nil {
+				return fmt.Errorf("failed to persist state of deal %s: %w", deal.DealUUID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Record the deal ID of every DealNotify event emitted by the prover since the checkpoint
+func (a *aggregator) scanDealNotifications(ctx context.Context) error {
+	head, err := a.notifyClient.BlockNumber(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get destination chain head: %w", err)
+	}
+	from, found, err := a.store.notifyCheckpoint()
+	if err != nil {
+		return err
+	}
+	if !found {
+		from = 0
+		if head > notifyLookback {
+			from = head - notifyLookback
+		}
+	}
+
+	for from <= head {
+		to := min(from+notifyLogsRange-1, head)
+		logs, err := a.notifyClient.FilterLogs(ctx, ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(from),
+			ToBlock:   new(big.Int).SetUint64(to),
+			Addresses: []common.Address{a.proverAddr},
+			Topics:    [][]common.Hash{{a.dealNotify.ID}},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to filter prover logs in blocks %d-%d: %w", from, to, err)
+		}
+		for _, l := range logs {
+			fields, err := a.dealNotify.Inputs.Unpack(l.Data)
+			if err != nil || len(fields) == 0 {
+				log.Printf("[ERROR] failed to unpack DealNotify event in tx %s: %v", l.TxHash.Hex(), err)
+				continue
+			}
+			dealID, ok := fields[0].(uint64)
+			if !ok {
+				log.Printf("[ERROR] unexpected deal ID %v in DealNotify event in tx %s", fields[0], l.TxHash.Hex())
+				continue
+			}
+			if err := a.recordDealID(ctx, filabi.DealID(dealID)); err != nil {
+				return err
+			}
+		}
+		if err := a.store.putNotifyCheckpoint(to + 1); err != nil {
+			return fmt.Errorf("failed to persist deal notification checkpoint: %w", err)
+		}
+		from = to + 1
+	}
+	return nil
+}
+
+// Set the ID of a published deal on the proposal it was made from, matched on
+// piece, provider and start epoch. Deals of other aggregators are ignored.
+func (a *aggregator) recordDealID(ctx context.Context, dealID filabi.DealID) error {
+	md, err := a.lotusAPI.StateMarketStorageDeal(ctx, dealID, lotustypes.EmptyTSK)
+	if err != nil {
+		log.Printf("[ERROR] failed to get market state of notified deal %d: %s", dealID, err)
+		return nil
+	}
+	aggs, err := a.store.aggregates()
+	if err != nil {
+		return err
+	}
+	for _, agg := range aggs {
+		if !agg.AggCommP.Equals(md.Proposal.PieceCID) {
+			continue
+		}
+		for i, deal := range agg.Deals {
+			if deal.DealID != 0 || deal.AllocationID != 0 || deal.Engine != "" || !deal.Accepted || isTerminalDealState(deal.State) ||
+				deal.Provider != md.Proposal.Provider || deal.StartEpoch != md.Proposal.StartEpoch {
+				continue
+			}
+			err := a.store.updateAggregate(agg.TransferID, func(rec *aggregateRecord) {
+				rec.Deals[i].DealID = dealID
+			})
+			if err != nil {
+				return fmt.Errorf("failed to persist ID of deal %s: %w", deal.DealUUID, err)
+			}
+			log.Printf("Deal %s with %s for aggregate %s was published as deal %d", deal.DealUUID, deal.Provider, agg.AggCommP, dealID)
+			return nil
+		}
+	}
+	return nil
+}
+
+// Return the current state of a deal, asking the provider until the deal is
+// published and the market actor afterwards. Directly onboarded deals are followed
+// through the verified registry. An empty state means unknown.
+func (a *aggregator) queryDeal(ctx context.Context, deal dealRecord, head filabi.ChainEpoch) (string, filabi.DealID, string) {
+	if deal.AllocationID != 0 {
+		return a.queryAllocation(ctx, deal, head)
+	}
+	dealID := deal.DealID
+	if dealID == 0 {
+		// Deals not published by their start epoch never will be, whatever the provider reports
+		if deal.StartEpoch > 0 && head > deal.StartEpoch {
+			return dealExpired, 0, "deal was not published before its start epoch"
+		}
+		sp, err := a.providerFor(ctx, deal.Provider)
+		if err != nil {
+			log.Printf("[ERROR] cannot resolve provider %s of deal %s: %s", deal.Provider, deal.DealUUID, err)
+			return "", 0, ""
+		}
+		resp, err := a.dealStatus(ctx, sp, deal.DealUUID)
+		if err != nil {
+			log.Printf("[ERROR] failed to get status of deal %s from %s: %s", deal.DealUUID, deal.Provider, err)
+			return "", 0, ""
+		}
+		var state, message string
+		state, dealID, message = boostDealState(resp)
+		if state == "" {
+			log.Printf("[ERROR] provider %s has no status for deal %s: %s", deal.Provider, deal.DealUUID, message)
+			return "", 0, ""
+		}
+		if dealID == 0 {
+			return state, 0, message
+		}
+	}
+
+	md, err := a.lotusAPI.StateMarketStorageDeal(ctx, dealID, lotustypes.EmptyTSK)
+	if err != nil {
+		// Deals are removed from market state once they expire
+		if deal.EndEpoch > 0 && head > deal.EndEpoch {
+			return dealExpired, dealID, ""
+		}
+		log.Printf("[ERROR] failed to get market state of deal %d: %s", dealID, err)
+		return dealSealing, dealID, ""
+	}
+	return marketDealState(md, head), dealID, ""
+}
+
+// Serve the deals of every aggregate as JSON
+func (a *aggregator) dealsHandler(w http.ResponseWriter, r *http.Request) {
+	aggs, err := a.store.aggregates()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type aggregateDeals struct {
+		TransferID int          `json:"transferID"`
+		AggCommP   string       `json:"aggCommP"`
+		Committed  bool         `json:"committed"`
+		Deals      []dealRecord `json:"deals"`
+	}
+	out := make([]aggregateDeals, 0, len(aggs))
+	for _, agg := range aggs {
+		out = append(out, aggregateDeals{TransferID: agg.TransferID, AggCommP: agg.AggCommP.String(), Committed: agg.Committed, Deals: agg.Deals})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Printf("failed to write deals: %v", err)
+	}
+}
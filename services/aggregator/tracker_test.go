@@ -0,0 +1,125 @@
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/FIL-Builders/xchainClient/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	boosttypes "github.com/filecoin-project/boost/storagemarket/types"
+	"github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/v0api"
+	lotustypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// Lotus stand-in serving market deals
+type fakeMarket struct {
+	v0api.FullNode
+	deals map[filabi.DealID]*api.MarketDeal
+}
+
+func (f *fakeMarket) StateMarketStorageDeal(ctx context.Context, dealID filabi.DealID, tsk lotustypes.TipSetKey) (*api.MarketDeal, error) {
+	if md, ok := f.deals[dealID]; ok {
+		return md, nil
+	}
+	return nil, fmt.Errorf("deal %d not found", dealID)
+}
+
+func TestBoostDealState(t *testing.T) {
+	tests := []struct {
+		resp   boosttypes.DealStatusResponse
+		state  string
+		dealID filabi.DealID
+	}{
+		{boosttypes.DealStatusResponse{Error: "no such deal"}, "", 0},
+		{boosttypes.DealStatusResponse{DealStatus: &boosttypes.DealStatus{Status: "Accepted"}}, dealAccepted, 0},
+		{boosttypes.DealStatusResponse{DealStatus: &boosttypes.DealStatus{Status: "Accepted"}, TransferSize: 100, NBytesReceived: 10}, dealTransferring, 0},
+		{boosttypes.DealStatusResponse{DealStatus: &boosttypes.DealStatus{Status: "Transferred"}}, dealSealing, 0},
+		{boosttypes.DealStatusResponse{DealStatus: &boosttypes.DealStatus{Status: "AddedPiece", ChainDealID: 42}}, dealSealing, 42},
+		{boosttypes.DealStatusResponse{DealStatus: &boosttypes.DealStatus{Status: "Complete", Error: "sector terminated"}}, dealFailed, 0},
+	}
+	for _, tt := range tests {
+		state, dealID, _ := boostDealState(&tt.resp)
+		assert.Equal(t, tt.state, state)
+		assert.Equal(t, tt.dealID, dealID)
+	}
+}
+
+func TestMarketDealState(t *testing.T) {
+	deal := func(sectorStart, slash filabi.ChainEpoch) *api.MarketDeal {
+		return &api.MarketDeal{
+			Proposal: market.DealProposal{StartEpoch: 100, EndEpoch: 1000},
+			State:    api.MarketDealState{SectorStartEpoch: sectorStart, LastUpdatedEpoch: -1, SlashEpoch: slash},
+		}
+	}
+	assert.Equal(t, dealSealing, marketDealState(deal(-1, -1), 50))
+	assert.Equal(t, dealExpired, marketDealState(deal(-1, -1), 150))
+	assert.Equal(t, dealActive, marketDealState(deal(90, -1), 150))
+	assert.Equal(t, dealSlashed, marketDealState(deal(90, 200), 250))
+	assert.Equal(t, dealExpired, marketDealState(deal(90, -1), 1001))
+}
+
+func TestDealNotifications(t *testing.T) {
+	store, err := openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	proverABI, err := utils.LoadAbi("../../config/prover-abi.json")
+	if err != nil {
+		t.Fatalf("failed to load abi: %v", err)
+	}
+	event := proverABI.Events["DealNotify"]
+	notify := func(block uint64, dealID uint64) types.Log {
+		data, err := event.Inputs.Pack(dealID, []byte{}, []byte{}, []byte{}, uint64(1000))
+		assert.NoError(t, err)
+		return types.Log{BlockNumber: block, Topics: []common.Hash{event.ID}, Data: data}
+	}
+
+	aggCommp := testAggCommp(t, 1)
+	p1, _ := address.NewIDAddress(1000)
+	p2, _ := address.NewIDAddress(1001)
+	rec := aggregateRecord{TransferID: 1, AggCommP: aggCommp, Deals: []dealRecord{
+		{Provider: p1, DealUUID: uuid.New(), Accepted: true, State: dealTransferring, StartEpoch: 4000},
+		{Provider: p2, DealUUID: uuid.New(), Accepted: true, State: dealTransferring, StartEpoch: 4000},
+	}}
+	assert.NoError(t, store.saveAggregate(rec, nil, nil))
+	lotus := &fakeMarket{deals: map[filabi.DealID]*api.MarketDeal{
+		7: {Proposal: market.DealProposal{PieceCID: aggCommp, Provider: p1, StartEpoch: 4000}},
+		8: {Proposal: market.DealProposal{PieceCID: testAggCommp(t, 2), Provider: p2, StartEpoch: 4000}},
+		9: {Proposal: market.DealProposal{PieceCID: aggCommp, Provider: p2, StartEpoch: 3000}},
+	}}
+	// Notifications before the lookback are not scanned
+	client := &fakeChainClient{head: 5000, logs: []types.Log{notify(100, 7), notify(2500, 8), notify(3000, 9), notify(4900, 42)}}
+	a := &aggregator{store: store, lotusAPI: lotus, notifyClient: client, dealNotify: event}
+
+	ctx := context.Background()
+	assert.NoError(t, a.scanDealNotifications(ctx))
+	saved, _, _ := store.getAggregate(rec.TransferID)
+	assert.Zero(t, saved.Deals[0].DealID)
+	assert.Zero(t, saved.Deals[1].DealID)
+	checkpoint, found, err := store.notifyCheckpoint()
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.EqualValues(t, 5001, checkpoint)
+
+	// Deals are matched on piece, provider and start epoch
+	client.logs = append(client.logs, notify(5010, 7))
+	client.setHead(5020)
+	assert.NoError(t, a.scanDealNotifications(ctx))
+	saved, _, _ = store.getAggregate(rec.TransferID)
+	assert.EqualValues(t, 7, saved.Deals[0].DealID)
+	assert.Zero(t, saved.Deals[1].DealID)
+
+	// Unpublished deals expire after their start epoch without asking the provider
+	state, dealID, _ := a.queryDeal(ctx, saved.Deals[1], 4001)
+	assert.Equal(t, dealExpired, state)
+	assert.Zero(t, dealID)
+}
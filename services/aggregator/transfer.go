@@ -0,0 +1,181 @@
+package aggregator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/filecoin-project/go-data-segment/datasegment"
+)
+
+// A part of an aggregate at an unpadded offset, either a sub piece read from its
+// buffer location or the data segment index. Parts are zero padded to their length
+// and the gaps between them are zeros.
+type aggregatePart struct {
+	offset uint64
+	length uint64
+	url    string // buffer location of a sub piece
+	data   []byte // contents of the index
+}
+
+func (p aggregatePart) end() uint64 {
+	return p.offset + p.length
+}
+
+// Layout of an aggregate as written by datasegment.Aggregate.AggregateObjectReader
+type aggregateLayout struct {
+	size  uint64          // unpadded size of the aggregate
+	parts []aggregatePart // ascending by offset, not overlapping
+}
+
+func newAggregateLayout(agg *datasegment.Aggregate, locations []string) (*aggregateLayout, error) {
+	if len(locations) != len(agg.Index.Entries) {
+		return nil, fmt.Errorf("aggregate has %d sub pieces but %d locations", len(agg.Index.Entries), len(locations))
+	}
+	layout := &aggregateLayout{size: uint64(agg.DealSize.Unpadded())}
+	for i, entry := range agg.Index.Entries {
+		layout.parts = append(layout.parts, aggregatePart{
+			offset: entry.UnpaddedOffest(),
+			length: entry.UnpaddedLength(),
+			url:    locations[i],
+		})
+	}
+	indexReader, err := agg.IndexReader()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create index reader: %w", err)
+	}
+	index, err := io.ReadAll(indexReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	indexStart, err := agg.IndexStartPosition()
+	if err != nil {
+		return nil, err
+	}
+	layout.parts = append(layout.parts, aggregatePart{offset: indexStart, length: uint64(len(index)), data: index})
+
+	for i, part := range layout.parts {
+		if part.end() > layout.size || (i > 0 && part.offset < layout.parts[i-1].end()) {
+			return nil, fmt.Errorf("part %d at [%d, %d) does not fit the aggregate layout", i, part.offset, part.end())
+		}
+	}
+	return layout, nil
+}
+
+// Return the index of the part containing offset, or of the first part after it
+// with contains false. The index is len(parts) past the last part.
+func (l *aggregateLayout) partAt(offset uint64) (int, bool) {
+	i := sort.Search(len(l.parts), func(i int) bool { return l.parts[i].end() > offset })
+	return i, i < len(l.parts) && l.parts[i].offset <= offset
+}
+
+// Reads an aggregate at any offset without assembling it. Sequential reads stream each
+// sub piece with a single request, reads after a seek request the sub piece from the
+// new offset with a Range header.
+type aggregateReader struct {
+	ctx      context.Context
+	fetcher  *pieceFetcher
+	layout   *aggregateLayout
+	pos      uint64
+	body     io.ReadCloser // stream of the sub piece part bodyPart from bodyPos
+	bodyPart int
+	bodyPos  uint64
+}
+
+func newAggregateReader(ctx context.Context, fetcher *pieceFetcher, layout *aggregateLayout) *aggregateReader {
+	return &aggregateReader{ctx: ctx, fetcher: fetcher, layout: layout}
+}
+
+func (r *aggregateReader) Read(p []byte) (int, error) {
+	if r.pos >= r.layout.size {
+		return 0, io.EOF
+	}
+	if remaining := r.layout.size - r.pos; uint64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	i, contains := r.layout.partAt(r.pos)
+	if !contains {
+		// Zeros up to the next part
+		next := r.layout.size
+		if i < len(r.layout.parts) {
+			next = r.layout.parts[i].offset
+		}
+		if uint64(len(p)) > next-r.pos {
+			p = p[:next-r.pos]
+		}
+		clear(p)
+		r.pos += uint64(len(p))
+		return len(p), nil
+	}
+
+	part := r.layout.parts[i]
+	if uint64(len(p)) > part.end()-r.pos {
+		p = p[:part.end()-r.pos]
+	}
+	if part.url == "" {
+		n := copy(p, part.data[r.pos-part.offset:])
+		r.pos += uint64(n)
+		return n, nil
+	}
+	if r.body == nil || r.bodyPart != i || r.bodyPos != r.pos {
+		r.closeBody()
+		body := r.fetcher.open(r.ctx, pieceSource{url: part.url, limit: part.length}, r.pos-part.offset)
+		r.body, r.bodyPart, r.bodyPos = body, i, r.pos
+	}
+	n, err := io.ReadFull(r.body, p)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		// The sub piece ended, the rest of its part is padding
+		r.body.Close()
+		r.body = io.NopCloser(zeroReader{})
+		clear(p[n:])
+		n, err = len(p), nil
+	}
+	if err != nil {
+		r.closeBody()
+		return n, fmt.Errorf("failed to read sub piece from %s: %w", part.url, err)
+	}
+	r.pos += uint64(n)
+	r.bodyPos = r.pos
+	return n, nil
+}
+
+func (r *aggregateReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = int64(r.pos) + offset
+	case io.SeekEnd:
+		pos = int64(r.layout.size) + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position %d", pos)
+	}
+	r.pos = uint64(pos)
+	return pos, nil
+}
+
+func (r *aggregateReader) Close() error {
+	r.closeBody()
+	return nil
+}
+
+func (r *aggregateReader) closeBody() {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+}
+
+// Endless stream of zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,89 @@
+package aggregator
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/filecoin-project/go-data-segment/datasegment"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferRanges(t *testing.T) {
+	// The first sub piece is shorter than its part and served with range support,
+	// the second fills its part and is served by a buffer ignoring ranges
+	rng := rand.New(rand.NewSource(1))
+	first := make([]byte, 1000)
+	second := make([]byte, filabi.PaddedPieceSize(4096).Unpadded())
+	rng.Read(first)
+	rng.Read(second)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/first", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(first))
+	})
+	mux.HandleFunc("/second", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(second)
+	})
+	buffer := httptest.NewServer(mux)
+	defer buffer.Close()
+
+	agg, err := datasegment.NewAggregate(filabi.PaddedPieceSize(1<<20), []filabi.PieceInfo{
+		{Size: 2048, PieceCID: testAggCommp(t, 1)},
+		{Size: 4096, PieceCID: testAggCommp(t, 2)},
+	})
+	if err != nil {
+		t.Fatalf("failed to create aggregate: %v", err)
+	}
+	objectReader, err := agg.AggregateObjectReader([]io.Reader{bytes.NewReader(first), bytes.NewReader(second)})
+	if err != nil {
+		t.Fatalf("failed to create aggregate reader: %v", err)
+	}
+	expected, err := io.ReadAll(objectReader)
+	if err != nil {
+		t.Fatalf("failed to read aggregate: %v", err)
+	}
+	aggCommp, err := agg.PieceCID()
+	if err != nil {
+		t.Fatalf("failed to get commp: %v", err)
+	}
+
+	a := &aggregator{
+		stagingPath: t.TempDir(),
+		fetcher:     newPieceFetcher(config.PieceFetchConfig{}, t.TempDir()),
+		transfers: map[int]AggregateTransfer{
+			1: {locations: []string{buffer.URL + "/first", buffer.URL + "/second"}, agg: agg},
+		},
+	}
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/?id=1", nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		a.transferHandler(w, req)
+		return w
+	}
+
+	w := get(nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, fmt.Sprint(len(expected)), w.Header().Get("Content-Length"))
+	assert.Equal(t, fmt.Sprintf("%q", aggCommp.String()), w.Header().Get("ETag"))
+	assert.True(t, bytes.Equal(expected, w.Body.Bytes()))
+
+	// Ranges within and across sub pieces, padding and the index
+	for _, r := range [][2]int{{0, 99}, {500, 3000}, {1500, 2100}, {2100, 6000}, {len(expected) - 5000, len(expected) - 1}} {
+		w := get(http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", r[0], r[1])}})
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		assert.True(t, bytes.Equal(expected[r[0]:r[1]+1], w.Body.Bytes()), "range %d-%d", r[0], r[1])
+	}
+
+	w = get(http.Header{"If-None-Match": {fmt.Sprintf("%q", aggCommp.String())}})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+}
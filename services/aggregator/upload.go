@@ -0,0 +1,87 @@
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/FIL-Builders/xchainClient/services/buffer"
+	"github.com/ipfs/go-cid"
+)
+
+// gateway aggregates uploaded to Lighthouse are fetched from
+const lighthouseGatewayURL = "https://gateway.lighthouse.storage"
+
+// AggregateUploader makes staged aggregates retrievable by storage providers
+type AggregateUploader interface {
+	// Upload the staged aggregate file and return the URL providers fetch it from,
+	// or an empty URL to have them fetch it from the transfer server
+	Upload(ctx context.Context, path string, aggCommp cid.Cid) (string, error)
+}
+
+func newAggregateUploader(cfg *config.Config) (AggregateUploader, error) {
+	backend := cfg.Upload.Backend
+	if backend == "" {
+		backend = "none"
+		if cfg.LighthouseApiKey != "" {
+			backend = "lighthouse"
+		}
+	}
+	switch backend {
+	case "lighthouse":
+		if cfg.LighthouseApiKey == "" {
+			return nil, fmt.Errorf("lighthouse upload requires LighthouseApiKey")
+		}
+		return &lighthouseUploader{apiKey: cfg.LighthouseApiKey}, nil
+	case "s3":
+		return newS3Uploader(cfg.Upload.S3)
+	case "ipfs":
+		if cfg.Upload.IPFS.ApiURL == "" || cfg.Upload.IPFS.GatewayURL == "" {
+			return nil, fmt.Errorf("ipfs upload requires Upload.IPFS.ApiURL and Upload.IPFS.GatewayURL")
+		}
+		return &ipfsUploader{apiURL: strings.TrimSuffix(cfg.Upload.IPFS.ApiURL, "/"), gatewayURL: strings.TrimSuffix(cfg.Upload.IPFS.GatewayURL, "/")}, nil
+	case "none":
+		return noUploader{}, nil
+	default:
+		return nil, fmt.Errorf("unknown upload backend %q, expected lighthouse, s3, ipfs or none", backend)
+	}
+}
+
+// Uploads aggregates to Lighthouse, providers fetch them from its gateway
+type lighthouseUploader struct {
+	apiKey string
+}
+
+func (u *lighthouseUploader) Upload(ctx context.Context, path string, aggCommp cid.Cid) (string, error) {
+	resp, err := buffer.UploadToLighthouse(ctx, path, u.apiKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload to lighthouse: %w", err)
+	}
+	log.Printf("Uploaded CAR size is %s", resp.Size)
+	return fmt.Sprintf("%s/ipfs/%s", lighthouseGatewayURL, resp.Hash), nil
+}
+
+// Adds aggregates to an IPFS node, providers fetch them from its gateway
+type ipfsUploader struct {
+	apiURL     string
+	gatewayURL string
+}
+
+func (u *ipfsUploader) Upload(ctx context.Context, path string, aggCommp cid.Cid) (string, error) {
+	params := url.Values{"cid-version": {"1"}, "raw-leaves": {"true"}, "pin": {"true"}}
+	resp, err := buffer.AddFile(ctx, u.apiURL+"/api/v0/add?"+params.Encode(), path, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to add to ipfs: %w", err)
+	}
+	return fmt.Sprintf("%s/ipfs/%s", u.gatewayURL, resp.Hash), nil
+}
+
+// Leaves aggregates with the transfer server
+type noUploader struct{}
+
+func (noUploader) Upload(ctx context.Context, path string, aggCommp cid.Cid) (string, error) {
+	return "", nil
+}
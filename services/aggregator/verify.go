@@ -0,0 +1,153 @@
+package aggregator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+)
+
+const (
+	// time allowed to fetch the data of an offer on top of transferring it at verifyMinRate
+	verifyTimeout = time.Minute
+	// slowest transfer of offer data in bytes per second before its verification times out
+	verifyMinRate = 1 << 20
+	// wait before fetching the data of an unavailable offer again, doubled on every further failure
+	verifyRetryBackoff = time.Minute
+	// upper bound of the wait before fetching the data of an unavailable offer again
+	verifyRetryMaxBackoff = time.Hour
+)
+
+// Verification failures caused by the data of an offer rather than by fetching it,
+// only these reject the offer
+var errDataMismatch = errors.New("offer data mismatch")
+
+// Results of checking the data of pending offers against their CommP
+type offerChecks struct {
+	verified map[offerRef]struct{}
+	failures map[offerRef]int       // failed fetches of offers whose data could not be fetched
+	retryAt  map[offerRef]time.Time // when the data of unavailable offers is fetched again
+}
+
+func newOfferChecks() *offerChecks {
+	return &offerChecks{
+		verified: make(map[offerRef]struct{}),
+		failures: make(map[offerRef]int),
+		retryAt:  make(map[offerRef]time.Time),
+	}
+}
+
+// Record a failed fetch of the offer data and back off before the next one
+func (c *offerChecks) fetchFailed(ref offerRef) time.Duration {
+	c.failures[ref]++
+	backoff := verifyRetryBackoff
+	for i := 1; i < c.failures[ref] && backoff < verifyRetryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, verifyRetryMaxBackoff)
+	c.retryAt[ref] = time.Now().Add(backoff)
+	return backoff
+}
+
+func (c *offerChecks) passed(ref offerRef) {
+	c.verified[ref] = struct{}{}
+	delete(c.failures, ref)
+	delete(c.retryAt, ref)
+}
+
+// Stream the offer's data from its location through a CommP calculator and
+// check that it matches the CommP and padded size claimed on chain. Errors
+// wrapping errDataMismatch are caused by the data, others by fetching it.
+func verifyOfferData(ctx context.Context, offer Offer) error {
+	piece, err := offer.Piece()
+	if err != nil {
+		return fmt.Errorf("%w: invalid piece: %s", errDataMismatch, err)
+	}
+
+	// Bound the fetch so a stalled buffer does not hold up aggregation
+	timeout := verifyTimeout + time.Duration(uint64(piece.Size.Unpadded())/verifyMinRate)*time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, offer.Location, nil)
+	if err != nil {
+		return fmt.Errorf("%w: invalid location %q: %s", errDataMismatch, offer.Location, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch data: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch data: %s", resp.Status)
+	}
+
+	// Read at most one byte more than fits in the piece to detect oversized data
+	maxSize := int64(piece.Size.Unpadded())
+	cp := new(commp.Calc)
+	n, err := io.Copy(cp, io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return fmt.Errorf("failed to read data: %w", err)
+	}
+	if n > maxSize {
+		return fmt.Errorf("%w: data exceeds the %d bytes of a %d byte piece", errDataMismatch, maxSize, piece.Size)
+	}
+	rawCommP, paddedSize, err := cp.Digest()
+	if err != nil {
+		return fmt.Errorf("failed to compute commp: %w", err)
+	}
+	commCid, err := commcid.DataCommitmentV1ToCID(rawCommP)
+	if err != nil {
+		return fmt.Errorf("failed to convert commp to cid: %w", err)
+	}
+	if !commCid.Equals(piece.PieceCID) {
+		return fmt.Errorf("%w: data commp %s does not match offer commp %s", errDataMismatch, commCid, piece.PieceCID)
+	}
+	if filabi.PaddedPieceSize(paddedSize) != piece.Size {
+		return fmt.Errorf("%w: data padded size %d does not match offer size %d", errDataMismatch, paddedSize, piece.Size)
+	}
+	return nil
+}
+
+// Verify the data of every offer not verified before. Offers whose data does not match
+// are recorded as rejected and returned first. Offers whose data cannot be fetched are
+// returned second, they stay pending and are fetched again after a backoff.
+func (a *aggregator) verifyOffers(ctx context.Context, events []DataReadyEvent, checks *offerChecks) ([]DataReadyEvent, []DataReadyEvent, error) {
+	var invalid, unavailable []DataReadyEvent
+	for _, event := range events {
+		if _, ok := checks.verified[event.ref()]; ok {
+			continue
+		}
+		if time.Now().Before(checks.retryAt[event.ref()]) {
+			unavailable = append(unavailable, event)
+			continue
+		}
+		log.Printf("Verifying data of offer %d at %s", event.OfferID, event.Offer.Location)
+		if err := verifyOfferData(ctx, event.Offer); err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			if !errors.Is(err, errDataMismatch) {
+				backoff := checks.fetchFailed(event.ref())
+				log.Printf("Offer %d stays pending, its data could not be fetched, retrying in %s: %s", event.OfferID, backoff, err)
+				unavailable = append(unavailable, event)
+				continue
+			}
+			log.Printf("Offer %d dropped, data verification failed: %s", event.OfferID, err)
+			reason := fmt.Sprintf("data verification failed: %s", err)
+			if err := a.store.putOffer(offerRecord{Event: event, Status: offerRejected, Reason: reason}); err != nil {
+				return nil, nil, fmt.Errorf("failed to persist rejected offer %d: %w", event.OfferID, err)
+			}
+			invalid = append(invalid, event)
+			continue
+		}
+		checks.passed(event.ref())
+	}
+	return invalid, unavailable, nil
+}
@@ -0,0 +1,105 @@
+package aggregator
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyOfferData(t *testing.T) {
+	data := bytes.Repeat([]byte("xchain"), 1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bogus" {
+			w.Write(bytes.Repeat([]byte("bogus!"), 1000))
+			return
+		}
+		if r.URL.Path == "/unavailable" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	cp := new(commp.Calc)
+	cp.Write(data)
+	rawCommP, paddedSize, err := cp.Digest()
+	if err != nil {
+		t.Fatalf("failed to compute commp: %v", err)
+	}
+	commCid, err := commcid.DataCommitmentV1ToCID(rawCommP)
+	if err != nil {
+		t.Fatalf("failed to convert commp: %v", err)
+	}
+
+	offer := Offer{CommP: commCid.Bytes(), Size: paddedSize, Location: srv.URL + "/data"}
+	assert.NoError(t, verifyOfferData(context.Background(), offer))
+
+	bogus := offer
+	bogus.Location = srv.URL + "/bogus"
+	assert.ErrorContains(t, verifyOfferData(context.Background(), bogus), "does not match")
+
+	small := offer
+	small.Size = paddedSize / 2
+	assert.ErrorContains(t, verifyOfferData(context.Background(), small), "exceeds")
+	assert.ErrorIs(t, verifyOfferData(context.Background(), small), errDataMismatch)
+
+	// Offers whose data cannot be fetched stay pending and are retried after a backoff
+	store, err := openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	a := &aggregator{store: store}
+	unavailable := offer
+	unavailable.Location = srv.URL + "/unavailable"
+	refused := offer
+	refused.Location = "http://127.0.0.1:1/data"
+	events := []DataReadyEvent{
+		{OfferID: 1, ChainID: 1, Offer: offer},
+		{OfferID: 2, ChainID: 1, Offer: bogus},
+		{OfferID: 3, ChainID: 1, Offer: unavailable},
+		{OfferID: 4, ChainID: 1, Offer: refused},
+	}
+	checks := newOfferChecks()
+	invalid, failed, err := a.verifyOffers(context.Background(), events, checks)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{2}, offerIDs(invalid))
+	assert.Equal(t, []uint64{3, 4}, offerIDs(failed))
+	rec, found, err := store.getOffer(offerRef{ChainID: 1, OfferID: 2})
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, offerRejected, rec.Status)
+	_, found, err = store.getOffer(offerRef{ChainID: 1, OfferID: 3})
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.WithinDuration(t, time.Now().Add(verifyRetryBackoff), checks.retryAt[events[2].ref()], time.Second)
+
+	// Offers in backoff are not fetched again, those that become available pass
+	unavailable.Location = srv.URL + "/data"
+	events[2].Offer = unavailable
+	_, failed, err = a.verifyOffers(context.Background(), events[2:3], checks)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{3}, offerIDs(failed))
+	checks.retryAt[events[2].ref()] = time.Now()
+	_, failed, err = a.verifyOffers(context.Background(), events[2:3], checks)
+	assert.NoError(t, err)
+	assert.Empty(t, failed)
+	assert.Contains(t, checks.verified, events[2].ref())
+	assert.NotContains(t, checks.failures, events[2].ref())
+
+	// The backoff doubles on every failure up to its upper bound
+	ref := events[3].ref()
+	assert.Equal(t, 2*verifyRetryBackoff, checks.fetchFailed(ref))
+	for i := 0; i < 10; i++ {
+		checks.fetchFailed(ref)
+	}
+	assert.Equal(t, verifyRetryMaxBackoff, checks.fetchFailed(ref))
+}
@@ -1,8 +1,9 @@
 package buffer
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
@@ -20,40 +21,46 @@ type UploadFileResponse struct {
 	Size string `json:"Size"`
 }
 
-func UploadToLighthouse(sourcePath, apiKey string) (*UploadFileResponse, error) {
+func UploadToLighthouse(ctx context.Context, sourcePath, apiKey string) (*UploadFileResponse, error) {
 	endpoint := lighthouseNodeURL + "/api/v0/add?wrap-with-directory=false"
+	return AddFile(ctx, endpoint, sourcePath, "Bearer "+apiKey)
+}
 
+// AddFile streams the file at sourcePath to the add endpoint of an IPFS HTTP API,
+// authorized with the given Authorization header if it is not empty
+func AddFile(ctx context.Context, endpoint, sourcePath, authorization string) (*UploadFileResponse, error) {
 	file, err := os.Open(sourcePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	part, err := writer.CreateFormFile("file", filepath.Base(sourcePath))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create form file: %w", err)
-	}
-
-	_, err = io.Copy(part, file)
-	if err != nil {
-		return nil, fmt.Errorf("failed to copy file content: %w", err)
-	}
-
-	err = writer.Close()
-	if err != nil {
-		return nil, fmt.Errorf("failed to close multipart writer: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", endpoint, body)
+	// Stream the form instead of buffering files of many GiB in memory
+	body, pw := io.Pipe()
+	defer body.Close()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		part, err := writer.CreateFormFile("file", filepath.Base(sourcePath))
+		if err != nil {
+			pw.CloseWithError(fmt.Errorf("failed to create form file: %w", err))
+			return
+		}
+		if _, err := io.Copy(part, file); err != nil {
+			pw.CloseWithError(fmt.Errorf("failed to copy file content: %w", err))
+			return
+		}
+		pw.CloseWithError(writer.Close())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
 
 	client := &http.Client{
 		Timeout: 2 * time.Hour,
@@ -69,10 +76,24 @@ func UploadToLighthouse(sourcePath, apiKey string) (*UploadFileResponse, error)
 		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 
+	// Nodes may report progress before the added file, the file comes last
 	var response UploadFileResponse
-	err = json.NewDecoder(resp.Body).Decode(&response)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var entry UploadFileResponse
+		err := decoder.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+		if entry.Hash != "" {
+			response = entry
+		}
+	}
+	if response.Hash == "" {
+		return nil, fmt.Errorf("response has no hash")
 	}
 
 	return &response, nil
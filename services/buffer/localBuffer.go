@@ -14,6 +14,7 @@ import (
 
 	"strconv"
 	"sync"
+	"time"
 )
 
 type BufferHTTPService struct {
@@ -119,5 +120,6 @@ func (s *BufferHTTPService) GetHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	io.Copy(w, file)
+	// Serve ranges so the aggregator can read sub pieces from any offset
+	http.ServeContent(w, r, "", time.Time{}, file)
 }
@@ -18,7 +18,6 @@ import (
 	"github.com/FIL-Builders/xchainClient/config"
 	"github.com/FIL-Builders/xchainClient/utils"
 	"github.com/ethereum/go-ethereum/accounts/abi"
-	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethclient"
@@ -116,7 +115,6 @@ func OfferFileAction(cctx *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to load ABI: %v", err)
 	}
-	onramp := bind.NewBoundContract(contractAddress, *parsedABI, client, client, client)
 	auth, err := utils.LoadPrivateKey(cfg, srcCfg.ChainID)
 	if err != nil {
 		return fmt.Errorf("failed to load private key: %v", err)
@@ -130,16 +128,12 @@ func OfferFileAction(cctx *cli.Context) error {
 	}
 
 	// Submit the offer transaction.
-	tx, err := onramp.Transact(auth, "offerData", offerObj)
+	txm := utils.NewTxManager(client, auth, srcCfg.Tx)
+	receipt, err := txm.Transact(cctx.Context, contractAddress, parsedABI, "offerData", offerObj)
 	if err != nil {
-		return fmt.Errorf("failed to send transaction: %v", err)
+		return fmt.Errorf("failed to send offer: %v", err)
 	}
-	log.Printf("Waiting for transaction: %s\n", tx.Hash().Hex())
-	receipt, err := bind.WaitMined(cctx.Context, client, tx)
-	if err != nil {
-		return fmt.Errorf("failed to wait for tx: %v", err)
-	}
-	log.Printf("Tx %s included: %d", tx.Hash().Hex(), receipt.Status)
+	log.Printf("Tx %s included in block %d", receipt.TxHash.Hex(), receipt.BlockNumber)
 	return nil
 }
 
@@ -168,10 +162,6 @@ func OfferCarAction(cctx *cli.Context) error {
 	if err != nil {
 		log.Fatal(err)
 	}
-	onramp := bind.NewBoundContract(contractAddress, *parsedABI, client, client, client)
-	if err != nil {
-		log.Fatal(err)
-	}
 
 	// Get auth
 	auth, err := utils.LoadPrivateKey(cfg, srcCfg.ChainID)
@@ -193,17 +183,12 @@ func OfferCarAction(cctx *cli.Context) error {
 	if err != nil {
 		log.Fatalf("failed to pack offer data params: %v", err)
 	}
-	tx, err := onramp.Transact(auth, "offerData", offer)
-	if err != nil {
-		log.Fatalf("failed to send tx: %v", err)
-	}
-
-	log.Printf("Waiting for transaction: %s\n", tx.Hash().Hex())
-	receipt, err := bind.WaitMined(cctx.Context, client, tx)
+	txm := utils.NewTxManager(client, auth, srcCfg.Tx)
+	receipt, err := txm.Transact(cctx.Context, contractAddress, parsedABI, "offerData", offer)
 	if err != nil {
-		log.Fatalf("failed to wait for tx: %v", err)
+		log.Fatalf("failed to send offer: %v", err)
 	}
-	log.Printf("Tx %s included: %d", tx.Hash().Hex(), receipt.Status)
+	log.Printf("Tx %s included in block %d", receipt.TxHash.Hex(), receipt.BlockNumber)
 
 	return nil
 }
@@ -2,49 +2,331 @@ package deal
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"math/big"
+	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/FIL-Builders/xchainClient/services/aggregator"
+	"github.com/FIL-Builders/xchainClient/utils"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	builtintypes "github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/lotus/api"
+	lotustypes "github.com/filecoin-project/lotus/chain/types"
 )
 
-// SmartContractDeal continuously runs logic until the context is canceled
+const (
+	// how often the prover contract is polled for deal notifications
+	relayPollInterval = 30 * time.Second
+	// epochs scanned for notifications when no checkpoint exists, one day of Filecoin blocks
+	defaultLookback = 2880
+	// max number of epochs per eth_getLogs query, Lotus rejects larger ranges
+	logsRange = 2000
+)
+
+// Mirror Oracles.sol's Status enum
+const (
+	statusNone = iota
+	statusDealPublished
+	statusDealActivated
+	statusDealTerminated
+)
+
+// Mirror Oracles.sol's DataAttestation struct
+type DataAttestation struct {
+	CommP    []byte
+	Duration int64
+	FILID    uint64
+	Status   *big.Int
+}
+
+// Relays storage proofs of deals made by the prover contract to the source chain OnRamp
+type relayer struct {
+	filClient  *ethclient.Client                 // Filecoin eth client for prover events
+	lotusAPI   aggregator.LotusDaemonAPIClientV0 // Lotus API for market deal state
+	srcClient  *ethclient.Client                 // source chain client for sending proofs
+	onramp     *bind.BoundContract               // OnRamp contract on the source chain
+	onrampAddr common.Address                    // address of the OnRamp for sending proofs
+	onRampABI  *abi.ABI                          // ABI of the OnRamp for sending proofs
+	txm        *utils.TxManager                  // sends proofs with the oracle key allowed to call proveDataStored
+	proverAddr common.Address                    // prover contract emitting deal notifications
+	proverABI  *abi.ABI                          // ABI of the prover's DealNotify event
+	dealClient address.Address                   // f4 address of the prover, the client of its deals
+	chainLabel string                            // deal label of deals made for this source chain
+	store      *relayStore                       // deals seen and aggregates proven
+}
+
+// SmartContractDeal relays storage proofs until the context is canceled
 func SmartContractDeal(ctx context.Context, cfg *config.Config, srcCfg *config.SourceChainConfig) error {
 	log.Println("Starting SmartContractDeal process...")
+	r, cleanup, err := newRelayer(ctx, cfg, srcCfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
 
-	// Example: Perform a periodic task in a loop until the context is canceled
-	ticker := time.NewTicker(5 * time.Second) // Adjust the interval as needed
+	ticker := time.NewTicker(relayPollInterval)
 	defer ticker.Stop()
-
 	for {
+		if err := r.poll(ctx); err != nil {
+			log.Printf("Error in SmartContractDeal process: %v", err)
+		}
 		select {
 		case <-ctx.Done():
 			// Handle graceful shutdown
 			log.Println("SmartContractDeal process is shutting down...")
 			return nil
 		case <-ticker.C:
-			// Example logic: Interact with a smart contract or process data
-			err := processSmartContractLogic(cfg, srcCfg)
-			if err != nil {
-				log.Printf("Error in SmartContractDeal process: %v", err)
-			} else {
-				log.Println("SmartContractDeal task completed successfully")
+		}
+	}
+}
+
+func newRelayer(ctx context.Context, cfg *config.Config, srcCfg *config.SourceChainConfig) (*relayer, func(), error) {
+	srcClient, err := ethclient.Dial(srcCfg.Api)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to Ethereum client for source chain at %s: %w", srcCfg.Api, err)
+	}
+	onRampABI, err := utils.LoadAbi(cfg.OnRampABIPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	onrampAddr := common.HexToAddress(srcCfg.OnRampAddress)
+	onramp := bind.NewBoundContract(onrampAddr, *onRampABI, srcClient, srcClient, srcClient)
+	auth, err := utils.LoadPrivateKey(cfg, srcCfg.ChainID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	proverABI, err := utils.LoadAbi(cfg.ProverABIPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := proverABI.Events["DealNotify"]; !ok {
+		return nil, nil, fmt.Errorf("prover abi %s has no DealNotify event", cfg.ProverABIPath)
+	}
+	filClient, err := ethclient.Dial(aggregator.LotusEthURL(cfg.Destination.LotusAPI))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to the Ethereum client on the destination chain: using url %s: %w", cfg.Destination.LotusAPI, err)
+	}
+	lAPI, closer, err := aggregator.NewLotusDaemonAPIClientV0(ctx, cfg.Destination.LotusAPI, 1, "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to the Lotus API on the destination chain: using url %s: %w", cfg.Destination.LotusAPI, err)
+	}
+
+	proverAddr := common.HexToAddress(cfg.Destination.ProverAddr)
+	dealClient, err := address.NewDelegatedAddress(builtintypes.EthereumAddressManagerActorID, proverAddr[:])
+	if err != nil {
+		closer()
+		return nil, nil, fmt.Errorf("failed to translate prover address (%s) into a Filecoin f4 address: %w", proverAddr.Hex(), err)
+	}
+	// Deals are labeled with the source chain ID, see aggregator.sendDeal
+	chainLabel, err := utils.EncodeChainIDAsString(big.NewInt(int64(srcCfg.ChainID)))
+	if err != nil {
+		closer()
+		return nil, nil, err
+	}
+
+	statePath := cfg.StatePath
+	if statePath == "" {
+		statePath = aggregator.DefaultStatePath
+	}
+	store, err := openRelayStore(filepath.Join(statePath, "relayer", strconv.Itoa(srcCfg.ChainID)))
+	if err != nil {
+		closer()
+		return nil, nil, err
+	}
+
+	r := &relayer{
+		filClient:  filClient,
+		lotusAPI:   lAPI,
+		srcClient:  srcClient,
+		onramp:     onramp,
+		onrampAddr: onrampAddr,
+		onRampABI:  onRampABI,
+		txm:        utils.NewTxManager(srcClient, auth, srcCfg.Tx),
+		proverAddr: proverAddr,
+		proverABI:  proverABI,
+		dealClient: dealClient,
+		chainLabel: chainLabel,
+		store:      store,
+	}
+	cleanup := func() {
+		closer()
+		if err := store.Close(); err != nil {
+			log.Printf("failed to close relayer store: %s", err)
+		}
+	}
+	return r, cleanup, nil
+}
+
+// Collect new deal notifications from the prover and relay proofs of every
+// deal waiting to become active
+func (r *relayer) poll(ctx context.Context) error {
+	if err := r.scanNotifications(ctx); err != nil {
+		return err
+	}
+	waiting, err := r.store.waitingDeals()
+	if err != nil {
+		return err
+	}
+	for _, rec := range waiting {
+		if err := r.relay(ctx, rec); err != nil {
+			log.Printf("[ERROR] failed to relay proof of deal %d: %s", rec.DealID, err)
+		}
+	}
+	return nil
+}
+
+// Record the deal of every DealNotify event emitted by the prover since the checkpoint
+func (r *relayer) scanNotifications(ctx context.Context) error {
+	head, err := r.filClient.BlockNumber(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get destination chain head: %w", err)
+	}
+	from, found, err := r.store.checkpoint()
+	if err != nil {
+		return err
+	}
+	if !found {
+		from = 0
+		if head > defaultLookback {
+			from = head - defaultLookback
+		}
+	}
+
+	event := r.proverABI.Events["DealNotify"]
+	for from <= head {
+		to := from + logsRange - 1
+		if to > head {
+			to = head
+		}
+		logs, err := r.filClient.FilterLogs(ctx, ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(from),
+			ToBlock:   new(big.Int).SetUint64(to),
+			Addresses: []common.Address{r.proverAddr},
+			Topics:    [][]common.Hash{{event.ID}},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to filter prover logs in blocks %d-%d: %w", from, to, err)
+		}
+		for _, l := range logs {
+			fields, err := event.Inputs.Unpack(l.Data)
+			if err != nil || len(fields) == 0 {
+				log.Printf("[ERROR] failed to unpack DealNotify event in tx %s: %v", l.TxHash.Hex(), err)
+				continue
+			}
+			dealID, ok := fields[0].(uint64)
+			if !ok {
+				log.Printf("[ERROR] unexpected deal ID %v in DealNotify event in tx %s", fields[0], l.TxHash.Hex())
+				continue
+			}
+			if err := r.store.addDeal(dealID); err != nil {
+				return err
 			}
 		}
+		if err := r.store.putCheckpoint(to + 1); err != nil {
+			return err
+		}
+		from = to + 1
 	}
+	return nil
 }
 
-// processSmartContractLogic handles the core logic of the SmartContractDeal process
-func processSmartContractLogic(cfg *config.Config, srcCfg *config.SourceChainConfig) error {
-	// Example placeholder logic:
-	// This is where you could interact with a smart contract, fetch data, or perform computations.
+// Return the attestation of a deal made by the client for this source chain once
+// the deal is active. A nil attestation with an empty reason means not active yet,
+// a reason means the deal will never be attested.
+func buildAttestation(md *api.MarketDeal, dealID filabi.DealID, client address.Address, chainLabel string, head filabi.ChainEpoch) (*DataAttestation, string) {
+	if md.Proposal.Client != client {
+		return nil, fmt.Sprintf("deal client %s is not the prover", md.Proposal.Client)
+	}
+	label, err := md.Proposal.Label.ToString()
+	if err != nil || label != chainLabel {
+		return nil, fmt.Sprintf("deal is for chain %q", label)
+	}
+	if md.State.SlashEpoch > 0 {
+		return nil, fmt.Sprintf("deal was slashed at epoch %d", md.State.SlashEpoch)
+	}
+	if md.State.SectorStartEpoch <= 0 {
+		if head > md.Proposal.StartEpoch {
+			return nil, "deal was not activated before its start epoch"
+		}
+		return nil, ""
+	}
+	return &DataAttestation{
+		CommP:    md.Proposal.PieceCID.Bytes(),
+		Duration: int64(md.Proposal.EndEpoch - md.Proposal.StartEpoch),
+		FILID:    uint64(dealID),
+		Status:   big.NewInt(statusDealActivated),
+	}, ""
+}
 
-	log.Printf("Processing smart contract logic with chain: %s and config: %+v", srcCfg.OnRampAddress, cfg)
+// Send the attestation of a deal to the OnRamp once the deal is active, unless
+// its aggregate was already proven
+func (r *relayer) relay(ctx context.Context, rec relayRecord) error {
+	tipset, err := r.lotusAPI.ChainHead(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get chain head: %w", err)
+	}
+	md, err := r.lotusAPI.StateMarketStorageDeal(ctx, filabi.DealID(rec.DealID), lotustypes.EmptyTSK)
+	if err != nil {
+		return fmt.Errorf("failed to get market state: %w", err)
+	}
+	attestation, reason := buildAttestation(md, filabi.DealID(rec.DealID), r.dealClient, r.chainLabel, tipset.Height())
+	if reason != "" {
+		log.Printf("Deal %d will not be relayed: %s", rec.DealID, reason)
+		rec.Status = relayIgnored
+		rec.Reason = reason
+		return r.store.putDeal(rec)
+	}
+	if attestation == nil {
+		return nil
+	}
 
-	// TODO: Implement actual logic to interact with a smart contract
-	// - Call an Ethereum or Filecoin smart contract
-	// - Process events or data
-	// - Execute business logic
+	var out []interface{}
+	if err := r.onramp.Call(&bind.CallOpts{Context: ctx}, &out, "commPToAggregateID", attestation.CommP); err != nil {
+		return fmt.Errorf("failed to look up aggregate of %s: %w", md.Proposal.PieceCID, err)
+	}
+	if len(out) == 0 {
+		return fmt.Errorf("empty aggregate lookup of %s", md.Proposal.PieceCID)
+	}
+	aggregateID, ok := out[0].(uint64)
+	if !ok {
+		return fmt.Errorf("unexpected aggregate ID %v of %s", out[0], md.Proposal.PieceCID)
+	}
+	rec.AggregateID = aggregateID
+	rec.PieceCID = md.Proposal.PieceCID.String()
+	out = nil
+	if err := r.onramp.Call(&bind.CallOpts{Context: ctx}, &out, "provenAggregations", rec.AggregateID); err != nil {
+		return fmt.Errorf("failed to check whether aggregate %d is proven: %w", rec.AggregateID, err)
+	}
+	if len(out) == 0 {
+		return fmt.Errorf("empty proven state of aggregate %d", rec.AggregateID)
+	}
+	proven, ok := out[0].(bool)
+	if !ok {
+		return fmt.Errorf("unexpected proven state %v of aggregate %d", out[0], rec.AggregateID)
+	}
+	if proven {
+		log.Printf("Aggregate %d (%s) of deal %d is already proven", rec.AggregateID, rec.PieceCID, rec.DealID)
+		rec.Status = relayProven
+		return r.store.putDeal(rec)
+	}
 
-	return nil // Return an error if something fails
+	receipt, err := r.txm.Transact(ctx, r.onrampAddr, r.onRampABI, "proveDataStored", *attestation)
+	if err != nil {
+		return err
+	}
+	log.Printf("Tx %s proving aggregate %d (%s) with deal %d included", receipt.TxHash.Hex(), rec.AggregateID, rec.PieceCID, rec.DealID)
+	rec.Status = relayProven
+	rec.TxHash = receipt.TxHash.Hex()
+	return r.store.putDeal(rec)
 }
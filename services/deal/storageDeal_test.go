@@ -0,0 +1,70 @@
+package deal
+
+import (
+	"testing"
+
+	"github.com/FIL-Builders/xchainClient/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/filecoin-project/go-address"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	builtintypes "github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildAttestation(t *testing.T) {
+	prover := common.HexToAddress("0x8560C0fAC0EF0547863e1748D15B85a5c3FF4B2f")
+	client, err := address.NewDelegatedAddress(builtintypes.EthereumAddressManagerActorID, prover[:])
+	assert.NoError(t, err)
+	pieceCID, err := commcid.DataCommitmentV1ToCID(make([]byte, 32))
+	assert.NoError(t, err)
+	label, err := market.NewLabelFromString("43113")
+	assert.NoError(t, err)
+
+	deal := func(sectorStart, slash filabi.ChainEpoch) *api.MarketDeal {
+		return &api.MarketDeal{
+			Proposal: market.DealProposal{PieceCID: pieceCID, Client: client, Label: label, StartEpoch: 100, EndEpoch: 600},
+			State:    api.MarketDealState{SectorStartEpoch: sectorStart, LastUpdatedEpoch: -1, SlashEpoch: slash},
+		}
+	}
+
+	att, reason := buildAttestation(deal(-1, -1), 7, client, "43113", 50)
+	assert.Nil(t, att)
+	assert.Empty(t, reason)
+
+	att, reason = buildAttestation(deal(90, -1), 7, client, "43113", 150)
+	assert.Empty(t, reason)
+	if assert.NotNil(t, att) {
+		assert.Equal(t, pieceCID.Bytes(), att.CommP)
+		assert.Equal(t, int64(500), att.Duration)
+		assert.Equal(t, uint64(7), att.FILID)
+	}
+
+	// The attestation must match the OnRamp's proveDataStored signature
+	onRampABI, err := utils.LoadAbi("../../config/onramp-abi.json")
+	assert.NoError(t, err)
+	_, err = onRampABI.Pack("proveDataStored", *att)
+	assert.NoError(t, err)
+
+	_, reason = buildAttestation(deal(90, -1), 7, client, "84532", 150)
+	assert.NotEmpty(t, reason)
+	_, reason = buildAttestation(deal(90, -1), 7, client, "4311", 150)
+	assert.NotEmpty(t, reason)
+
+	// Deals are labeled with a single chain ID
+	label, err = market.NewLabelFromString("43113,84532")
+	assert.NoError(t, err)
+	_, reason = buildAttestation(deal(90, -1), 7, client, "43113", 150)
+	assert.NotEmpty(t, reason)
+	label, err = market.NewLabelFromString("43113")
+	assert.NoError(t, err)
+	_, reason = buildAttestation(deal(-1, -1), 7, client, "43113", 150)
+	assert.NotEmpty(t, reason)
+	_, reason = buildAttestation(deal(90, 120), 7, client, "43113", 150)
+	assert.NotEmpty(t, reason)
+	other, _ := address.NewIDAddress(1000)
+	_, reason = buildAttestation(deal(90, -1), 7, other, "43113", 150)
+	assert.NotEmpty(t, reason)
+}
@@ -0,0 +1,118 @@
+package deal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	// Deal was notified by the prover and is waiting to become active
+	relayWaiting = "waiting"
+	// Aggregate of the deal is proven on the source chain
+	relayProven = "proven"
+	// Deal will never be relayed, see the reason
+	relayIgnored = "ignored"
+)
+
+const (
+	dealPrefix    = "deal/"
+	checkpointKey = "meta/checkpoint"
+)
+
+// Relay state of a deal notified by the prover contract
+type relayRecord struct {
+	DealID      uint64    `json:"dealID"`
+	Status      string    `json:"status"`
+	PieceCID    string    `json:"pieceCID,omitempty"`
+	AggregateID uint64    `json:"aggregateID,omitempty"`
+	TxHash      string    `json:"txHash,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// Durable relayer state kept in a leveldb database
+type relayStore struct {
+	db *leveldb.DB
+}
+
+func openRelayStore(path string) (*relayStore, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create relayer state directory: %w", err)
+	}
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open relayer state database: %w", err)
+	}
+	return &relayStore{db: db}, nil
+}
+
+func (s *relayStore) Close() error {
+	return s.db.Close()
+}
+
+func dealKey(dealID uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", dealPrefix, dealID))
+}
+
+func (s *relayStore) putDeal(rec relayRecord) error {
+	rec.UpdatedAt = time.Now()
+	bs, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal deal %d: %w", rec.DealID, err)
+	}
+	return s.db.Put(dealKey(rec.DealID), bs, nil)
+}
+
+// Record a notified deal as waiting unless it is already known
+func (s *relayStore) addDeal(dealID uint64) error {
+	ok, err := s.db.Has(dealKey(dealID), nil)
+	if err != nil || ok {
+		return err
+	}
+	return s.putDeal(relayRecord{DealID: dealID, Status: relayWaiting})
+}
+
+func (s *relayStore) waitingDeals() ([]relayRecord, error) {
+	var waiting []relayRecord
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(dealPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var rec relayRecord
+		if err := json.Unmarshal(iter.Value(), &rec); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal %s: %w", iter.Key(), err)
+		}
+		if rec.Status == relayWaiting {
+			waiting = append(waiting, rec)
+		}
+	}
+	return waiting, iter.Error()
+}
+
+// Return the first destination block not scanned for notifications yet
+func (s *relayStore) checkpoint() (uint64, bool, error) {
+	bs, err := s.db.Get([]byte(checkpointKey), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	block, err := strconv.ParseUint(string(bs), 10, 64)
+	return block, err == nil, err
+}
+
+func (s *relayStore) putCheckpoint(block uint64) error {
+	return s.db.Put([]byte(checkpointKey), []byte(strconv.FormatUint(block, 10)), nil)
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// selector of the error raised by failing asserts and arithmetic
+var panicSelector = crypto.Keccak256([]byte("Panic(uint256)"))[:4]
+
+// RevertError reports a contract call that reverts when simulated
+type RevertError struct {
+	Method string
+	Reason string // human-readable reason decoded from Data
+	Data   []byte // raw revert data
+}
+
+func (e *RevertError) Error() string {
+	return fmt.Sprintf("%s would revert: %s", e.Method, e.Reason)
+}
+
+// Turn an error of a call reverted by the contract into a RevertError, returns nil for other errors
+func revertError(method string, err error, contractABI *abi.ABI) error {
+	var data []byte
+	var dataErr rpc.DataError
+	if errors.As(err, &dataErr) {
+		switch d := dataErr.ErrorData().(type) {
+		case string:
+			data, _ = hexutil.Decode(d)
+		case []byte:
+			data = d
+		}
+	}
+	if data == nil && !strings.Contains(err.Error(), "execution reverted") {
+		return nil
+	}
+	return &RevertError{Method: method, Reason: DecodeRevert(data, contractABI), Data: data}
+}
+
+// DecodeRevert turns revert data into a readable reason. Solidity Error(string) and
+// Panic(uint256) errors are always decoded, custom errors if they are in the contract ABI.
+func DecodeRevert(data []byte, contractABI *abi.ABI) string {
+	if len(data) == 0 {
+		return "reverted without a reason"
+	}
+	if reason, err := abi.UnpackRevert(data); err == nil {
+		if bytes.HasPrefix(data, panicSelector) {
+			return "panic: " + reason
+		}
+		return reason
+	}
+	if contractABI != nil && len(data) >= 4 {
+		if abiErr, err := contractABI.ErrorByID([4]byte(data[:4])); err == nil {
+			if unpacked, err := abiErr.Unpack(data); err == nil {
+				values := unpacked.([]interface{})
+				args := make([]string, len(values))
+				for i, v := range values {
+					if bs, ok := v.([]byte); ok {
+						v = hexutil.Encode(bs)
+					}
+					args[i] = fmt.Sprintf("%s=%v", abiErr.Inputs[i].Name, v)
+				}
+				return fmt.Sprintf("%s(%s)", abiErr.Name, strings.Join(args, ", "))
+			}
+		}
+	}
+	return "unknown error " + hexutil.Encode(data)
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+const revertTestABI = `[
+	{"type":"function","name":"offerData","stateMutability":"nonpayable","inputs":[{"name":"size","type":"uint256"}],"outputs":[]},
+	{"type":"error","name":"InsufficientPayment","inputs":[{"name":"want","type":"uint256"},{"name":"token","type":"address"}]}
+]`
+
+// eth_call error carrying revert data as returned by the node
+type revertRPCError struct {
+	data string
+}
+
+func (e revertRPCError) Error() string          { return "execution reverted" }
+func (e revertRPCError) ErrorData() interface{} { return e.data }
+
+func packRevert(t *testing.T, sig string, typ string, value interface{}) []byte {
+	abiType, err := abi.NewType(typ, "", nil)
+	if err != nil {
+		t.Fatalf("failed to make type: %v", err)
+	}
+	args, err := abi.Arguments{{Type: abiType}}.Pack(value)
+	if err != nil {
+		t.Fatalf("failed to pack revert: %v", err)
+	}
+	return append(crypto.Keccak256([]byte(sig))[:4], args...)
+}
+
+func TestDecodeRevert(t *testing.T) {
+	contractABI, err := abi.JSON(strings.NewReader(revertTestABI))
+	if err != nil {
+		t.Fatalf("failed to parse abi: %v", err)
+	}
+	token := common.HexToAddress("0x5c31e78f3f7329769734f5ff1ac7e22c243e817e")
+
+	assert.Equal(t, "offer too small", DecodeRevert(packRevert(t, "Error(string)", "string", "offer too small"), &contractABI))
+	assert.Equal(t, "panic: arithmetic underflow or overflow", DecodeRevert(packRevert(t, "Panic(uint256)", "uint256", big.NewInt(0x11)), &contractABI))
+
+	abiErr := contractABI.Errors["InsufficientPayment"]
+	custom, err := abiErr.Inputs.Pack(big.NewInt(1000), token)
+	assert.NoError(t, err)
+	custom = append(abiErr.ID[:4], custom...)
+	assert.Equal(t, "InsufficientPayment(want=1000, token="+token.Hex()+")", DecodeRevert(custom, &contractABI))
+
+	assert.Equal(t, "unknown error "+hexutil.Encode(custom), DecodeRevert(custom, nil))
+	assert.Equal(t, "reverted without a reason", DecodeRevert(nil, &contractABI))
+}
+
+// Test that calls which would revert are never broadcast
+func TestTransactRevert(t *testing.T) {
+	contractABI, err := abi.JSON(strings.NewReader(revertTestABI))
+	if err != nil {
+		t.Fatalf("failed to parse abi: %v", err)
+	}
+	data := packRevert(t, "Error(string)", "string", "offer too small")
+	backend := &fakeTxBackend{baseFee: big.NewInt(100), tip: big.NewInt(50), callErr: revertRPCError{data: hexutil.Encode(data)}}
+	m := testTxManager(t, backend, config.TxConfig{})
+
+	_, err = m.Transact(context.Background(), common.Address{}, &contractABI, "offerData", big.NewInt(1))
+	var revertErr *RevertError
+	if assert.True(t, errors.As(err, &revertErr)) {
+		assert.Equal(t, "offerData", revertErr.Method)
+		assert.Equal(t, "offer too small", revertErr.Reason)
+	}
+	assert.Equal(t, "offerData would revert: offer too small", err.Error())
+	assert.Empty(t, backend.sent)
+
+	// Other simulation failures are not reverts but are not broadcast either
+	backend.callErr = errors.New("connection refused")
+	_, err = m.Transact(context.Background(), common.Address{}, &contractABI, "offerData", big.NewInt(1))
+	assert.False(t, errors.As(err, &revertErr))
+	assert.Empty(t, backend.sent)
+}
@@ -0,0 +1,282 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const (
+	// default time to wait for a transaction before replacing it
+	defaultReceiptTimeout = 3 * time.Minute
+	// default fee increase of a replacement, nodes require at least 10%
+	defaultFeeBumpPercent = 20
+	// default number of replacements sent before giving up on a transaction
+	defaultMaxReplacements = 5
+)
+
+// how often receipts of sent transactions are polled
+var receiptPollInterval = time.Second
+
+// TxBackend is the part of an Ethereum client used to simulate and send transactions
+type TxBackend interface {
+	bind.ContractTransactor
+	CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error)
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+}
+
+// TxManager sends the transactions of one account on one chain. It assigns nonces
+// locally so concurrent transactions do not collide, caps EIP-1559 fees and replaces
+// transactions that are not included in time with higher fees.
+type TxManager struct {
+	backend         TxBackend
+	auth            *bind.TransactOpts
+	maxFeePerGas    *big.Int // nil for no cap
+	maxTipPerGas    *big.Int // nil for no cap
+	timeout         time.Duration
+	bumpPercent     int64
+	maxReplacements int
+	lk              sync.Mutex // serializes nonce assignment
+	nonce           uint64     // next nonce to use
+	synced          bool       // false until the nonce is loaded from the pending state
+}
+
+// Fees of a transaction, gasPrice is only set on chains without a base fee
+type txFees struct {
+	tipCap   *big.Int
+	feeCap   *big.Int
+	gasPrice *big.Int
+}
+
+func NewTxManager(backend TxBackend, auth *bind.TransactOpts, cfg config.TxConfig) *TxManager {
+	m := &TxManager{
+		backend:         backend,
+		auth:            auth,
+		timeout:         time.Duration(cfg.ReceiptTimeout) * time.Second,
+		bumpPercent:     int64(cfg.FeeBumpPercent),
+		maxReplacements: cfg.MaxReplacements,
+	}
+	if cfg.MaxFeePerGas > 0 {
+		m.maxFeePerGas = new(big.Int).SetUint64(cfg.MaxFeePerGas)
+	}
+	if cfg.MaxPriorityFeePerGas > 0 {
+		m.maxTipPerGas = new(big.Int).SetUint64(cfg.MaxPriorityFeePerGas)
+	}
+	if m.timeout <= 0 {
+		m.timeout = defaultReceiptTimeout
+	}
+	if m.bumpPercent <= 0 {
+		m.bumpPercent = defaultFeeBumpPercent
+	}
+	if m.maxReplacements <= 0 {
+		m.maxReplacements = defaultMaxReplacements
+	}
+	return m
+}
+
+// Transact calls method of the contract at `to` and waits until the call is included.
+// The call is simulated first and not sent if it would revert, a *RevertError with
+// the reason decoded from the contract ABI is returned instead. A receipt with a
+// failed status is returned with an error.
+func (m *TxManager) Transact(ctx context.Context, to common.Address, contractABI *abi.ABI, method string, params ...interface{}) (*types.Receipt, error) {
+	return m.TransactNotify(ctx, nil, to, contractABI, method, params...)
+}
+
+// TransactNotify is Transact calling sent with the hash of every transaction sent for
+// the call, the first one and its replacements, before waiting for their inclusion.
+// Callers persist the hashes to learn the outcome of the call after a restart.
+func (m *TxManager) TransactNotify(ctx context.Context, sent func(common.Hash), to common.Address, contractABI *abi.ABI, method string, params ...interface{}) (*types.Receipt, error) {
+	data, err := contractABI.Pack(method, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack %s call: %w", method, err)
+	}
+	if _, err := m.backend.CallContract(ctx, ethereum.CallMsg{From: m.auth.From, To: &to, Data: data}, nil); err != nil {
+		if revertErr := revertError(method, err, contractABI); revertErr != nil {
+			return nil, revertErr
+		}
+		return nil, fmt.Errorf("failed to simulate %s: %w", method, err)
+	}
+	receipt, err := m.send(ctx, to, data, sent)
+	if err != nil {
+		return receipt, fmt.Errorf("%s: %w", method, err)
+	}
+	return receipt, nil
+}
+
+// Send a transaction with data to `to` and wait until it is included, replacing it
+// with higher fees each time it is not included within the receipt timeout
+func (m *TxManager) send(ctx context.Context, to common.Address, data []byte, sent func(common.Hash)) (*types.Receipt, error) {
+	gas, err := m.backend.EstimateGas(ctx, ethereum.CallMsg{From: m.auth.From, To: &to, Data: data})
+	if err != nil {
+		return nil, fmt.Errorf("failed to estimate gas: %w", err)
+	}
+	fees, err := m.suggestFees(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lk.Lock()
+	if !m.synced {
+		m.nonce, err = m.backend.PendingNonceAt(ctx, m.auth.From)
+		if err != nil {
+			m.lk.Unlock()
+			return nil, fmt.Errorf("failed to get nonce of %s: %w", m.auth.From, err)
+		}
+		m.synced = true
+	}
+	nonce := m.nonce
+	tx, err := m.signAndSend(ctx, nonce, to, data, gas, fees)
+	if err != nil {
+		// The node may know transactions this manager did not send, reload the nonce next time
+		m.synced = false
+		m.lk.Unlock()
+		return nil, err
+	}
+	m.nonce++
+	m.lk.Unlock()
+	log.Printf("Sent tx %s with nonce %d", tx.Hash().Hex(), nonce)
+	if sent != nil {
+		sent(tx.Hash())
+	}
+
+	// Any of the sent transactions may be the one included
+	txs := []*types.Transaction{tx}
+	replacements := 0
+	deadline := time.Now().Add(m.timeout)
+	ticker := time.NewTicker(receiptPollInterval)
+	defer ticker.Stop()
+	for {
+		for _, tx := range txs {
+			receipt, err := m.backend.TransactionReceipt(ctx, tx.Hash())
+			if errors.Is(err, ethereum.NotFound) {
+				continue
+			}
+			if err != nil {
+				log.Printf("failed to get receipt of tx %s: %s", tx.Hash().Hex(), err)
+				continue
+			}
+			if receipt.Status != types.ReceiptStatusSuccessful {
+				return receipt, fmt.Errorf("tx %s failed in block %d", tx.Hash().Hex(), receipt.BlockNumber)
+			}
+			return receipt, nil
+		}
+
+		if time.Now().After(deadline) {
+			if replacements == m.maxReplacements {
+				m.lk.Lock()
+				m.synced = false
+				m.lk.Unlock()
+				return nil, fmt.Errorf("tx %s was not included after %d replacements", tx.Hash().Hex(), replacements)
+			}
+			replacements++
+			deadline = time.Now().Add(m.timeout)
+			bumped := m.bumpFees(fees)
+			if !bumped.exceeds(fees) {
+				log.Printf("Tx %s with nonce %d is not included yet, fee caps reached so it is not replaced", tx.Hash().Hex(), nonce)
+			} else if replacement, err := m.signAndSend(ctx, nonce, to, data, gas, bumped); err != nil {
+				log.Printf("failed to replace tx %s: %s", tx.Hash().Hex(), err)
+			} else {
+				log.Printf("Tx %s with nonce %d is not included after %s, replaced by %s", tx.Hash().Hex(), nonce, m.timeout, replacement.Hash().Hex())
+				fees = bumped
+				txs = append(txs, replacement)
+				if sent != nil {
+					sent(replacement.Hash())
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *TxManager) signAndSend(ctx context.Context, nonce uint64, to common.Address, data []byte, gas uint64, fees txFees) (*types.Transaction, error) {
+	var inner types.TxData
+	if fees.gasPrice != nil {
+		inner = &types.LegacyTx{Nonce: nonce, GasPrice: fees.gasPrice, Gas: gas, To: &to, Data: data}
+	} else {
+		inner = &types.DynamicFeeTx{Nonce: nonce, GasTipCap: fees.tipCap, GasFeeCap: fees.feeCap, Gas: gas, To: &to, Data: data}
+	}
+	tx, err := m.auth.Signer(m.auth.From, types.NewTx(inner))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign tx: %w", err)
+	}
+	if err := m.backend.SendTransaction(ctx, tx); err != nil {
+		return nil, fmt.Errorf("failed to send tx: %w", err)
+	}
+	return tx, nil
+}
+
+// Suggest fees from the latest base fee and the node's tip suggestion, within the caps
+func (m *TxManager) suggestFees(ctx context.Context) (txFees, error) {
+	head, err := m.backend.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return txFees{}, fmt.Errorf("failed to get latest header: %w", err)
+	}
+	if head.BaseFee == nil {
+		gasPrice, err := m.backend.SuggestGasPrice(ctx)
+		if err != nil {
+			return txFees{}, fmt.Errorf("failed to suggest gas price: %w", err)
+		}
+		return txFees{gasPrice: capFee(gasPrice, m.maxFeePerGas)}, nil
+	}
+	tip, err := m.backend.SuggestGasTipCap(ctx)
+	if err != nil {
+		return txFees{}, fmt.Errorf("failed to suggest gas tip: %w", err)
+	}
+	return m.capFees(tip, new(big.Int).Add(new(big.Int).Mul(head.BaseFee, big.NewInt(2)), tip)), nil
+}
+
+// Raise the fees by the bump percentage, within the caps
+func (m *TxManager) bumpFees(fees txFees) txFees {
+	bump := func(fee *big.Int) *big.Int {
+		bumped := new(big.Int).Mul(fee, big.NewInt(100+m.bumpPercent))
+		bumped.Div(bumped, big.NewInt(100))
+		if bumped.Cmp(fee) == 0 {
+			bumped.Add(bumped, big.NewInt(1))
+		}
+		return bumped
+	}
+	if fees.gasPrice != nil {
+		return txFees{gasPrice: capFee(bump(fees.gasPrice), m.maxFeePerGas)}
+	}
+	return m.capFees(bump(fees.tipCap), bump(fees.feeCap))
+}
+
+func (m *TxManager) capFees(tip, feeCap *big.Int) txFees {
+	tip = capFee(tip, m.maxTipPerGas)
+	feeCap = capFee(feeCap, m.maxFeePerGas)
+	if tip.Cmp(feeCap) > 0 {
+		tip = feeCap
+	}
+	return txFees{tipCap: tip, feeCap: feeCap}
+}
+
+func capFee(fee, max *big.Int) *big.Int {
+	if max != nil && fee.Cmp(max) > 0 {
+		return new(big.Int).Set(max)
+	}
+	return fee
+}
+
+// Report whether a transaction paying f can replace one paying old
+func (f txFees) exceeds(old txFees) bool {
+	if f.gasPrice != nil {
+		return f.gasPrice.Cmp(old.gasPrice) > 0
+	}
+	return f.tipCap.Cmp(old.tipCap) > 0 && f.feeCap.Cmp(old.feeCap) > 0
+}
@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FIL-Builders/xchainClient/config"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+// Chain stand-in that includes transactions once mineAfter of them were sent
+type fakeTxBackend struct {
+	lk        sync.Mutex
+	baseFee   *big.Int
+	tip       *big.Int
+	nonce     uint64
+	mineAfter int
+	status    uint64
+	callErr   error // returned by eth_call simulations
+	sent      []*types.Transaction
+}
+
+func (b *fakeTxBackend) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	return nil, b.callErr
+}
+
+func (b *fakeTxBackend) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	return 50000, nil
+}
+
+func (b *fakeTxBackend) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return new(big.Int).Add(b.baseFee, b.tip), nil
+}
+
+func (b *fakeTxBackend) SuggestGasTipCap(ctx context.Context) (*big.Int, error) {
+	return b.tip, nil
+}
+
+func (b *fakeTxBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.sent = append(b.sent, tx)
+	return nil
+}
+
+func (b *fakeTxBackend) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return &types.Header{Number: big.NewInt(10), BaseFee: b.baseFee}, nil
+}
+
+func (b *fakeTxBackend) PendingCodeAt(ctx context.Context, account common.Address) ([]byte, error) {
+	return nil, nil
+}
+
+func (b *fakeTxBackend) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	return b.nonce, nil
+}
+
+func (b *fakeTxBackend) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if len(b.sent) < b.mineAfter {
+		return nil, ethereum.NotFound
+	}
+	if last := b.sent[len(b.sent)-1]; last.Hash() == txHash {
+		return &types.Receipt{Status: b.status, TxHash: txHash, BlockNumber: big.NewInt(11)}, nil
+	}
+	return nil, ethereum.NotFound
+}
+
+func testTxManager(t *testing.T, backend *fakeTxBackend, cfg config.TxConfig) *TxManager {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	auth, err := bind.NewKeyedTransactorWithChainID(key, big.NewInt(43113))
+	if err != nil {
+		t.Fatalf("failed to create transactor: %v", err)
+	}
+	return NewTxManager(backend, auth, cfg)
+}
+
+func TestTxManagerNonces(t *testing.T) {
+	backend := &fakeTxBackend{baseFee: big.NewInt(100), tip: big.NewInt(50), nonce: 7, status: types.ReceiptStatusSuccessful}
+	m := testTxManager(t, backend, config.TxConfig{MaxFeePerGas: 200, MaxPriorityFeePerGas: 30})
+	to := common.HexToAddress("0xeE857540dddB6E6EA10a5c84f57562F11D5Fb47D")
+
+	for i := 0; i < 2; i++ {
+		_, err := m.send(context.Background(), to, []byte{0x01}, nil)
+		assert.NoError(t, err)
+	}
+	if assert.Len(t, backend.sent, 2) {
+		assert.Equal(t, uint64(7), backend.sent[0].Nonce())
+		assert.Equal(t, uint64(8), backend.sent[1].Nonce())
+		assert.Equal(t, big.NewInt(30), backend.sent[0].GasTipCap())
+		assert.Equal(t, big.NewInt(200), backend.sent[0].GasFeeCap())
+	}
+
+	// Failed transactions are reported
+	backend.status = types.ReceiptStatusFailed
+	receipt, err := m.send(context.Background(), to, []byte{0x01}, nil)
+	assert.Error(t, err)
+	if assert.NotNil(t, receipt) {
+		assert.Equal(t, types.ReceiptStatusFailed, receipt.Status)
+	}
+}
+
+func TestTxManagerReplacement(t *testing.T) {
+	interval := receiptPollInterval
+	receiptPollInterval = time.Millisecond
+	defer func() { receiptPollInterval = interval }()
+
+	backend := &fakeTxBackend{baseFee: big.NewInt(100), tip: big.NewInt(50), mineAfter: 2, status: types.ReceiptStatusSuccessful}
+	m := testTxManager(t, backend, config.TxConfig{})
+	m.timeout = 10 * time.Millisecond
+	to := common.HexToAddress("0xeE857540dddB6E6EA10a5c84f57562F11D5Fb47D")
+
+	var hashes []common.Hash
+	receipt, err := m.send(context.Background(), to, []byte{0x01}, func(hash common.Hash) { hashes = append(hashes, hash) })
+	assert.NoError(t, err)
+	if assert.Len(t, backend.sent, 2) {
+		original, replacement := backend.sent[0], backend.sent[1]
+		assert.Equal(t, []common.Hash{original.Hash(), replacement.Hash()}, hashes)
+		assert.Equal(t, replacement.Hash(), receipt.TxHash)
+		assert.Equal(t, original.Nonce(), replacement.Nonce())
+		assert.Equal(t, big.NewInt(250), original.GasFeeCap())
+		assert.Equal(t, big.NewInt(300), replacement.GasFeeCap())
+		assert.Equal(t, big.NewInt(60), replacement.GasTipCap())
+	}
+
+	// Transactions at the fee caps are not replaced and eventually given up on
+	backend.sent = nil
+	backend.mineAfter = 100
+	m = testTxManager(t, backend, config.TxConfig{MaxFeePerGas: 250, MaxReplacements: 2})
+	m.timeout = time.Millisecond
+	_, err = m.send(context.Background(), to, []byte{0x01}, nil)
+	assert.Error(t, err)
+	assert.Len(t, backend.sent, 1)
+}